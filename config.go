@@ -1,13 +1,18 @@
 package memongo
 
 import (
+	"context"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tryvium-travels/memongo/memongolog"
@@ -32,16 +37,149 @@ type Options struct {
 	// be downloaded
 	MongoVersion string
 
+	// Platform, Arch and OSName override what's detected about the system
+	// when picking which build of MongoDB to download, e.g. inside a
+	// container whose /etc/os-release describes the build image. See
+	// mongobin.SpecOverrides for the values they take. They default to the
+	// MEMONGO_PLATFORM, MEMONGO_ARCH and MEMONGO_OS_NAME environment
+	// variables.
+	Platform string
+	Arch     string
+	OSName   string
+
+	// A JSON file of rules for picking the build of MongoDB to download,
+	// tried before the ones memongo ships with (see
+	// mongobin.LoadPlatformRules). Defaults to the
+	// MEMONGO_PLATFORM_RULES_FILE environment variable.
+	PlatformRulesFile string
+
+	// Edition of MongoDB to download. With Enterprise, mongod is started with
+	// the inMemory storage engine. Defaults to the MEMONGO_EDITION
+	// environment variable ("community" or "enterprise").
+	Edition mongobin.Edition
+
+	// The size of the inMemory storage engine's cache, in GB. Only used with
+	// the Enterprise edition. Defaults to the MEMONGO_IN_MEMORY_SIZE_GB
+	// environment variable, or to mongod's default (half the RAM, minus 1 GB).
+	InMemorySizeGB float64
+
 	// If given, mongod will be downloaded from this URL instead of the
-	// auto-detected URL based on the current platform and MongoVersion
+	// auto-detected URL based on the current platform and MongoVersion. This
+	// may also be a file:// URL or a path to a local .tgz archive.
 	DownloadURL string
 
+	// A directory of vendored archives. If it holds an archive with the same
+	// name as the one that would be downloaded, that archive is used instead
+	// of going to the network. Defaults to the MEMONGO_ARCHIVE_DIR
+	// environment variable.
+	ArchiveDir string
+
+	// If given (and DownloadURL isn't), mongod will be downloaded from the URL
+	// obtained by filling in this template with the auto-detected platform
+	// and MongoVersion, e.g.
+	// https://mirror.example.com/mongo/{version}/{platform}-{arch}-{os}.tgz.
+	// See mongobin.DownloadSpec.ExpandURLTemplate for the supported
+	// placeholders. Defaults to the MEMONGO_DOWNLOAD_URL_TEMPLATE environment
+	// variable.
+	DownloadURLTemplate string
+
+	// Mirrors to download mongod from, tried in order before falling back to
+	// fastdl.mongodb.org. Each mirror is either a base URL laid out like
+	// fastdl.mongodb.org, or a URL template (see
+	// mongobin.DownloadSpec.ExpandURLTemplate). Mirrors are not used if
+	// DownloadURL is given. Defaults to the comma-separated list in the
+	// MEMONGO_DOWNLOAD_MIRRORS environment variable.
+	Mirrors []string
+
 	// If given, this binary will be run instead of downloading a mongod binary
 	MongodBin string
 
-	// Logger for printing messages. Defaults to printing to stdout.
+	// If given, mongod is resolved by this provider instead of using
+	// MongodBin or downloading it, e.g. to find it in Bazel runfiles. See
+	// mongobin.ChainProvider to try several sources.
+	BinaryProvider mongobin.BinaryProvider
+
+	// If given, mongod is extracted from BinaryFSPath in this filesystem
+	// instead of downloading it, e.g. from a binary embedded in your tests
+	// with go:embed. The file may be mongod itself, or an archive holding
+	// it. It's extracted into the cache once. See mongobin.FSProvider.
+	BinaryFS fs.FS
+
+	// The path to mongod, or an archive holding it, in BinaryFS. Defaults to
+	// mongod.
+	BinaryFSPath string
+
+	// If given, mongod is pulled out of this container image instead of
+	// downloading it, e.g. "mongo:7.0.2" on Alpine. See
+	// mongobin.OCIImageProvider. Defaults to the MEMONGO_BINARY_IMAGE
+	// environment variable.
+	BinaryImage string
+
+	// The credentials for BinaryImage's registry. Default to the
+	// MEMONGO_BINARY_IMAGE_USERNAME and MEMONGO_BINARY_IMAGE_PASSWORD
+	// environment variables.
+	BinaryImageUsername string
+	BinaryImagePassword string
+
+	// If set, a mongod installed on the system is used when it's
+	// MongoVersion, instead of downloading it. It's looked up in $PATH and
+	// in mongobin.SystemBinaryDirs. Defaults to the
+	// MEMONGO_PREFER_SYSTEM_BINARY environment variable.
+	PreferSystemBinary bool
+
+	// If set with PreferSystemBinary, a system mongod with the same major
+	// and minor version as MongoVersion is used too, e.g. 6.0.5 for 6.0.4.
+	// Defaults to the MEMONGO_SYSTEM_BINARY_MATCH_MINOR environment variable.
+	SystemBinaryMatchMinor bool
+
+	// If set, the checksum of a cached mongod is checked against the one
+	// recorded when it was extracted before it's used. A corrupt cache entry
+	// is quarantined and downloaded again. Defaults to the
+	// MEMONGO_VERIFY_CACHE environment variable.
+	VerifyCache bool
+
+	// If set, tarballs are saved to the cache while they're downloaded and
+	// extracted afterwards, so a download interrupted by the process exiting
+	// is resumed by the next run. Otherwise, they're extracted as they're
+	// downloaded, which writes less to disk. Defaults to the
+	// MEMONGO_RESUMABLE_DOWNLOADS environment variable.
+	ResumableDownloads bool
+
+	// If set, the build of MongoDB for the detected distro release is used as
+	// is. Otherwise, when MongoDB doesn't publish that build for MongoVersion,
+	// the newest published build for an older release of the same distro is
+	// used instead (see mongobin.ResolveCompatibleSpec). Defaults to the
+	// MEMONGO_STRICT_PLATFORM_MATCH environment variable.
+	StrictPlatformMatch bool
+
+	// If given, this client is used to download mongod, e.g. to go through a
+	// proxy or trust a corporate CA
+	HTTPClient *http.Client
+
+	// Headers to send with the download request, e.g. an Authorization header
+	// for an authenticated artifact store. Defaults to the headers in the
+	// MEMONGO_DOWNLOAD_HEADERS environment variable, which holds one
+	// "Name: value" header per line.
+	DownloadHeaders http.Header
+
+	// If given, binaries that aren't in the cache are fetched from this
+	// second-level cache before downloading them, and binaries that had to
+	// be downloaded are uploaded to it, e.g. to share them between CI
+	// runners. Defaults to a mongobin.HTTPRemoteCache for the URL in the
+	// MEMONGO_REMOTE_CACHE_URL environment variable, which is sent the
+	// headers in MEMONGO_REMOTE_CACHE_HEADERS (laid out like
+	// MEMONGO_DOWNLOAD_HEADERS).
+	RemoteCache mongobin.RemoteCache
+
+	// Logger for printing messages. Defaults to logging to TB if it's given,
+	// or to stderr otherwise. Nothing is ever printed to stdout.
 	Logger *log.Logger
 
+	// If given, messages are logged to the test with TB.Logf (see
+	// memongolog.NewTB), e.g. a *testing.T. Stop the server before the test
+	// finishes.
+	TB memongolog.TB
+
 	// A LogLevel to log at. Defaults to LogLevelInfo.
 	LogLevel memongolog.LogLevel
 
@@ -52,15 +190,59 @@ type Options struct {
 	// If set, pass the --auth flag to mongod. This will allow tests to setup
 	// authentication.
 	Auth bool
+
+	// The download URLs derived from Mirrors
+	mirrorURLs []string
+
+	// The URL the cache entry of DownloadURL is keyed by, if it's a copy of
+	// the official archive
+	cacheKeyURL string
+
+	// The OS build of MongoDB that was picked for this system, and the
+	// platform and architecture it's built for
+	specOSName   string
+	specPlatform string
+	specArch     string
 }
 
 func (opts *Options) fillDefaults() error {
+	if opts.Edition == mongobin.Community && os.Getenv("MEMONGO_EDITION") != "" {
+		edition, err := mongobin.ParseEdition(os.Getenv("MEMONGO_EDITION"))
+		if err != nil {
+			return fmt.Errorf("error parsing MEMONGO_EDITION: %s", err)
+		}
+		opts.Edition = edition
+	}
+
+	if opts.InMemorySizeGB == 0 && os.Getenv("MEMONGO_IN_MEMORY_SIZE_GB") != "" {
+		sizeGB, err := strconv.ParseFloat(os.Getenv("MEMONGO_IN_MEMORY_SIZE_GB"), 64)
+		if err != nil {
+			return fmt.Errorf("error parsing MEMONGO_IN_MEMORY_SIZE_GB: %s", err)
+		}
+		opts.InMemorySizeGB = sizeGB
+	}
+
 	if opts.MongodBin == "" {
 		opts.MongodBin = os.Getenv("MEMONGO_MONGOD_BIN")
 	}
-	if opts.MongodBin == "" {
+	if !opts.PreferSystemBinary && os.Getenv("MEMONGO_PREFER_SYSTEM_BINARY") != "" {
+		preferSystem, err := strconv.ParseBool(os.Getenv("MEMONGO_PREFER_SYSTEM_BINARY"))
+		if err != nil {
+			return fmt.Errorf("error parsing MEMONGO_PREFER_SYSTEM_BINARY: %s", err)
+		}
+		opts.PreferSystemBinary = preferSystem
+	}
+	if !opts.SystemBinaryMatchMinor && os.Getenv("MEMONGO_SYSTEM_BINARY_MATCH_MINOR") != "" {
+		matchMinor, err := strconv.ParseBool(os.Getenv("MEMONGO_SYSTEM_BINARY_MATCH_MINOR"))
+		if err != nil {
+			return fmt.Errorf("error parsing MEMONGO_SYSTEM_BINARY_MATCH_MINOR: %s", err)
+		}
+		opts.SystemBinaryMatchMinor = matchMinor
+	}
+
+	if opts.MongodBin == "" && opts.BinaryProvider == nil {
 		// The user didn't give us a local path to a binary. That means we need
-		// a download URL and a cache path.
+		// a cache path, and a download URL unless the binary is in BinaryFS.
 
 		// Determine the cache path
 		if opts.CachePath == "" {
@@ -77,20 +259,109 @@ func (opts *Options) fillDefaults() error {
 			}
 		}
 
+		if !opts.VerifyCache && os.Getenv("MEMONGO_VERIFY_CACHE") != "" {
+			verifyCache, err := strconv.ParseBool(os.Getenv("MEMONGO_VERIFY_CACHE"))
+			if err != nil {
+				return fmt.Errorf("error parsing MEMONGO_VERIFY_CACHE: %s", err)
+			}
+			opts.VerifyCache = verifyCache
+		}
+
+		if !opts.ResumableDownloads && os.Getenv("MEMONGO_RESUMABLE_DOWNLOADS") != "" {
+			resumable, err := strconv.ParseBool(os.Getenv("MEMONGO_RESUMABLE_DOWNLOADS"))
+			if err != nil {
+				return fmt.Errorf("error parsing MEMONGO_RESUMABLE_DOWNLOADS: %s", err)
+			}
+			opts.ResumableDownloads = resumable
+		}
+	}
+
+	if opts.MongodBin == "" && opts.BinaryProvider == nil && opts.BinaryFS == nil {
+		if opts.BinaryImage == "" {
+			opts.BinaryImage = os.Getenv("MEMONGO_BINARY_IMAGE")
+		}
+		if opts.BinaryImage != "" {
+			if opts.BinaryImageUsername == "" {
+				opts.BinaryImageUsername = os.Getenv("MEMONGO_BINARY_IMAGE_USERNAME")
+			}
+			if opts.BinaryImagePassword == "" {
+				opts.BinaryImagePassword = os.Getenv("MEMONGO_BINARY_IMAGE_PASSWORD")
+			}
+		}
+	}
+
+	if opts.MongodBin == "" && opts.BinaryProvider == nil && opts.BinaryFS == nil && opts.BinaryImage == "" {
 		// Determine the download URL
 		if opts.DownloadURL == "" {
 			opts.DownloadURL = os.Getenv("MEMONGO_DOWNLOAD_URL")
 		}
+		if opts.ArchiveDir == "" {
+			opts.ArchiveDir = os.Getenv("MEMONGO_ARCHIVE_DIR")
+		}
+
+		if !opts.StrictPlatformMatch && os.Getenv("MEMONGO_STRICT_PLATFORM_MATCH") != "" {
+			strict, err := strconv.ParseBool(os.Getenv("MEMONGO_STRICT_PLATFORM_MATCH"))
+			if err != nil {
+				return fmt.Errorf("error parsing MEMONGO_STRICT_PLATFORM_MATCH: %s", err)
+			}
+			opts.StrictPlatformMatch = strict
+		}
+
+		if opts.DownloadHeaders == nil {
+			headers, err := parseDownloadHeaders(os.Getenv("MEMONGO_DOWNLOAD_HEADERS"))
+			if err != nil {
+				return fmt.Errorf("error parsing MEMONGO_DOWNLOAD_HEADERS: %s", err)
+			}
+			opts.DownloadHeaders = headers
+		}
+
+		if opts.RemoteCache == nil && os.Getenv("MEMONGO_REMOTE_CACHE_URL") != "" {
+			headers, err := parseDownloadHeaders(os.Getenv("MEMONGO_REMOTE_CACHE_HEADERS"))
+			if err != nil {
+				return fmt.Errorf("error parsing MEMONGO_REMOTE_CACHE_HEADERS: %s", err)
+			}
+			opts.RemoteCache = &mongobin.HTTPRemoteCache{
+				BaseURL:    os.Getenv("MEMONGO_REMOTE_CACHE_URL"),
+				HTTPClient: opts.HTTPClient,
+				Headers:    headers,
+			}
+		}
+
 		if opts.DownloadURL == "" {
 			if opts.MongoVersion == "" {
 				return fmt.Errorf("one of MongoVersion, DownloadURL, or MongodBin must be given")
 			}
-			spec, err := mongobin.MakeDownloadSpec(opts.MongoVersion)
-			if err != nil {
-				return err
+			if opts.DownloadURLTemplate == "" {
+				opts.DownloadURLTemplate = os.Getenv("MEMONGO_DOWNLOAD_URL_TEMPLATE")
 			}
 
-			opts.DownloadURL = spec.GetDownloadURL()
+			if opts.Mirrors == nil {
+				for _, mirror := range strings.Split(os.Getenv("MEMONGO_DOWNLOAD_MIRRORS"), ",") {
+					if mirror = strings.TrimSpace(mirror); mirror != "" {
+						opts.Mirrors = append(opts.Mirrors, mirror)
+					}
+				}
+			}
+
+			if opts.Platform == "" {
+				opts.Platform = os.Getenv("MEMONGO_PLATFORM")
+			}
+			if opts.Arch == "" {
+				opts.Arch = os.Getenv("MEMONGO_ARCH")
+			}
+			if opts.OSName == "" {
+				opts.OSName = os.Getenv("MEMONGO_OS_NAME")
+			}
+			if opts.PlatformRulesFile == "" {
+				opts.PlatformRulesFile = os.Getenv("MEMONGO_PLATFORM_RULES_FILE")
+			}
+			// The system binary may do without a download, and detecting which
+			// one to download can go to the network, so it's left until needed
+			if !opts.PreferSystemBinary {
+				if err := opts.detectDownloadURL(); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -124,22 +395,309 @@ func (opts *Options) fillDefaults() error {
 	return nil
 }
 
+// detectDownloadURL picks the build of MongoDB to download for this system,
+// and sets DownloadURL and the mirror URLs to it
+func (opts *Options) detectDownloadURL() error {
+	overrides := &mongobin.SpecOverrides{
+		Platform: opts.Platform,
+		Arch:     opts.Arch,
+		OSName:   opts.OSName,
+		Edition:  opts.Edition,
+	}
+	if opts.PlatformRulesFile != "" {
+		rules, err := mongobin.LoadPlatformRules(opts.PlatformRulesFile)
+		if err != nil {
+			return err
+		}
+		overrides.Rules = rules
+	}
+
+	var spec *mongobin.DownloadSpec
+	var err error
+	if opts.StrictPlatformMatch {
+		spec, err = mongobin.DetectSpecWithLogger(opts.MongoVersion, overrides, opts.getLogger())
+	} else {
+		spec, err = opts.resolveCompatibleSpec(overrides)
+	}
+	if err != nil {
+		return err
+	}
+
+	opts.specOSName = spec.OSName
+	opts.specPlatform = spec.Platform
+	opts.specArch = spec.Arch
+
+	if opts.DownloadURLTemplate != "" {
+		opts.DownloadURL, err = spec.ExpandURLTemplate(opts.DownloadURLTemplate)
+		if err != nil {
+			return err
+		}
+		// Like mirrors, copies of the official archive share its cache
+		// entry, so changing the template doesn't download it again
+		opts.cacheKeyURL = spec.GetDownloadURL()
+	} else {
+		opts.DownloadURL = spec.GetDownloadURL()
+	}
+
+	opts.mirrorURLs, err = spec.GetMirrorDownloadURLs(opts.Mirrors)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
 func (opts *Options) getLogger() *memongolog.Logger {
+	if opts.Logger == nil && opts.TB != nil {
+		return memongolog.NewTB(opts.TB, opts.LogLevel)
+	}
 	return memongolog.New(opts.Logger, opts.LogLevel)
 }
 
-func (opts *Options) getOrDownloadBinPath() (string, error) {
+// resolveCompatibleSpec picks the build of MongoDB to download with
+// mongobin.ResolveCompatibleSpec. The checkers it uses go to the network, so
+// they're only asked when no compatible build is cached or vendored already.
+func (opts *Options) resolveCompatibleSpec(overrides *mongobin.SpecOverrides) (*mongobin.DownloadSpec, error) {
+	silent := memongolog.New(nil, memongolog.LogLevelSilent)
+	spec, err := mongobin.ResolveCompatibleSpec(opts.MongoVersion, overrides, silent, offlineBuildChecker{opts.downloader()})
+	if err == nil && opts.downloader().HasArchive(spec.GetDownloadURL()) {
+		opts.getLogger().Debugf("using the %s build of MongoDB %s, which is available offline", spec.OSName, opts.MongoVersion)
+		return spec, nil
+	}
+
+	// The build the platform rules pick is usually published, and asking
+	// for it is cheaper than downloading the release catalog
+	if opts.DownloadURLTemplate == "" && len(opts.Mirrors) == 0 && overrides.OSName == "" {
+		exact, detectErr := mongobin.DetectSpecWithLogger(opts.MongoVersion, overrides, silent)
+		if detectErr == nil && exact.OSName != "" {
+			if exists, _ := opts.headChecker("").BuildExists(exact); exists {
+				return exact, nil
+			}
+		}
+	}
+
+	return mongobin.ResolveCompatibleSpec(opts.MongoVersion, overrides, opts.getLogger(), opts.buildCheckers()...)
+}
+
+// offlineBuildChecker reports the builds that are cached or vendored as the
+// ones that exist
+type offlineBuildChecker struct {
+	downloader *mongobin.Downloader
+}
+
+func (c offlineBuildChecker) BuildExists(spec *mongobin.DownloadSpec) (bool, error) {
+	return c.downloader.HasArchive(spec.GetDownloadURL()), nil
+}
+
+// buildCheckers returns the checkers used to find out which builds of MongoDB
+// exist. A template or mirror may not have every build MongoDB publishes, so
+// it's asked directly; otherwise the release catalog is used, falling back to
+// asking fastdl.mongodb.org.
+func (opts *Options) buildCheckers() []mongobin.BuildChecker {
+	template := opts.DownloadURLTemplate
+	if template == "" && len(opts.Mirrors) > 0 {
+		template = opts.Mirrors[0]
+		if !strings.Contains(template, "{") {
+			template = strings.TrimSuffix(template, "/") + "/{platform}/{archive}"
+		}
+	}
+
+	if template != "" {
+		return []mongobin.BuildChecker{opts.headChecker(template)}
+	}
+
+	return []mongobin.BuildChecker{
+		&mongobin.ReleaseCatalog{CachePath: opts.CachePath, HTTPClient: opts.HTTPClient},
+		opts.headChecker(""),
+	}
+}
+
+// headChecker returns a checker that asks the server at template whether a
+// build exists, or fastdl.mongodb.org if template is empty
+func (opts *Options) headChecker(template string) *mongobin.HeadChecker {
+	return &mongobin.HeadChecker{
+		URLTemplate: template,
+		HTTPClient:  opts.HTTPClient,
+		Headers:     opts.DownloadHeaders,
+		CachePath:   opts.CachePath,
+	}
+}
+
+// templateBraces unescapes the placeholders of a redacted URL template
+var templateBraces = strings.NewReplacer("%7B", "{", "%7D", "}")
+
+// redacted returns a copy of the options that is safe to log
+func (opts *Options) redacted() Options {
+	redacted := *opts
+
+	if redacted.DownloadURL != "" {
+		redacted.DownloadURL = mongobin.RedactURL(redacted.DownloadURL)
+	}
+
+	if redacted.DownloadURLTemplate != "" {
+		// Keep the placeholders readable, rather than escaped
+		redacted.DownloadURLTemplate = templateBraces.Replace(mongobin.RedactURL(redacted.DownloadURLTemplate))
+	}
+
+	if redacted.Mirrors != nil {
+		redacted.Mirrors = make([]string, len(opts.Mirrors))
+		for i, mirror := range opts.Mirrors {
+			redacted.Mirrors[i] = mongobin.RedactURL(mirror)
+		}
+	}
+
+	if redacted.mirrorURLs != nil {
+		redacted.mirrorURLs = make([]string, len(opts.mirrorURLs))
+		for i, mirrorURL := range opts.mirrorURLs {
+			redacted.mirrorURLs[i] = mongobin.RedactURL(mirrorURL)
+		}
+	}
+
+	if redacted.BinaryImagePassword != "" {
+		redacted.BinaryImagePassword = "REDACTED"
+	}
+
+	if redacted.DownloadHeaders != nil {
+		redacted.DownloadHeaders = http.Header{}
+		for name := range opts.DownloadHeaders {
+			redacted.DownloadHeaders.Set(name, "REDACTED")
+		}
+	}
+
+	return redacted
+}
+
+// binaryProvider returns the provider of the mongod binary to run
+func (opts *Options) binaryProvider() mongobin.BinaryProvider {
+	if opts.BinaryProvider != nil {
+		return opts.BinaryProvider
+	}
+
 	if opts.MongodBin != "" {
-		return opts.MongodBin, nil
+		return &mongobin.FixedPathProvider{Mongod: opts.MongodBin}
 	}
 
-	// Download or fetch from cache
-	binPath, err := mongobin.GetOrDownloadMongod(opts.DownloadURL, opts.CachePath, opts.getLogger())
-	if err != nil {
-		return "", err
+	if opts.BinaryFS != nil {
+		return &mongobin.FSProvider{
+			Downloader: &mongobin.Downloader{
+				CachePath:       opts.CachePath,
+				Logger:          opts.getLogger(),
+				VerifyChecksums: opts.VerifyCache,
+			},
+			FS:   opts.BinaryFS,
+			Path: opts.BinaryFSPath,
+		}
+	}
+
+	if opts.BinaryImage != "" {
+		return &mongobin.OCIImageProvider{
+			Downloader: &mongobin.Downloader{
+				CachePath:       opts.CachePath,
+				Logger:          opts.getLogger(),
+				HTTPClient:      opts.HTTPClient,
+				VerifyChecksums: opts.VerifyCache,
+			},
+			Image:    opts.BinaryImage,
+			Username: opts.BinaryImageUsername,
+			Password: opts.BinaryImagePassword,
+		}
+	}
+
+	// A system binary can only be checked against a version we know
+	if opts.PreferSystemBinary && opts.MongoVersion != "" {
+		return mongobin.ChainProvider{
+			&mongobin.LookPathProvider{
+				Dirs:              mongobin.SystemBinaryDirs,
+				MatchMinorVersion: opts.SystemBinaryMatchMinor,
+				Logger:            opts.getLogger(),
+			},
+			detectingURLProvider{opts},
+		}
+	}
+
+	return opts.urlProvider()
+}
+
+// urlProvider returns the provider that downloads DownloadURL
+func (opts *Options) urlProvider() *mongobin.URLProvider {
+	return &mongobin.URLProvider{
+		Downloader:  opts.downloader(),
+		URL:         opts.DownloadURL,
+		MirrorURLs:  opts.mirrorURLs,
+		CacheKeyURL: opts.cacheKeyURL,
+	}
+}
+
+// detectingURLProvider downloads MongoDB like urlProvider, but only detects
+// which build to download once it's asked for the binaries, i.e. once the
+// system binary turned out not to do
+type detectingURLProvider struct {
+	opts *Options
+}
+
+func (p detectingURLProvider) Resolve(ctx context.Context, version string) (*mongobin.BinaryPaths, error) {
+	if p.opts.DownloadURL == "" {
+		if err := p.opts.detectDownloadURL(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p.opts.urlProvider().Resolve(ctx, version)
+}
+
+// downloader returns the Downloader used to download DownloadURL
+func (opts *Options) downloader() *mongobin.Downloader {
+	return &mongobin.Downloader{
+		CachePath:   opts.CachePath,
+		Logger:      opts.getLogger(),
+		HTTPClient:  opts.HTTPClient,
+		Headers:     opts.DownloadHeaders,
+		HeaderHosts: downloadHosts(append([]string{opts.DownloadURL}, opts.mirrorURLs...)),
+		ArchiveDir:  opts.ArchiveDir,
+		OSName:      opts.specOSName,
+		Platform:    opts.specPlatform,
+		Arch:        opts.specArch,
+
+		RemoteCache:        opts.RemoteCache,
+		VerifyChecksums:    opts.VerifyCache,
+		ResumableDownloads: opts.ResumableDownloads,
+	}
+}
+
+// downloadHosts returns the hosts of urls, which the download headers are
+// sent to
+func downloadHosts(urls []string) []string {
+	var hosts []string
+	for _, urlStr := range urls {
+		if urlParsed, err := url.Parse(urlStr); err == nil && urlParsed.Hostname() != "" {
+			hosts = append(hosts, urlParsed.Hostname())
+		}
+	}
+	return hosts
+}
+
+// parseDownloadHeaders parses headers given as one "Name: value" pair per line
+func parseDownloadHeaders(headersStr string) (http.Header, error) {
+	if strings.TrimSpace(headersStr) == "" {
+		return nil, nil
+	}
+
+	headers := http.Header{}
+	for _, line := range strings.Split(headersStr, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("header must be in the form \"Name: value\"")
+		}
+
+		headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
 	}
 
-	return binPath, nil
+	return headers, nil
 }
 
 func getFreePort() (int, error) {
@@ -0,0 +1,679 @@
+package memongo_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// fakeMongod is a script that behaves just enough like mongod for memongo to
+// start it
+const fakeMongod = `#!/bin/sh
+if [ "$1" = "--version" ]; then
+	echo "db version v6.0.4"
+	exit 0
+fi
+while [ $# -gt 0 ]; do
+	if [ "$1" = "--port" ]; then
+		port=$2
+	fi
+	shift
+done
+echo "waiting for connections on port $port"
+exec sleep 60
+`
+
+// fakeMongodTarball returns a tarball holding fakeMongod
+func fakeMongodTarball(t *testing.T) []byte {
+	var buf bytes.Buffer
+	gzWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzWriter)
+	require.NoError(t, tarWriter.WriteHeader(&tar.Header{
+		Name: "mongodb/bin/mongod",
+		Mode: 0755,
+		Size: int64(len(fakeMongod)),
+	}))
+	_, err := tarWriter.Write([]byte(fakeMongod))
+	require.NoError(t, err)
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzWriter.Close())
+
+	return buf.Bytes()
+}
+
+// serveFakeMongod starts a server that serves a tarball holding fakeMongod
+// at every path, and records the requested paths
+func serveFakeMongod(t *testing.T) (*httptest.Server, *[]string) {
+	tarball := fakeMongodTarball(t)
+
+	var requestedPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// Checks for which builds exist
+			return
+		}
+		requestedPaths = append(requestedPaths, r.URL.Path)
+		_, _ = w.Write(tarball)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requestedPaths
+}
+
+func TestDownloadURLTemplate(t *testing.T) {
+	server, requestedPaths := serveFakeMongod(t)
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:        "4.0.5",
+		CachePath:           t.TempDir(),
+		DownloadURLTemplate: server.URL + "/mongo/{version}/{platform}-{arch}.tgz",
+		LogLevel:            memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	assert.Len(t, *requestedPaths, 1)
+	assert.Regexp(t, `^/mongo/4\.0\.5/(linux|osx)-(x86_64|arm64|aarch64)\.tgz$`, (*requestedPaths)[0])
+}
+
+func TestDownloadURLTemplateFromEnv(t *testing.T) {
+	server, requestedPaths := serveFakeMongod(t)
+	t.Setenv("MEMONGO_DOWNLOAD_URL_TEMPLATE", server.URL+"/{version}/{archive}")
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion: "4.0.5",
+		CachePath:    t.TempDir(),
+		LogLevel:     memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	assert.Len(t, *requestedPaths, 1)
+	assert.Regexp(t, `^/4\.0\.5/mongodb-.*-4\.0\.5\.tgz$`, (*requestedPaths)[0])
+}
+
+func TestDownloadMirrorsFromEnv(t *testing.T) {
+	server, requestedPaths := serveFakeMongod(t)
+	t.Setenv("MEMONGO_DOWNLOAD_MIRRORS", " , "+server.URL+"/mirror ,, ")
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion: "4.0.5",
+		CachePath:    t.TempDir(),
+		LogLevel:     memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	assert.Len(t, *requestedPaths, 1)
+	assert.Regexp(t, `^/mirror/(linux|osx)/mongodb-.*-4\.0\.5\.tgz$`, (*requestedPaths)[0])
+}
+
+func TestDownloadURLTemplateIsRedactedAndSharesCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mongod is a shell script")
+	}
+
+	server, requestedPaths := serveFakeMongod(t)
+	cachePath := t.TempDir()
+
+	logOutput := &bytes.Buffer{}
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:        "6.0.4",
+		CachePath:           cachePath,
+		DownloadURLTemplate: strings.Replace(server.URL, "http://", "http://user:sekrit@", 1) + "/{archive}?token=sekrit",
+		Logger:              log.New(logOutput, "", 0),
+		LogLevel:            memongolog.LogLevelDebug,
+	})
+	require.NoError(t, err)
+	mongoServer.Stop()
+	assert.Len(t, *requestedPaths, 1)
+
+	assert.Contains(t, logOutput.String(), "/{archive}?token=REDACTED")
+	assert.NotContains(t, logOutput.String(), "sekrit")
+
+	// A template on another host shares the cache entry
+	otherServer, otherRequestedPaths := serveFakeMongod(t)
+	mongoServer, err = memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:        "6.0.4",
+		CachePath:           cachePath,
+		DownloadURLTemplate: otherServer.URL + "/mirror/{archive}",
+		LogLevel:            memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	mongoServer.Stop()
+	assert.Empty(t, *otherRequestedPaths)
+}
+
+// countingTransport counts the requests sent through it by method
+type countingTransport struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	if c.requests == nil {
+		c.requests = map[string]int{}
+	}
+	c.requests[req.Method]++
+	c.mu.Unlock()
+
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCachedBuildIsUsedWithoutCheckingForBuilds(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mongod is a shell script")
+	}
+
+	server, requestedPaths := serveFakeMongod(t)
+	cachePath := t.TempDir()
+
+	transport := &countingTransport{}
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:        "6.0.4",
+		CachePath:           cachePath,
+		DownloadURLTemplate: server.URL + "/{archive}",
+		HTTPClient:          &http.Client{Transport: transport},
+		LogLevel:            memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	mongoServer.Stop()
+	assert.Len(t, *requestedPaths, 1)
+
+	// Once the build is cached, the network isn't needed at all
+	server.Close()
+	transport = &countingTransport{}
+	mongoServer, err = memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:        "6.0.4",
+		CachePath:           cachePath,
+		DownloadURLTemplate: server.URL + "/{archive}",
+		HTTPClient:          &http.Client{Transport: transport},
+		LogLevel:            memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	mongoServer.Stop()
+	assert.Empty(t, transport.requests)
+}
+
+// serverTransport sends every request to the server at target, whichever
+// host it's for
+type serverTransport struct {
+	target string
+}
+
+func (tr serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target, err := url.Parse(tr.target)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestPublishedBuildIsUsedWithoutDownloadingTheCatalog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux builds are checked for")
+	}
+
+	server, requestedPaths := serveFakeMongod(t)
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion: "6.0.4",
+		CachePath:    t.TempDir(),
+		HTTPClient:   &http.Client{Transport: serverTransport{server.URL}},
+		LogLevel:     memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	assert.NotContains(t, *requestedPaths, "/full.json")
+	assert.Regexp(t, `^/linux/mongodb-linux-.*-6\.0\.4\.tgz$`, (*requestedPaths)[len(*requestedPaths)-1])
+}
+
+func TestPlatformOverridesFromEnv(t *testing.T) {
+	server, requestedPaths := serveFakeMongod(t)
+	t.Setenv("MEMONGO_PLATFORM", "linux")
+	t.Setenv("MEMONGO_ARCH", "arm64")
+	t.Setenv("MEMONGO_OS_NAME", "ubuntu2204")
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:        "6.0.4",
+		CachePath:           t.TempDir(),
+		DownloadURLTemplate: server.URL + "/{archive}",
+		LogLevel:            memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	assert.Equal(t, []string{"/mongodb-linux-aarch64-ubuntu2204-6.0.4.tgz"}, *requestedPaths)
+}
+
+func TestDownloadURLTemplateUnknownPlaceholder(t *testing.T) {
+	_, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:        "4.0.5",
+		CachePath:           t.TempDir(),
+		DownloadURLTemplate: "https://mirror.example.com/{version}/{distro}.tgz",
+		LogLevel:            memongolog.LogLevelSilent,
+	})
+	require.EqualError(t, err, `unknown placeholder(s) {distro} in download URL template "https://mirror.example.com/{version}/{distro}.tgz"`)
+}
+
+func TestRunningServerKeepsCacheEntry(t *testing.T) {
+	server, _ := serveFakeMongod(t)
+	cachePath := t.TempDir()
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion: "4.0.5",
+		CachePath:    cachePath,
+		DownloadURL:  server.URL + "/mongodb-linux-x86_64-4.0.5.tgz",
+		LogLevel:     memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+
+	cache := &mongobin.Cache{Path: cachePath, Logger: memongolog.New(nil, memongolog.LogLevelSilent)}
+
+	removed, err := cache.Prune(time.Nanosecond, 0)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	mongoServer.Stop()
+
+	removed, err = cache.Prune(time.Nanosecond, 0)
+	require.NoError(t, err)
+	assert.Len(t, removed, 1)
+}
+
+func TestEnterpriseUsesInMemoryEngine(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mongod is a shell script")
+	}
+
+	dir := t.TempDir()
+	argsPath := path.Join(dir, "args")
+	mongodPath := path.Join(dir, "mongod")
+	require.NoError(t, os.WriteFile(mongodPath, []byte("#!/bin/sh\necho \"$@\" > "+argsPath+"\n"+strings.TrimPrefix(fakeMongod, "#!/bin/sh\n")), 0755))
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongodBin:      mongodPath,
+		Edition:        mongobin.Enterprise,
+		InMemorySizeGB: 0.5,
+		LogLevel:       memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "--inMemorySizeGB 0.5 --bind_ip localhost --storageEngine inMemory")
+}
+
+// releaseRecordingProvider provides a fixed mongod, and records whether it
+// was released
+type releaseRecordingProvider struct {
+	mongod   string
+	released bool
+}
+
+func (p *releaseRecordingProvider) Resolve(ctx context.Context, version string) (*mongobin.BinaryPaths, error) {
+	return &mongobin.BinaryPaths{
+		Mongod: p.mongod,
+		Release: func() error {
+			p.released = true
+			return nil
+		},
+	}, nil
+}
+
+func TestBinaryProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mongod is a shell script")
+	}
+
+	mongodPath := path.Join(t.TempDir(), "mongod")
+	require.NoError(t, os.WriteFile(mongodPath, []byte(fakeMongod), 0755))
+	provider := &releaseRecordingProvider{mongod: mongodPath}
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:   "6.0.4",
+		BinaryProvider: provider,
+		LogLevel:       memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	assert.False(t, provider.released)
+
+	mongoServer.Stop()
+	assert.True(t, provider.released)
+}
+
+func TestBinaryImageFromEnv(t *testing.T) {
+	// Nothing listens on the registry, so we can tell it was asked
+	registry := httptest.NewServer(http.NotFoundHandler())
+	registryAddr := registry.Listener.Addr().String()
+	registry.Close()
+	t.Setenv("MEMONGO_BINARY_IMAGE", registryAddr+"/mongo:7.0.2")
+
+	_, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion: "7.0.2",
+		CachePath:    t.TempDir(),
+		LogLevel:     memongolog.LogLevelSilent,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), registryAddr+"/v2/mongo/manifests/7.0.2")
+}
+
+func TestBinaryFS(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mongod is a shell script")
+	}
+
+	// No MongoVersion is needed, since nothing is downloaded
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		CachePath:    t.TempDir(),
+		BinaryFS:     fstest.MapFS{"bin/mongod": {Data: []byte(fakeMongod)}},
+		BinaryFSPath: "bin/mongod",
+		LogLevel:     memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	assert.NotZero(t, mongoServer.Port())
+}
+
+func TestPreferSystemBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mongod is a shell script")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "mongod"), []byte(fakeMongod), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	systemBinaryDirs := mongobin.SystemBinaryDirs
+	mongobin.SystemBinaryDirs = nil
+	defer func() { mongobin.SystemBinaryDirs = systemBinaryDirs }()
+
+	tests := map[string]struct {
+		mongoVersion string
+		matchMinor   bool
+
+		expectDownload bool
+	}{
+		"Same version": {
+			mongoVersion: "6.0.4",
+		},
+		"Other version": {
+			mongoVersion:   "6.0.5",
+			expectDownload: true,
+		},
+		"Same minor version": {
+			mongoVersion: "6.0.5",
+			matchMinor:   true,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			server, requestedPaths := serveFakeMongod(t)
+
+			mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+				MongoVersion:           test.mongoVersion,
+				CachePath:              t.TempDir(),
+				DownloadURLTemplate:    server.URL + "/{archive}",
+				PreferSystemBinary:     true,
+				SystemBinaryMatchMinor: test.matchMinor,
+				LogLevel:               memongolog.LogLevelSilent,
+			})
+			require.NoError(t, err)
+			defer mongoServer.Stop()
+
+			if test.expectDownload {
+				assert.Len(t, *requestedPaths, 1)
+			} else {
+				assert.Empty(t, *requestedPaths)
+			}
+		})
+	}
+}
+
+func TestSystemBinaryIsUsedWithoutDetectingTheDownload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mongod is a shell script")
+	}
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(dir, "mongod"), []byte(fakeMongod), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	systemBinaryDirs := mongobin.SystemBinaryDirs
+	mongobin.SystemBinaryDirs = nil
+	defer func() { mongobin.SystemBinaryDirs = systemBinaryDirs }()
+
+	// Detecting the download would fail on the missing rules, and checking
+	// which builds exist would send requests
+	transport := &countingTransport{}
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:       "6.0.4",
+		CachePath:          t.TempDir(),
+		HTTPClient:         &http.Client{Transport: transport},
+		PlatformRulesFile:  path.Join(dir, "missing.json"),
+		PreferSystemBinary: true,
+		LogLevel:           memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	assert.Empty(t, transport.requests)
+
+	// Without a system binary, the download is still detected
+	_, err = memongo.StartWithOptions(&memongo.Options{
+		MongoVersion:       "6.0.5",
+		CachePath:          t.TempDir(),
+		HTTPClient:         &http.Client{Transport: transport},
+		PlatformRulesFile:  path.Join(dir, "missing.json"),
+		PreferSystemBinary: true,
+		LogLevel:           memongolog.LogLevelSilent,
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "error reading platform rules")
+	assert.Empty(t, transport.requests)
+}
+
+func TestRemoteCacheFromEnv(t *testing.T) {
+	// Only archives that were checked against a checksum are uploaded
+	archive := fakeMongodTarball(t)
+	archivePath := path.Join(t.TempDir(), "mongodb-linux-x86_64-4.0.5.tgz")
+	require.NoError(t, os.WriteFile(archivePath, archive, 0644))
+	checksum := sha256.Sum256(archive)
+	require.NoError(t, os.WriteFile(archivePath+".sha256", []byte(hex.EncodeToString(checksum[:])), 0644))
+
+	var uploadedPaths []string
+	cacheServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer cache-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodPut {
+			uploadedPaths = append(uploadedPaths, r.URL.Path)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer cacheServer.Close()
+	t.Setenv("MEMONGO_REMOTE_CACHE_URL", cacheServer.URL+"/memongo")
+	t.Setenv("MEMONGO_REMOTE_CACHE_HEADERS", "Authorization: Bearer cache-token")
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion: "4.0.5",
+		CachePath:    t.TempDir(),
+		DownloadURL:  archivePath,
+		LogLevel:     memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	require.Len(t, uploadedPaths, 3)
+	assert.Regexp(t, `^/memongo/binaries/[0-9a-f]{64}$`, uploadedPaths[0])
+	assert.Regexp(t, `^/memongo/entries/[0-9a-f]{64}\.json$`, uploadedPaths[1])
+	assert.Regexp(t, `^/memongo/archives/mongodb-linux-x86_64-4_0_5_tgz_[0-9a-f]{10}$`, uploadedPaths[2])
+}
+
+func TestResumableDownloadsFromEnv(t *testing.T) {
+	cachePath := t.TempDir()
+	tarball := fakeMongodTarball(t)
+
+	// The tarball is only sent in full once it's been seen being saved to
+	// the cache
+	var saved bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(tarball)))
+		_, _ = w.Write(tarball[:len(tarball)/2])
+		w.(http.Flusher).Flush()
+
+		for deadline := time.Now().Add(time.Second); !saved && time.Now().Before(deadline); {
+			partials, _ := filepath.Glob(path.Join(cachePath, ".partial", "*.partial"))
+			saved = len(partials) > 0
+			time.Sleep(time.Millisecond)
+		}
+		_, _ = w.Write(tarball[len(tarball)/2:])
+	}))
+	defer server.Close()
+	t.Setenv("MEMONGO_RESUMABLE_DOWNLOADS", "true")
+
+	mongoServer, err := memongo.StartWithOptions(&memongo.Options{
+		MongoVersion: "4.0.5",
+		CachePath:    cachePath,
+		DownloadURL:  server.URL + "/mongodb-linux-x86_64-4.0.5.tgz",
+		LogLevel:     memongolog.LogLevelSilent,
+	})
+	require.NoError(t, err)
+	defer mongoServer.Stop()
+
+	server.Close()
+	assert.True(t, saved)
+}
+
+// captureOutput returns what's written to the file (os.Stdout or os.Stderr)
+// until the returned function is called
+func captureOutput(t *testing.T, file **os.File) func() string {
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+
+	original := *file
+	*file = writer
+
+	var buf bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&buf, reader)
+		close(done)
+	}()
+
+	return func() string {
+		*file = original
+		writer.Close()
+		<-done
+		reader.Close()
+		return buf.String()
+	}
+}
+
+// recordingTB records what's logged to it, like a testing.T
+type recordingTB struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (tb *recordingTB) Logf(format string, args ...interface{}) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.lines = append(tb.lines, fmt.Sprintf(format, args...))
+}
+
+func (tb *recordingTB) output() string {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return strings.Join(tb.lines, "\n")
+}
+
+func TestNothingIsWrittenToStdout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake mongod is a shell script")
+	}
+
+	tests := map[string]struct {
+		tb *recordingTB
+
+		expectStderr bool
+	}{
+		"Default logger": {
+			expectStderr: true,
+		},
+		"Logging to a test": {
+			tb: &recordingTB{},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			server, _ := serveFakeMongod(t)
+			opts := &memongo.Options{
+				MongoVersion:        "6.0.4",
+				CachePath:           t.TempDir(),
+				DownloadURLTemplate: server.URL + "/{archive}",
+				LogLevel:            memongolog.LogLevelDebug,
+			}
+			if test.tb != nil {
+				opts.TB = test.tb
+			}
+
+			stopStdout := captureOutput(t, &os.Stdout)
+			stopStderr := captureOutput(t, &os.Stderr)
+
+			mongoServer, err := memongo.StartWithOptions(opts)
+			if err == nil {
+				mongoServer.Stop()
+			}
+
+			stderr := stopStderr()
+			stdout := stopStdout()
+			require.NoError(t, err)
+
+			assert.Empty(t, stdout)
+			if test.expectStderr {
+				assert.Contains(t, stderr, "[memongo] [INFO]  mongod from")
+			} else {
+				assert.Empty(t, stderr)
+				assert.Contains(t, test.tb.output(), "[memongo] [INFO]  mongod from")
+			}
+		})
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
 	"github.com/tryvium-travels/memongo/monitor"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -29,6 +30,7 @@ type Server struct {
 	dbDir      string
 	logger     *memongolog.Logger
 	port       int
+	binaries   *mongobin.BinaryPaths
 }
 
 // Start runs a MongoDB server at a given MongoDB version using default options
@@ -48,12 +50,21 @@ func StartWithOptions(opts *Options) (*Server, error) {
 
 	logger := opts.getLogger()
 
-	logger.Infof("Starting MongoDB with options %#v", opts)
+	logger.Infof("Starting MongoDB with options %#v", opts.redacted())
 
-	binPath, err := opts.getOrDownloadBinPath()
+	binaries, err := opts.binaryProvider().Resolve(context.Background(), opts.MongoVersion)
 	if err != nil {
 		return nil, err
 	}
+	binPath := binaries.Mongod
+
+	// Release the binaries if the server doesn't start
+	started := false
+	defer func() {
+		if !started {
+			releaseBinaries(binaries, logger)
+		}
+	}()
 
 	logger.Debugf("Using binary %s", binPath)
 
@@ -73,7 +84,15 @@ func StartWithOptions(opts *Options) (*Server, error) {
 	} else if strings.HasPrefix(opts.MongoVersion, "7.") {
 		engine = "wiredTiger"
 	}
-	if engine == "wiredTiger" {
+	if opts.Edition == mongobin.Enterprise {
+		// The Enterprise server has a real in-memory engine, which also
+		// works with replica sets
+		engine = "inMemory"
+		if opts.InMemorySizeGB > 0 {
+			args = append(args, "--inMemorySizeGB", strconv.FormatFloat(opts.InMemorySizeGB, 'f', -1, 64))
+		}
+	}
+	if engine != "ephemeralForTest" {
 		args = append(args, "--bind_ip", "localhost")
 	}
 
@@ -206,12 +225,14 @@ func StartWithOptions(opts *Options) (*Server, error) {
 	// ---------- END OF REPLICA CODE ----------
 
 	// Return a Memongo server
+	started = true
 	return &Server{
 		cmd:        cmd,
 		watcherCmd: watcherCmd,
 		dbDir:      dbDir,
 		logger:     logger,
 		port:       port,
+		binaries:   binaries,
 	}, nil
 }
 
@@ -233,6 +254,13 @@ func (s *Server) URIWithRandomDB() string {
 
 // Stop kills the mongo server
 func (s *Server) Stop() {
+	// Release the binaries even if stopping the processes fails, so the
+	// cache entry doesn't stay marked as in use
+	defer func() {
+		releaseBinaries(s.binaries, s.logger)
+		s.binaries = nil
+	}()
+
 	err := s.cmd.Process.Kill()
 	if err != nil {
 		s.logger.Warnf("error stopping mongod process: %s", err)
@@ -252,6 +280,18 @@ func (s *Server) Stop() {
 	}
 }
 
+// releaseBinaries tells the provider of the binaries that they're no longer
+// used, e.g. so the cache can prune them
+func releaseBinaries(binaries *mongobin.BinaryPaths, logger *memongolog.Logger) {
+	if binaries == nil || binaries.Release == nil {
+		return
+	}
+
+	if err := binaries.Release(); err != nil {
+		logger.Warnf("error releasing mongod binary: %s", err)
+	}
+}
+
 // Cribbed from https://github.com/nodkz/mongodb-memory-server/blob/master/packages/mongodb-memory-server-core/src/util/MongoInstance.ts#L206
 var (
 	reReady                 = regexp.MustCompile(`waiting for connections.*port\D*(\d+)`)
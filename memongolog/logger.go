@@ -3,6 +3,7 @@ package memongolog
 import (
 	"log"
 	"os"
+	"strings"
 )
 
 // LogLevel is a logging vebosity level
@@ -30,10 +31,16 @@ type Logger struct {
 	out   *log.Logger
 }
 
-// New constructs a new logger
+// TB is the part of testing.TB a Logger needs to log to a test
+type TB interface {
+	Logf(format string, args ...interface{})
+}
+
+// New constructs a new logger. If out is nil, it logs to stderr, so it
+// doesn't get mixed up with the output of the program (e.g. go test -json).
 func New(out *log.Logger, level LogLevel) *Logger {
 	if out == nil {
-		out = log.New(os.Stdout, "", 0)
+		out = log.New(os.Stderr, "", 0)
 	}
 
 	if level == 0 {
@@ -46,6 +53,24 @@ func New(out *log.Logger, level LogLevel) *Logger {
 	}
 }
 
+// NewTB constructs a new logger that logs to a test with tb.Logf, so
+// messages are shown along with the test that logged them, and only if it
+// fails or go test -v is used. tb must not be logged to once its test has
+// finished, so stop any servers started with the logger before that.
+func NewTB(tb TB, level LogLevel) *Logger {
+	return New(log.New(tbWriter{tb}, "", 0), level)
+}
+
+// tbWriter writes each line logged by a log.Logger to a test
+type tbWriter struct {
+	tb TB
+}
+
+func (w tbWriter) Write(p []byte) (int, error) {
+	w.tb.Logf("%s", strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
 // Debugf logs at the debug level
 func (l *Logger) Debugf(format string, v ...interface{}) {
 	if l.level <= LogLevelDebug {
@@ -2,6 +2,7 @@ package memongolog
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"testing"
 
@@ -188,3 +189,26 @@ func TestLogger(t *testing.T) {
 		})
 	}
 }
+
+// recordingTB records what's logged to it, like a testing.T
+type recordingTB struct {
+	lines []string
+}
+
+func (tb *recordingTB) Logf(format string, args ...interface{}) {
+	tb.lines = append(tb.lines, fmt.Sprintf(format, args...))
+}
+
+func TestNewTB(t *testing.T) {
+	tb := &recordingTB{}
+	logger := NewTB(tb, LogLevelInfo)
+
+	logger.Debugf("foo %s", "bar")
+	logger.Infof("foo %s", "baz")
+	logger.Warnf("multi\nline")
+
+	assert.Equal(t, []string{"[memongo] [INFO]  foo baz", "[memongo] [WARN]  multi\nline"}, tb.lines)
+
+	// A testing.T can be logged to
+	NewTB(t, LogLevelInfo).Infof("logged to the test")
+}
@@ -0,0 +1,160 @@
+package mongobin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// BinaryCheckTimeout is how long a freshly extracted binary may take to
+// report its version
+var BinaryCheckTimeout = 30 * time.Second
+
+var (
+	// e.g. "mongod: error while loading shared libraries: libcrypto.so.1.1:
+	// cannot open shared object file: No such file or directory"
+	missingLibraryRegex = regexp.MustCompile(`error while loading shared libraries: ([^:\s]+): cannot open shared object file`)
+
+	// e.g. "mongod: /lib/x86_64-linux-gnu/libc.so.6: version `GLIBC_2.34' not
+	// found (required by mongod)"
+	libraryVersionRegex = regexp.MustCompile("([^\\s:]+): version [`'‘]([^`'’\\s]+)['’] not found")
+
+	// e.g. "dyld: Library not loaded: /usr/local/opt/openssl/lib/libssl.1.0.0.dylib"
+	dyldLibraryRegex = regexp.MustCompile(`Library not loaded: '?([^'\s]+)`)
+
+	// e.g. "db version v6.0.4" or "mongos version v6.0.4"
+	binaryVersionRegex = regexp.MustCompile(`version v(\d+\.\d+\.\d+\S*)`)
+
+	// e.g. "mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz" or
+	// "mongodb-osx-ssl-x86_64-4.0.5.tgz"
+	systemInArchiveNameRegex = regexp.MustCompile(`^mongodb-(linux|osx|macos|windows|win32)-(?:ssl-)?([a-z0-9_]+)-`)
+
+	// e.g. "mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+	osNameInArchiveNameRegex = regexp.MustCompile(`^mongodb-linux-[^-]+-(?:enterprise-)?([a-z]+\d+)-\d`)
+)
+
+// checkBinary runs `binPath --version` to make sure the binary can run on
+// this system, and returns the version it reports. If the binary can't run
+// because of missing shared libraries, it returns a
+// *MissingSharedLibraryError.
+//
+// Binaries on a filesystem other than the OS's, or built for another system
+// than this one, can't be run, so they're not checked.
+func (d *Downloader) checkBinary(ctx context.Context, binPath string, urlStr string) (string, error) {
+	if _, ok := Afs.Fs.(*afero.OsFs); !ok {
+		return "", nil
+	}
+	if !d.isForThisSystem(urlStr) {
+		d.logger().Debugf("not checking %s, which is built for another system", binPath)
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, BinaryCheckTimeout)
+	defer cancel()
+
+	//  Safe to pass binPath
+	//nolint:gosec
+	output, runErr := exec.CommandContext(ctx, binPath, "--version").CombinedOutput()
+	if runErr != nil {
+		if libraries := missingLibraries(string(output)); len(libraries) > 0 {
+			osName := d.OSName
+			if osName == "" {
+				osName = osNameFromURL(urlStr)
+			}
+
+			return "", &MissingSharedLibraryError{
+				Binary:    binPath,
+				Libraries: libraries,
+				OSName:    osName,
+			}
+		}
+
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return "", fmt.Errorf("%s --version did not finish within %s", binPath, BinaryCheckTimeout)
+		}
+
+		return "", fmt.Errorf("error running %s --version: %s: %s", binPath, runErr, strings.TrimSpace(string(output)))
+	}
+
+	match := binaryVersionRegex.FindStringSubmatch(string(output))
+	if match == nil {
+		d.logger().Debugf("could not find a version in the output of %s --version: %s", binPath, strings.TrimSpace(string(output)))
+		return "", nil
+	}
+
+	return match[1], nil
+}
+
+// isForThisSystem returns whether the binaries from the archive at urlStr
+// are built for the system we're running on. If we can't tell, we assume
+// they are.
+func (d *Downloader) isForThisSystem(urlStr string) bool {
+	platform, arch := d.Platform, d.Arch
+	if match := systemInArchiveNameRegex.FindStringSubmatch(archiveBaseName(urlStr)); match != nil {
+		if platform == "" {
+			platform = match[1]
+		}
+		if arch == "" {
+			arch = match[2]
+		}
+	}
+
+	switch platform {
+	case "osx", "macos", "darwin":
+		platform = "darwin"
+	case "windows", "win32":
+		platform = "windows"
+	}
+	switch arch {
+	case "x86_64", "amd64":
+		arch = "amd64"
+	case "aarch64", "arm64":
+		arch = "arm64"
+	}
+
+	return (platform == "" || platform == runtime.GOOS) && (arch == "" || arch == runtime.GOARCH)
+}
+
+// missingLibraries parses the libraries the dynamic loader couldn't load out
+// of its error messages
+func missingLibraries(output string) []string {
+	var libraries []string
+	seen := map[string]bool{}
+	add := func(library string) {
+		if !seen[library] {
+			seen[library] = true
+			libraries = append(libraries, library)
+		}
+	}
+
+	for _, line := range strings.Split(output, "\n") {
+		if match := missingLibraryRegex.FindStringSubmatch(line); match != nil {
+			add(match[1])
+		} else if match := libraryVersionRegex.FindStringSubmatch(line); match != nil {
+			add(path.Base(match[1]) + " (" + match[2] + ")")
+		} else if match := dyldLibraryRegex.FindStringSubmatch(line); match != nil {
+			add(path.Base(match[1]))
+		}
+	}
+
+	return libraries
+}
+
+// osNameFromURL returns the OSName of the official archive at urlStr, or ""
+// if it's not an official Linux archive
+func osNameFromURL(urlStr string) string {
+	match := osNameInArchiveNameRegex.FindStringSubmatch(archiveBaseName(urlStr))
+	if match == nil {
+		return ""
+	}
+
+	return match[1]
+}
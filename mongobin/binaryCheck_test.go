@@ -0,0 +1,177 @@
+package mongobin_test
+
+import (
+	"errors"
+	"path"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// useOsFs makes mongobin use the OS filesystem for the rest of the test
+func useOsFs(t *testing.T) {
+	oldAfs := mongobin.Afs
+	mongobin.Afs = afero.Afero{Fs: afero.NewOsFs()}
+	t.Cleanup(func() { mongobin.Afs = oldAfs })
+}
+
+func TestExtractedBinaryIsChecked(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binaries are shell scripts")
+	}
+
+	tests := map[string]struct {
+		script            string
+		expectedLibraries []string
+		expectedError     string
+		expectedVersion   string
+	}{
+		"Binary that runs": {
+			script:          "#!/bin/sh\necho 'db version v6.0.5'\n",
+			expectedVersion: "6.0.5",
+		},
+		"Binary with an unexpected version output": {
+			script:          "#!/bin/sh\necho 'something else'\n",
+			expectedVersion: "6.0.4",
+		},
+		"Missing shared libraries": {
+			script: "#!/bin/sh\n" +
+				"echo \"$0: error while loading shared libraries: libcrypto.so.1.1: cannot open shared object file: No such file or directory\" >&2\n" +
+				"echo \"$0: error while loading shared libraries: libcurl.so.4: cannot open shared object file: No such file or directory\" >&2\n" +
+				"exit 127\n",
+			expectedLibraries: []string{"libcrypto.so.1.1", "libcurl.so.4"},
+		},
+		"glibc too old": {
+			script: "#!/bin/sh\n" +
+				"echo \"$0: /lib/x86_64-linux-gnu/libc.so.6: version \\`GLIBC_2.34' not found (required by $0)\" >&2\n" +
+				"exit 1\n",
+			expectedLibraries: []string{"libc.so.6 (GLIBC_2.34)"},
+		},
+		"Other failure": {
+			script:        "#!/bin/sh\necho 'Illegal instruction' >&2\nexit 132\n",
+			expectedError: "exit status 132: Illegal instruction",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			useOsFs(t)
+
+			server, _ := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": test.script}))
+			downloader := &mongobin.Downloader{
+				CachePath: t.TempDir(),
+				Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+			}
+
+			mongodPath, err := downloader.GetOrDownloadMongod(server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz")
+
+			switch {
+			case test.expectedLibraries != nil:
+				libErr := &mongobin.MissingSharedLibraryError{}
+				require.True(t, errors.As(err, &libErr), "unexpected error: %v", err)
+				assert.Equal(t, test.expectedLibraries, libErr.Libraries)
+				assert.Equal(t, "ubuntu2204", libErr.OSName)
+				assert.Contains(t, err.Error(), "from the ubuntu2204 build of MongoDB")
+
+				// The binary that can't run isn't kept in the cache
+				exists, existsErr := mongobin.Afs.Exists(libErr.Binary)
+				require.NoError(t, existsErr)
+				assert.False(t, exists)
+			case test.expectedError != "":
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedError)
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, test.expectedVersion, readMetadata(t, path.Dir(mongodPath)).Version)
+			}
+		})
+	}
+}
+
+func TestMissingSharedLibraryErrorUsesDownloaderOSName(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binaries are shell scripts")
+	}
+
+	useOsFs(t)
+
+	script := "#!/bin/sh\n" +
+		"echo \"dyld: Library not loaded: '/usr/local/opt/openssl/lib/libssl.1.0.0.dylib'\" >&2\n" +
+		"exit 134\n"
+	server, _ := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": script}))
+	downloader := &mongobin.Downloader{
+		CachePath: t.TempDir(),
+		Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+		OSName:    "rhel80",
+	}
+
+	_, err := downloader.GetOrDownloadMongod(server.URL + "/custom.tgz")
+	libErr := &mongobin.MissingSharedLibraryError{}
+	require.True(t, errors.As(err, &libErr), "unexpected error: %v", err)
+	assert.Equal(t, []string{"libssl.1.0.0.dylib"}, libErr.Libraries)
+	assert.Equal(t, "rhel80", libErr.OSName)
+}
+
+func TestBinaryForAnotherSystemIsNotChecked(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binaries are shell scripts")
+	}
+
+	otherArch := "aarch64"
+	if runtime.GOARCH == "arm64" {
+		otherArch = "x86_64"
+	}
+	otherPlatform := "osx"
+	if runtime.GOOS == "darwin" {
+		otherPlatform = "linux"
+	}
+
+	tests := map[string]struct {
+		archiveName string
+		platform    string
+		arch        string
+	}{
+		"Architecture in the archive name": {
+			archiveName: "mongodb-linux-" + otherArch + "-ubuntu2204-6.0.4.tgz",
+		},
+		"Platform in the archive name": {
+			archiveName: "mongodb-windows-x86_64-6.0.4.tgz",
+		},
+		"Architecture given to the Downloader": {
+			archiveName: "custom.tgz",
+			arch:        otherArch,
+		},
+		"Platform given to the Downloader": {
+			archiveName: "custom.tgz",
+			platform:    otherPlatform,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			useOsFs(t)
+
+			// The binary would fail the check if it was run
+			script := "#!/bin/sh\necho 'Exec format error' >&2\nexit 1\n"
+			server, _ := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": script}))
+			downloader := &mongobin.Downloader{
+				CachePath: t.TempDir(),
+				Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+				Platform:  test.platform,
+				Arch:      test.arch,
+			}
+
+			mongodPath, err := downloader.GetOrDownloadMongod(server.URL + "/" + test.archiveName)
+			require.NoError(t, err)
+
+			content, err := mongobin.Afs.ReadFile(mongodPath)
+			require.NoError(t, err)
+			assert.Equal(t, script, string(content))
+		})
+	}
+}
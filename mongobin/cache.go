@@ -0,0 +1,352 @@
+package mongobin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tryvium-travels/memongo/memongolog"
+)
+
+// inUseDirName is the directory in the cache where running servers record
+// which cache entries they use
+const inUseDirName = ".inuse"
+
+// Cache manages the binaries that have been downloaded to a cache directory.
+// Entries that are being downloaded, or that are used by a running server
+// (see MarkInUse), are never removed.
+type Cache struct {
+	// Path is the cache directory, i.e. the CachePath of the Downloader
+	Path string
+
+	// Logger for printing messages. Defaults to a logger at the default
+	// level.
+	Logger *memongolog.Logger
+}
+
+// CacheEntry describes an entry in the cache, which holds the binaries
+// extracted from one archive
+type CacheEntry struct {
+	// Name is the name of the entry's directory in the cache
+	Name string
+
+	// Path is the entry's directory
+	Path string
+
+	// Version is the MongoDB version, if it's known
+	Version string
+
+	// SourceURL is the (redacted) URL the archive was downloaded from, if
+	// it's known
+	SourceURL string
+
+	// Size is the total size of the entry's files, in bytes
+	Size int64
+
+	// LastUsedAt is when a binary from the entry was last used
+	LastUsedAt time.Time
+}
+
+// CacheEntryInUseError is used to indicate that a cache entry can't be
+// removed because it's being downloaded or used by a running server
+type CacheEntryInUseError struct {
+	Name   string
+	reason string
+}
+
+func (err *CacheEntryInUseError) Error() string {
+	return "cache entry " + err.Name + " is in use: " + err.reason
+}
+
+// InUseMarker records that a cache entry is used by a running server. The
+// entry can't be removed until the marker is released, or the process that
+// created it exits.
+type InUseMarker struct {
+	path string
+}
+
+// Release releases the marker
+func (m *InUseMarker) Release() error {
+	removeErr := Afs.Remove(m.path)
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	return nil
+}
+
+func (c *Cache) logger() *memongolog.Logger {
+	if c.Logger == nil {
+		return memongolog.New(nil, 0)
+	}
+	return c.Logger
+}
+
+// List returns the entries in the cache, sorted by name
+func (c *Cache) List() ([]CacheEntry, error) {
+	dirEntries, readErr := Afs.ReadDir(c.Path)
+	if os.IsNotExist(readErr) {
+		return []CacheEntry{}, nil
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("error reading cache directory %s: %s", c.Path, readErr)
+	}
+
+	entries := make([]CacheEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		// Skip the cache's own bookkeeping directories, like .locks
+		if !dirEntry.IsDir() || strings.HasPrefix(dirEntry.Name(), ".") {
+			continue
+		}
+
+		entry, entryErr := c.describeEntry(dirEntry.Name())
+		if entryErr != nil {
+			return nil, entryErr
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	return entries, nil
+}
+
+func (c *Cache) describeEntry(name string) (CacheEntry, error) {
+	dirPath := path.Join(c.Path, name)
+	entry := CacheEntry{
+		Name: name,
+		Path: dirPath,
+	}
+
+	// Entries extracted from container images keep shared libraries in a
+	// subdirectory
+	walkErr := Afs.Walk(dirPath, func(filePath string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file.IsDir() {
+			return nil
+		}
+		entry.Size += file.Size()
+		if file.ModTime().After(entry.LastUsedAt) {
+			entry.LastUsedAt = file.ModTime()
+		}
+		return nil
+	})
+	if walkErr != nil {
+		return CacheEntry{}, fmt.Errorf("error reading cache entry %s: %s", dirPath, walkErr)
+	}
+
+	metadata, metadataErr := readCacheMetadata(dirPath)
+	if metadataErr != nil {
+		if !os.IsNotExist(metadataErr) {
+			c.logger().Warnf("ignoring unreadable cache metadata: %s", metadataErr)
+		}
+		return entry, nil
+	}
+
+	entry.Version = metadata.Version
+	entry.SourceURL = metadata.SourceURL
+	if !metadata.LastUsedAt.IsZero() {
+		entry.LastUsedAt = metadata.LastUsedAt
+	}
+	if lastUsed, statErr := Afs.Stat(path.Join(c.Path, lastUsedDirName, name)); statErr == nil && lastUsed.ModTime().After(entry.LastUsedAt) {
+		entry.LastUsedAt = lastUsed.ModTime()
+	}
+
+	return entry, nil
+}
+
+// Prune removes entries that haven't been used for longer than maxAge, then
+// removes the least recently used entries until the cache holds no more
+// than maxTotalBytes. A zero maxAge or maxTotalBytes means no limit. Entries
+// that are in use are skipped.
+//
+// It returns the entries that were removed.
+func (c *Cache) Prune(maxAge time.Duration, maxTotalBytes int64) ([]CacheEntry, error) {
+	entries, listErr := c.List()
+	if listErr != nil {
+		return nil, listErr
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsedAt.Before(entries[j].LastUsedAt)
+	})
+
+	var totalBytes int64
+	for _, entry := range entries {
+		totalBytes += entry.Size
+	}
+
+	removed := []CacheEntry{}
+	for _, entry := range entries {
+		tooOld := maxAge > 0 && time.Since(entry.LastUsedAt) > maxAge
+		tooBig := maxTotalBytes > 0 && totalBytes > maxTotalBytes
+		if !tooOld && !tooBig {
+			continue
+		}
+
+		removeErr := c.Remove(entry)
+		inUseErr := &CacheEntryInUseError{}
+		if errors.As(removeErr, &inUseErr) {
+			c.logger().Debugf("not pruning %s", removeErr)
+			continue
+		}
+		if removeErr != nil {
+			return removed, removeErr
+		}
+
+		c.logger().Debugf("pruned cache entry %s", entry.Name)
+		totalBytes -= entry.Size
+		removed = append(removed, entry)
+	}
+
+	return removed, nil
+}
+
+// Remove removes an entry from the cache. It returns a
+// *CacheEntryInUseError if the entry is being downloaded or used by a
+// running server.
+func (c *Cache) Remove(entry CacheEntry) error {
+	if entry.Name == "" || strings.HasPrefix(entry.Name, ".") || strings.Contains(entry.Name, "/") {
+		return fmt.Errorf("invalid cache entry name %q", entry.Name)
+	}
+
+	logger := c.logger()
+
+	lock, lockErr := tryAcquireFileLock(path.Join(c.Path, lockDirName, entry.Name+".lock"), logger)
+	if lockErr != nil {
+		return lockErr
+	}
+	if lock == nil {
+		return &CacheEntryInUseError{Name: entry.Name, reason: "it's being downloaded"}
+	}
+	defer func() {
+		if releaseErr := lock.release(); releaseErr != nil {
+			logger.Warnf("error releasing lock: %s", releaseErr)
+		}
+	}()
+
+	inUse, inUseErr := c.inUse(entry.Name)
+	if inUseErr != nil {
+		return inUseErr
+	}
+	if inUse {
+		return &CacheEntryInUseError{Name: entry.Name, reason: "it's used by a running server"}
+	}
+
+	if removeErr := Afs.RemoveAll(path.Join(c.Path, entry.Name)); removeErr != nil {
+		return fmt.Errorf("error removing cache entry %s: %s", entry.Name, removeErr)
+	}
+	_ = Afs.RemoveAll(path.Join(c.Path, inUseDirName, entry.Name))
+	_ = Afs.Remove(path.Join(c.Path, lastUsedDirName, entry.Name))
+
+	return nil
+}
+
+// Purge removes every entry from the cache that isn't in use, along with
+// quarantined entries. It returns an error naming the entries that are in
+// use, if any.
+func (c *Cache) Purge() error {
+	entries, listErr := c.List()
+	if listErr != nil {
+		return listErr
+	}
+
+	var inUse []string
+	for _, entry := range entries {
+		removeErr := c.Remove(entry)
+		inUseErr := &CacheEntryInUseError{}
+		if errors.As(removeErr, &inUseErr) {
+			inUse = append(inUse, entry.Name)
+			continue
+		}
+		if removeErr != nil {
+			return removeErr
+		}
+	}
+
+	if removeErr := Afs.RemoveAll(path.Join(c.Path, quarantineDirName)); removeErr != nil {
+		return fmt.Errorf("error removing quarantined cache entries: %s", removeErr)
+	}
+
+	if len(inUse) > 0 {
+		return fmt.Errorf("did not remove cache entries that are in use: %s", strings.Join(inUse, ", "))
+	}
+
+	return nil
+}
+
+// MarkInUse records that the cached binary at binPath is used by a running
+// server, so the entry holding it isn't removed. Release the marker when the
+// server stops. If the binary was removed from the cache since it was
+// downloaded, the returned error satisfies os.IsNotExist.
+func (c *Cache) MarkInUse(binPath string) (*InUseMarker, error) {
+	dirPath := path.Dir(binPath)
+	name := path.Base(dirPath)
+	if path.Clean(path.Dir(dirPath)) != path.Clean(c.Path) {
+		return nil, fmt.Errorf("%s is not in the cache at %s", binPath, c.Path)
+	}
+
+	logger := c.logger()
+
+	// Holding the lock makes sure the entry isn't being removed while we
+	// mark it
+	lock, lockErr := acquireFileLock(context.Background(), path.Join(c.Path, lockDirName, name+".lock"), logger)
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer func() {
+		if releaseErr := lock.release(); releaseErr != nil {
+			logger.Warnf("error releasing lock: %s", releaseErr)
+		}
+	}()
+
+	if _, statErr := Afs.Stat(binPath); statErr != nil {
+		return nil, statErr
+	}
+
+	markerDir := path.Join(c.Path, inUseDirName, name)
+	if mkdirErr := Afs.MkdirAll(markerDir, 0755); mkdirErr != nil {
+		return nil, fmt.Errorf("error creating directory %s: %s", markerDir, mkdirErr)
+	}
+
+	markerPath := path.Join(markerDir, fmt.Sprintf("%d_%d", os.Getpid(), time.Now().UnixNano()))
+	if writeErr := Afs.WriteFile(markerPath, []byte(lockOwner()), 0644); writeErr != nil {
+		return nil, fmt.Errorf("error writing in-use marker %s: %s", markerPath, writeErr)
+	}
+
+	return &InUseMarker{path: markerPath}, nil
+}
+
+// inUse returns whether a running server uses the entry. Markers left
+// behind by processes that are no longer running are removed.
+func (c *Cache) inUse(name string) (bool, error) {
+	markerDir := path.Join(c.Path, inUseDirName, name)
+	markers, readErr := Afs.ReadDir(markerDir)
+	if os.IsNotExist(readErr) {
+		return false, nil
+	}
+	if readErr != nil {
+		return false, fmt.Errorf("error reading in-use markers in %s: %s", markerDir, readErr)
+	}
+
+	inUse := false
+	for _, marker := range markers {
+		markerPath := path.Join(markerDir, marker.Name())
+		if gone, reason := isOwnerGone(markerPath); gone {
+			c.logger().Debugf("removing in-use marker %s: %s", markerPath, reason)
+			_ = Afs.Remove(markerPath)
+			continue
+		}
+		inUse = true
+	}
+
+	return inUse, nil
+}
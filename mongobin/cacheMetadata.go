@@ -0,0 +1,299 @@
+package mongobin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// metadataFileName is the name of the file in each cache entry that holds
+// its CacheMetadata
+const metadataFileName = "memongo.json"
+
+// quarantineDirName is the directory in the cache where corrupt cache
+// entries are moved to
+const quarantineDirName = ".quarantine"
+
+// lastUsedDirName is the directory in the cache where the last use of each
+// cache entry is recorded
+const lastUsedDirName = ".lastused"
+
+// CacheMetadata describes a cache entry: where it came from and what it
+// holds
+type CacheMetadata struct {
+	// SourceURL is the (redacted) URL or path the archive was downloaded from
+	SourceURL string `json:"sourceURL"`
+
+	// ArchiveSHA256 is the checksum of the archive the binaries were
+	// extracted from. It's empty for entries that were created before
+	// memongo kept metadata.
+	ArchiveSHA256 string `json:"archiveSHA256,omitempty"`
+
+	// Version is the MongoDB version, if it's known
+	Version string `json:"version,omitempty"`
+
+	// Binaries describes the binaries in the cache entry, keyed by name
+	Binaries map[string]BinaryMetadata `json:"binaries"`
+
+	// ExtractedAt is when the binaries were extracted
+	ExtractedAt time.Time `json:"extractedAt"`
+
+	// LastUsedAt is when a binary from the cache entry was last used when
+	// the metadata was written. Later uses are recorded outside of the
+	// metadata (see Cache.List).
+	LastUsedAt time.Time `json:"lastUsedAt"`
+}
+
+// BinaryMetadata describes a binary in a cache entry
+type BinaryMetadata struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// CorruptCacheEntryError is used to indicate that a binary in the cache
+// doesn't match the metadata recorded when it was extracted, or that the
+// metadata itself can't be read
+type CorruptCacheEntryError struct {
+	Path string
+	msg  string
+}
+
+func (err *CorruptCacheEntryError) Error() string {
+	return "cached file " + err.Path + " is corrupt: " + err.msg
+}
+
+func readCacheMetadata(dirPath string) (*CacheMetadata, error) {
+	contents, readErr := Afs.ReadFile(path.Join(dirPath, metadataFileName))
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	metadata := &CacheMetadata{}
+	if jsonErr := json.Unmarshal(contents, metadata); jsonErr != nil {
+		return nil, fmt.Errorf("error parsing cache metadata in %s: %s", dirPath, jsonErr)
+	}
+
+	return metadata, nil
+}
+
+func writeCacheMetadata(dirPath string, metadata *CacheMetadata) error {
+	contents, jsonErr := json.MarshalIndent(metadata, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	// Write to a temp file and rename it into place, so the metadata can't
+	// be left half written
+	tmpFile, createErr := Afs.TempFile(dirPath, metadataFileName+".*.tmp")
+	if createErr != nil {
+		return fmt.Errorf("error writing cache metadata in %s: %s", dirPath, createErr)
+	}
+	tmpPath := tmpFile.Name()
+
+	_, writeErr := tmpFile.Write(contents)
+	closeErr := tmpFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = Afs.Rename(tmpPath, path.Join(dirPath, metadataFileName))
+	}
+	if writeErr != nil {
+		_ = Afs.Remove(tmpPath)
+		return fmt.Errorf("error writing cache metadata in %s: %s", dirPath, writeErr)
+	}
+
+	return nil
+}
+
+// verifyCacheEntry checks the binaries at paths against the cache entry's
+// metadata. It returns the names of the binaries that are missing, and a
+// *CorruptCacheEntryError if any binary doesn't match its metadata. The size
+// of each binary is always checked; its checksum is checked if
+// VerifyChecksums is set.
+//
+// Entries created before memongo kept metadata get metadata computed from
+// the binaries they hold if backfill is set, which callers only do while
+// holding the entry's lock. Otherwise their binaries are reported as missing,
+// so the caller takes the lock. If the metadata exists but can't be read, the
+// binaries can't be trusted, so the entry is reported as corrupt.
+func (d *Downloader) verifyCacheEntry(dirPath string, paths map[string]string, backfill bool) ([]string, error) {
+	missing, missingErr := missingBinaries(paths)
+	if missingErr != nil {
+		return nil, missingErr
+	}
+
+	metadata, metadataErr := readCacheMetadata(dirPath)
+	hasMetadata := metadataErr == nil
+	if metadataErr != nil && !os.IsNotExist(metadataErr) {
+		return missing, &CorruptCacheEntryError{
+			Path: path.Join(dirPath, metadataFileName),
+			msg:  metadataErr.Error(),
+		}
+	}
+	if metadata == nil {
+		metadata = &CacheMetadata{}
+	}
+	if metadata.Binaries == nil {
+		metadata.Binaries = map[string]BinaryMetadata{}
+	}
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	backfilled := false
+	for _, name := range names {
+		binPath := paths[name]
+		if contains(missing, name) {
+			continue
+		}
+
+		expected, ok := metadata.Binaries[name]
+		if !ok && hasMetadata {
+			return missing, &CorruptCacheEntryError{
+				Path: binPath,
+				msg:  "it's not recorded in the cache metadata",
+			}
+		}
+		if !ok && !backfill {
+			missing = append(missing, name)
+			continue
+		}
+		if !ok {
+			// We don't know what this binary should look like, so trust it and
+			// record it as it is
+			sha, size, hashErr := hashFile(binPath)
+			if hashErr != nil {
+				return nil, hashErr
+			}
+			metadata.Binaries[name] = BinaryMetadata{SHA256: sha, Size: size}
+			backfilled = true
+			continue
+		}
+
+		info, statErr := Afs.Stat(binPath)
+		if statErr != nil {
+			return nil, statErr
+		}
+		if info.Size() != expected.Size {
+			return missing, &CorruptCacheEntryError{
+				Path: binPath,
+				msg:  fmt.Sprintf("expected %d bytes, found %d", expected.Size, info.Size()),
+			}
+		}
+
+		if d.VerifyChecksums {
+			sha, _, hashErr := hashFile(binPath)
+			if hashErr != nil {
+				return nil, hashErr
+			}
+			if sha != expected.SHA256 {
+				return missing, &CorruptCacheEntryError{
+					Path: binPath,
+					msg:  fmt.Sprintf("expected SHA-256 %s, found %s", expected.SHA256, sha),
+				}
+			}
+		}
+	}
+
+	if backfilled && len(missing) == 0 {
+		d.logger().Debugf("recording metadata for cache entry %s", dirPath)
+		if metadata.ExtractedAt.IsZero() {
+			metadata.ExtractedAt = time.Now()
+		}
+		if writeErr := writeCacheMetadata(dirPath, metadata); writeErr != nil {
+			return nil, writeErr
+		}
+	}
+
+	return missing, nil
+}
+
+// touchCacheEntry records that the cache entry was used. It's called without
+// holding the entry's lock, so it leaves the metadata alone, and records the
+// use as the modification time of a file in lastUsedDirName instead.
+func touchCacheEntry(dirPath string) error {
+	lastUsedPath := path.Join(path.Dir(dirPath), lastUsedDirName, path.Base(dirPath))
+	now := time.Now()
+	chtimesErr := Afs.Chtimes(lastUsedPath, now, now)
+	if !os.IsNotExist(chtimesErr) {
+		return chtimesErr
+	}
+
+	if mkdirErr := Afs.MkdirAll(path.Dir(lastUsedPath), 0755); mkdirErr != nil {
+		return mkdirErr
+	}
+	return Afs.WriteFile(lastUsedPath, nil, 0644)
+}
+
+// quarantineCacheEntry moves a corrupt cache entry out of the way, so it can
+// be downloaded again, but can still be inspected
+func quarantineCacheEntry(cachePath string, dirname string) (string, error) {
+	dirPath := path.Join(cachePath, dirname)
+	quarantinePath := path.Join(cachePath, quarantineDirName, fmt.Sprintf("%s_%d", dirname, time.Now().UnixNano()))
+	if mkdirErr := Afs.MkdirAll(quarantinePath, 0755); mkdirErr != nil {
+		return "", fmt.Errorf("error creating directory %s: %s", quarantinePath, mkdirErr)
+	}
+
+	// We move the files one by one rather than renaming the directory, as
+	// not every afero.Fs moves the contents of renamed directories
+	entries, readErr := Afs.ReadDir(dirPath)
+	if readErr != nil {
+		return "", fmt.Errorf("error quarantining cache entry %s: %s", dirname, readErr)
+	}
+	for _, entry := range entries {
+		if renameErr := Afs.Rename(path.Join(dirPath, entry.Name()), path.Join(quarantinePath, entry.Name())); renameErr != nil {
+			return "", fmt.Errorf("error quarantining cache entry %s: %s", dirname, renameErr)
+		}
+	}
+
+	return quarantinePath, nil
+}
+
+func hashFile(filePath string) (string, int64, error) {
+	file, openErr := Afs.Open(filePath)
+	if openErr != nil {
+		return "", 0, openErr
+	}
+	defer file.Close()
+
+	shasum := sha256.New()
+	size, copyErr := io.Copy(shasum, file)
+	if copyErr != nil {
+		return "", 0, fmt.Errorf("error reading %s: %s", filePath, copyErr)
+	}
+
+	return hex.EncodeToString(shasum.Sum(nil)), size, nil
+}
+
+var versionInArchiveNameRegex = regexp.MustCompile(`\d+\.\d+\.\d+(-rc\d+)?`)
+
+// versionFromURL guesses the MongoDB version from the name of the archive at
+// urlStr
+func versionFromURL(urlStr string) string {
+	matches := versionInArchiveNameRegex.FindAllString(archiveBaseName(urlStr), -1)
+	if len(matches) == 0 {
+		return ""
+	}
+
+	return matches[len(matches)-1]
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
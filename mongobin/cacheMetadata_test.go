@@ -0,0 +1,269 @@
+package mongobin_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+func readMetadata(t *testing.T, dirPath string) mongobin.CacheMetadata {
+	contents, err := mongobin.Afs.ReadFile(path.Join(dirPath, "memongo.json"))
+	require.NoError(t, err)
+
+	metadata := mongobin.CacheMetadata{}
+	require.NoError(t, json.Unmarshal(contents, &metadata))
+	return metadata
+}
+
+func sha256Hex(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestCacheMetadataIsRecorded(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	tarball := makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod", "mongodb/bin/mongos": "mongos!"})
+	server, _ := countingServer(t, tarball)
+
+	downloader := &mongobin.Downloader{
+		CachePath: "/cache",
+		Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+	}
+	mongodPath, err := downloader.GetOrDownloadMongod(server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz?token=sekrit")
+	require.NoError(t, err)
+
+	metadata := readMetadata(t, path.Dir(mongodPath))
+	assert.Equal(t, server.URL+"/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz?token=REDACTED", metadata.SourceURL)
+	assert.Equal(t, sha256Hex(tarball), metadata.ArchiveSHA256)
+	assert.Equal(t, "6.0.4", metadata.Version)
+	assert.Equal(t, map[string]mongobin.BinaryMetadata{
+		"mongod": {SHA256: sha256Hex([]byte("mongod")), Size: 6},
+		"mongos": {SHA256: sha256Hex([]byte("mongos!")), Size: 7},
+	}, metadata.Binaries)
+	assert.False(t, metadata.ExtractedAt.IsZero())
+
+	// Using the cache entry again records when it was last used
+	time.Sleep(10 * time.Millisecond)
+	_, err = downloader.GetOrDownloadMongod(server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz?token=sekrit")
+	require.NoError(t, err)
+
+	entries, err := (&mongobin.Cache{Path: "/cache"}).List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, entries[0].LastUsedAt.After(metadata.LastUsedAt))
+
+	// without rewriting the metadata, which is only written under the lock
+	assert.Equal(t, metadata, readMetadata(t, path.Dir(mongodPath)))
+}
+
+func TestTruncatedCacheEntryIsQuarantined(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+	downloader := &mongobin.Downloader{
+		CachePath: "/cache",
+		Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+	}
+	urlStr := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+	mongodPath, err := downloader.GetOrDownloadMongod(urlStr)
+	require.NoError(t, err)
+
+	// Simulate a binary that was only partly written
+	require.NoError(t, mongobin.Afs.WriteFile(mongodPath, []byte("mon"), 0755))
+
+	mongodPath, err = downloader.GetOrDownloadMongod(urlStr)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+
+	content, err := mongobin.Afs.ReadFile(mongodPath)
+	require.NoError(t, err)
+	assert.Equal(t, "mongod", string(content))
+
+	quarantined, err := mongobin.Afs.ReadDir("/cache/.quarantine")
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	assert.Regexp(t, "^"+path.Base(path.Dir(mongodPath))+"_\\d+$", quarantined[0].Name())
+
+	content, err = mongobin.Afs.ReadFile(path.Join("/cache/.quarantine", quarantined[0].Name(), "mongod"))
+	require.NoError(t, err)
+	assert.Equal(t, "mon", string(content))
+}
+
+func TestCacheEntryWithUnreadableMetadataIsQuarantined(t *testing.T) {
+	tests := map[string]string{
+		"Truncated metadata": `{"sourceURL": "http://`,
+		"Unrecorded binary":  `{"binaries": {}}`,
+		"Not JSON":           "garbage",
+	}
+
+	for name, metadata := range tests {
+		t.Run(name, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+			downloader := &mongobin.Downloader{
+				CachePath: "/cache",
+				Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+			}
+			urlStr := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+			mongodPath, err := downloader.GetOrDownloadMongod(urlStr)
+			require.NoError(t, err)
+
+			// The binary can't be trusted without its metadata, even if its
+			// size would match
+			require.NoError(t, mongobin.Afs.WriteFile(mongodPath, []byte("MONGOD"), 0755))
+			require.NoError(t, mongobin.Afs.WriteFile(path.Join(path.Dir(mongodPath), "memongo.json"), []byte(metadata), 0644))
+
+			mongodPath, err = downloader.GetOrDownloadMongod(urlStr)
+			require.NoError(t, err)
+			assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+
+			content, err := mongobin.Afs.ReadFile(mongodPath)
+			require.NoError(t, err)
+			assert.Equal(t, "mongod", string(content))
+			assert.Equal(t, sha256Hex([]byte("mongod")), readMetadata(t, path.Dir(mongodPath)).Binaries["mongod"].SHA256)
+
+			// No temp files are left behind by writing the metadata
+			files, err := mongobin.Afs.ReadDir(path.Dir(mongodPath))
+			require.NoError(t, err)
+			names := make([]string, 0, len(files))
+			for _, file := range files {
+				names = append(names, file.Name())
+			}
+			assert.ElementsMatch(t, []string{"memongo.json", "mongod"}, names)
+		})
+	}
+}
+
+func TestCacheChecksumVerification(t *testing.T) {
+	tests := map[string]struct {
+		verifyChecksums  bool
+		expectedRequests int32
+		expectedContent  string
+	}{
+		"Without checksum verification": {
+			verifyChecksums:  false,
+			expectedRequests: 1,
+			expectedContent:  "MONGOD",
+		},
+		"With checksum verification": {
+			verifyChecksums:  true,
+			expectedRequests: 2,
+			expectedContent:  "mongod",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+			downloader := &mongobin.Downloader{
+				CachePath:       "/cache",
+				Logger:          memongolog.New(nil, memongolog.LogLevelSilent),
+				VerifyChecksums: test.verifyChecksums,
+			}
+			urlStr := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+			mongodPath, err := downloader.GetOrDownloadMongod(urlStr)
+			require.NoError(t, err)
+
+			// Corrupt the binary without changing its size
+			require.NoError(t, mongobin.Afs.WriteFile(mongodPath, []byte("MONGOD"), 0755))
+
+			mongodPath, err = downloader.GetOrDownloadMongod(urlStr)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedRequests, atomic.LoadInt32(requests))
+
+			content, err := mongobin.Afs.ReadFile(mongodPath)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedContent, string(content))
+		})
+	}
+}
+
+func TestCacheMetadataIsBackfilled(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+	downloader := &mongobin.Downloader{
+		CachePath: "/cache",
+		Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+	}
+	urlStr := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+	mongodPath, err := downloader.GetOrDownloadMongod(urlStr)
+	require.NoError(t, err)
+
+	// Entries created by older versions of memongo have no metadata
+	require.NoError(t, mongobin.Afs.Remove(path.Join(path.Dir(mongodPath), "memongo.json")))
+
+	_, err = downloader.GetOrDownloadMongod(urlStr)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	metadata := readMetadata(t, path.Dir(mongodPath))
+	assert.Equal(t, map[string]mongobin.BinaryMetadata{
+		"mongod": {SHA256: sha256Hex([]byte("mongod")), Size: 6},
+	}, metadata.Binaries)
+}
+
+func TestCacheMetadataIsOnlyBackfilledUnderTheLock(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+	provider := &mongobin.URLProvider{
+		Downloader: &mongobin.Downloader{
+			CachePath: "/cache",
+			Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+		},
+		URL: server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+	}
+
+	paths, err := provider.Resolve(context.Background(), "6.0.4")
+	require.NoError(t, err)
+	require.NoError(t, paths.Release())
+	dirPath := path.Dir(paths.Mongod)
+	require.NoError(t, mongobin.Afs.Remove(path.Join(dirPath, "memongo.json")))
+
+	// Another process holds the lock on the entry
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	lockPath := path.Join("/cache/.locks", path.Base(dirPath)+".lock")
+	require.NoError(t, mongobin.Afs.WriteFile(lockPath, []byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), hostname)), 0644))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = provider.Resolve(ctx, "6.0.4")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+
+	exists, err := mongobin.Afs.Exists(path.Join(dirPath, "memongo.json"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Once the lock is released, the metadata is backfilled without
+	// downloading the archive again
+	require.NoError(t, mongobin.Afs.Remove(lockPath))
+	paths, err = provider.Resolve(context.Background(), "6.0.4")
+	require.NoError(t, err)
+	require.NoError(t, paths.Release())
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+	assert.Contains(t, readMetadata(t, dirPath).Binaries, "mongod")
+}
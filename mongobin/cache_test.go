@@ -0,0 +1,230 @@
+package mongobin_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// makeCacheEntry creates a cache entry holding a mongod of the given size,
+// last used at lastUsedAt
+func makeCacheEntry(t *testing.T, name string, version string, size int, lastUsedAt time.Time) {
+	dirPath := path.Join("/cache", name)
+	require.NoError(t, mongobin.Afs.MkdirAll(dirPath, 0755))
+	require.NoError(t, mongobin.Afs.WriteFile(path.Join(dirPath, "mongod"), []byte(strings.Repeat("m", size)), 0755))
+
+	metadata, err := json.Marshal(mongobin.CacheMetadata{
+		SourceURL:  "https://fastdl.mongodb.org/linux/" + name + ".tgz",
+		Version:    version,
+		Binaries:   map[string]mongobin.BinaryMetadata{"mongod": {Size: int64(size)}},
+		LastUsedAt: lastUsedAt,
+	})
+	require.NoError(t, err)
+	require.NoError(t, mongobin.Afs.WriteFile(path.Join(dirPath, "memongo.json"), metadata, 0644))
+}
+
+func entryNames(entries []mongobin.CacheEntry) []string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name
+	}
+	return names
+}
+
+func newTestCache() *mongobin.Cache {
+	return &mongobin.Cache{
+		Path:   "/cache",
+		Logger: memongolog.New(nil, memongolog.LogLevelSilent),
+	}
+}
+
+func TestCacheList(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	lastUsedAt := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	makeCacheEntry(t, "mongodb-6_0_4", "6.0.4", 100, lastUsedAt)
+	makeCacheEntry(t, "mongodb-5_0_3", "5.0.3", 10, lastUsedAt)
+	require.NoError(t, mongobin.Afs.MkdirAll("/cache/.locks", 0755))
+	require.NoError(t, mongobin.Afs.MkdirAll("/cache/.partial", 0755))
+
+	entries, err := newTestCache().List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"mongodb-5_0_3", "mongodb-6_0_4"}, entryNames(entries))
+
+	entry := entries[1]
+	assert.Equal(t, "/cache/mongodb-6_0_4", entry.Path)
+	assert.Equal(t, "6.0.4", entry.Version)
+	assert.Equal(t, "https://fastdl.mongodb.org/linux/mongodb-6_0_4.tgz", entry.SourceURL)
+	assert.True(t, lastUsedAt.Equal(entry.LastUsedAt))
+
+	info, err := mongobin.Afs.Stat("/cache/mongodb-6_0_4/memongo.json")
+	require.NoError(t, err)
+	assert.Equal(t, 100+info.Size(), entry.Size)
+}
+
+func TestCacheListEmpty(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	entries, err := newTestCache().List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestCachePrune(t *testing.T) {
+	now := time.Now()
+
+	tests := map[string]struct {
+		maxAge          time.Duration
+		maxTotalBytes   int64
+		expectedRemoved []string
+	}{
+		"No limits": {
+			expectedRemoved: []string{},
+		},
+		"Max age": {
+			maxAge:          36 * time.Hour,
+			expectedRemoved: []string{"older"},
+		},
+		"Max total bytes": {
+			maxTotalBytes:   3000,
+			expectedRemoved: []string{"older"},
+		},
+		"Max total bytes evicts least recently used first": {
+			maxTotalBytes:   2000,
+			expectedRemoved: []string{"older", "old"},
+		},
+		"Max total bytes that fits everything": {
+			maxTotalBytes:   100000,
+			expectedRemoved: []string{},
+		},
+		"Max age and max total bytes": {
+			maxAge:          36 * time.Hour,
+			maxTotalBytes:   1000,
+			expectedRemoved: []string{"older", "old", "new"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			makeCacheEntry(t, "new", "6.0.4", 1000, now.Add(-time.Hour))
+			makeCacheEntry(t, "old", "5.0.3", 1000, now.Add(-24*time.Hour))
+			makeCacheEntry(t, "older", "4.4.1", 1000, now.Add(-48*time.Hour))
+
+			removed, err := newTestCache().Prune(test.maxAge, test.maxTotalBytes)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedRemoved, entryNames(removed))
+
+			for _, name := range test.expectedRemoved {
+				exists, err := mongobin.Afs.DirExists(path.Join("/cache", name))
+				require.NoError(t, err)
+				assert.False(t, exists, name)
+			}
+		})
+	}
+}
+
+func TestCachePruneSkipsEntriesInUse(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+	setFastLocks(t)
+
+	now := time.Now()
+	makeCacheEntry(t, "downloading", "6.0.4", 1000, now.Add(-48*time.Hour))
+	makeCacheEntry(t, "running", "5.0.3", 1000, now.Add(-48*time.Hour))
+	makeCacheEntry(t, "unused", "4.4.1", 1000, now.Add(-48*time.Hour))
+
+	// Another process is downloading to the first entry
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	require.NoError(t, mongobin.Afs.MkdirAll("/cache/.locks", 0755))
+	require.NoError(t, mongobin.Afs.WriteFile("/cache/.locks/downloading.lock", []byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), hostname)), 0644))
+
+	// A server is running the second one
+	cache := newTestCache()
+	marker, err := cache.MarkInUse("/cache/running/mongod")
+	require.NoError(t, err)
+
+	removed, err := cache.Prune(time.Hour, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"unused"}, entryNames(removed))
+
+	err = cache.Remove(mongobin.CacheEntry{Name: "downloading"})
+	require.EqualError(t, err, "cache entry downloading is in use: it's being downloaded")
+	err = cache.Remove(mongobin.CacheEntry{Name: "running"})
+	require.EqualError(t, err, "cache entry running is in use: it's used by a running server")
+
+	// Once the server stops, the entry can be pruned
+	require.NoError(t, marker.Release())
+	removed, err = cache.Prune(time.Hour, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"running"}, entryNames(removed))
+}
+
+func TestCacheIgnoresMarkersOfDeadProcesses(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	makeCacheEntry(t, "mongodb-6_0_4", "6.0.4", 10, time.Now())
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	require.NoError(t, mongobin.Afs.MkdirAll("/cache/.inuse/mongodb-6_0_4", 0755))
+	require.NoError(t, mongobin.Afs.WriteFile("/cache/.inuse/mongodb-6_0_4/marker", []byte(fmt.Sprintf("%d\n%s\n", deadPID(t), hostname)), 0644))
+
+	require.NoError(t, newTestCache().Remove(mongobin.CacheEntry{Name: "mongodb-6_0_4"}))
+
+	exists, err := mongobin.Afs.DirExists("/cache/mongodb-6_0_4")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestCacheMarkInUseRemovedEntry(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	_, err := newTestCache().MarkInUse("/cache/mongodb-6_0_4/mongod")
+	require.Error(t, err)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = newTestCache().MarkInUse("/elsewhere/mongodb-6_0_4/mongod")
+	require.EqualError(t, err, "/elsewhere/mongodb-6_0_4/mongod is not in the cache at /cache")
+}
+
+func TestCachePurge(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	makeCacheEntry(t, "mongodb-6_0_4", "6.0.4", 10, time.Now())
+	makeCacheEntry(t, "mongodb-5_0_3", "5.0.3", 10, time.Now())
+	require.NoError(t, mongobin.Afs.MkdirAll("/cache/.quarantine/mongodb-4_4_1_123", 0755))
+
+	cache := newTestCache()
+	marker, err := cache.MarkInUse("/cache/mongodb-5_0_3/mongod")
+	require.NoError(t, err)
+
+	err = cache.Purge()
+	require.EqualError(t, err, "did not remove cache entries that are in use: mongodb-5_0_3")
+
+	entries, err := cache.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mongodb-5_0_3"}, entryNames(entries))
+
+	exists, err := mongobin.Afs.DirExists("/cache/.quarantine")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, marker.Release())
+	require.NoError(t, cache.Purge())
+
+	entries, err = cache.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,402 @@
+package mongobin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Timeouts and retries for downloading archives
+var (
+	// DownloadConnectTimeout is how long to wait for a connection (including
+	// the TLS handshake) to the download server to be established
+	DownloadConnectTimeout = 30 * time.Second
+
+	// DownloadIdleTimeout is how long a download may go without receiving
+	// any data before the attempt is abandoned
+	DownloadIdleTimeout = 60 * time.Second
+
+	// DownloadMaxAttempts is the number of times a download is attempted
+	// before giving up
+	DownloadMaxAttempts = 5
+
+	// DownloadInitialBackoff is the delay before the first retry. The delay
+	// doubles after each failed attempt, up to DownloadMaxBackoff.
+	DownloadInitialBackoff = 1 * time.Second
+
+	// DownloadMaxBackoff is the longest delay between two attempts
+	DownloadMaxBackoff = 30 * time.Second
+)
+
+// permanentDownloadError is an error that retrying won't fix, like a 404
+type permanentDownloadError struct {
+	err error
+}
+
+func (err *permanentDownloadError) Error() string {
+	return err.err.Error()
+}
+
+func (err *permanentDownloadError) Unwrap() error {
+	return err.err
+}
+
+// interruptedDownloadError is a download that failed part way through, and
+// left a partial download that the next attempt can resume
+type interruptedDownloadError struct {
+	err error
+}
+
+func (err *interruptedDownloadError) Error() string {
+	return err.err.Error()
+}
+
+func (err *interruptedDownloadError) Unwrap() error {
+	return err.err
+}
+
+// isResumable returns whether a download that failed with err can be resumed
+// later, i.e. it was interrupted rather than refused
+func isResumable(err error) bool {
+	permErr := &permanentDownloadError{}
+	return !errors.As(err, &permErr)
+}
+
+func (d *Downloader) httpClient() *http.Client {
+	if d.HTTPClient != nil {
+		return d.HTTPClient
+	}
+	return newDownloadClient()
+}
+
+func newDownloadClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   DownloadConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   DownloadConnectTimeout,
+			ResponseHeaderTimeout: DownloadIdleTimeout,
+		},
+	}
+}
+
+// downloadArchive downloads the file at urlStr to partialPath. If partialPath
+// already holds the beginning of the file (from an earlier, interrupted
+// attempt) and the server supports range requests, the download picks up
+// where it left off. Failed attempts are retried with exponential backoff.
+//
+// When downloadArchive returns without an error, partialPath holds the whole
+// file.
+func (d *Downloader) downloadArchive(ctx context.Context, urlStr string, partialPath string) error {
+	client := d.httpClient()
+	logger := d.logger()
+	redactedURL := RedactURL(urlStr)
+	backoff := DownloadInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := d.downloadAttempt(ctx, client, urlStr, partialPath)
+		if err == nil {
+			return nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		permErr := &permanentDownloadError{}
+		if errors.As(err, &permErr) || attempt >= DownloadMaxAttempts {
+			return err
+		}
+
+		logger.Warnf("attempt %d/%d to download %s failed, retrying in %s: %s", attempt, DownloadMaxAttempts, redactedURL, backoff, err)
+		if sleepErr := sleepContext(ctx, backoff); sleepErr != nil {
+			return sleepErr
+		}
+
+		backoff *= 2
+		if backoff > DownloadMaxBackoff {
+			backoff = DownloadMaxBackoff
+		}
+	}
+}
+
+func (d *Downloader) downloadAttempt(ctx context.Context, client *http.Client, urlStr string, partialPath string) error {
+	logger := d.logger()
+	redactedURL := RedactURL(urlStr)
+
+	var offset int64
+	if info, statErr := Afs.Stat(partialPath); statErr == nil {
+		offset = info.Size()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, reqErr := d.newDownloadRequest(ctx, urlStr, offset)
+	if reqErr != nil {
+		return reqErr
+	}
+
+	resp, httpGetErr := client.Do(req)
+	if httpGetErr != nil {
+		return fmt.Errorf("error getting tarball from %s: %s", redactedURL, stripURLFromError(httpGetErr))
+	}
+	defer resp.Body.Close()
+
+	flag := os.O_WRONLY | os.O_CREATE
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			_ = Afs.Remove(partialPath)
+			return fmt.Errorf("server sent an unexpected range (%q) while resuming at byte %d", resp.Header.Get("Content-Range"), offset)
+		}
+		logger.Debugf("resuming download of %s at byte %d", redactedURL, offset)
+		flag |= os.O_APPEND
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			logger.Debugf("server does not support resuming downloads, restarting download of %s", redactedURL)
+		}
+		flag |= os.O_TRUNC
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial file doesn't match what the server has; start over
+		_ = Afs.Remove(partialPath)
+		return fmt.Errorf("server could not resume download at byte %d", offset)
+	default:
+		statusErr := fmt.Errorf("HTTP request failed with status code %d", resp.StatusCode)
+		if isRetryableStatus(resp.StatusCode) {
+			return statusErr
+		}
+		return &permanentDownloadError{statusErr}
+	}
+
+	partialFile, openErr := Afs.OpenFile(partialPath, flag, 0644)
+	if openErr != nil {
+		return &permanentDownloadError{fmt.Errorf("error opening partial download at %s: %s", partialPath, openErr)}
+	}
+	defer partialFile.Close()
+
+	body := newIdleTimeoutReader(resp.Body, DownloadIdleTimeout, cancel)
+	defer body.stop()
+
+	_, copyErr := io.Copy(partialFile, body)
+	if copyErr != nil {
+		if body.timedOut() {
+			return fmt.Errorf("download from %s stalled for more than %s", redactedURL, DownloadIdleTimeout)
+		}
+		return fmt.Errorf("error downloading tarball from %s: %s", redactedURL, stripURLFromError(copyErr))
+	}
+
+	return partialFile.Close()
+}
+
+// sleepContext sleeps for duration, or until ctx is done, in which case it
+// returns ctx's error
+func sleepContext(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newDownloadRequest creates a request for the file at urlStr, with the
+// Downloader's headers if its host is one of HeaderHosts, that starts at
+// offset
+func (d *Downloader) newDownloadRequest(ctx context.Context, urlStr string, offset int64) (*http.Request, error) {
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if reqErr != nil {
+		return nil, &permanentDownloadError{fmt.Errorf("error creating request for %s: %s", RedactURL(urlStr), stripURLFromError(reqErr))}
+	}
+	if d.sendsHeadersTo(req.URL.Hostname()) {
+		for name, values := range d.Headers {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	return req, nil
+}
+
+// sendsHeadersTo reports whether the Downloader's headers are sent to host
+func (d *Downloader) sendsHeadersTo(host string) bool {
+	if contains(mongoDBHosts, host) {
+		return false
+	}
+	return len(d.HeaderHosts) == 0 || contains(d.HeaderHosts, host)
+}
+
+// mongoDBHosts are the hosts MongoDB publishes its archives on. Custom
+// headers are never sent to them, and they publish the SHA-256 checksum of
+// each archive next to it, as <archive URL>.sha256.
+var mongoDBHosts = []string{"fastdl.mongodb.org", "downloads.mongodb.com", "downloads.mongodb.org"}
+
+// maxChecksumFileSize is the largest checksum file we read
+const maxChecksumFileSize = 4 << 10
+
+// publishedChecksum returns the SHA-256 checksum MongoDB publishes for the
+// archive at urlStr, or "" if the archive isn't on one of MongoDB's hosts,
+// or its checksum can't be fetched
+func (d *Downloader) publishedChecksum(ctx context.Context, urlStr string) string {
+	logger := d.logger()
+
+	urlParsed, parseErr := url.Parse(urlStr)
+	if parseErr != nil || !contains(mongoDBHosts, urlParsed.Hostname()) {
+		return ""
+	}
+	urlParsed.Path += ".sha256"
+	checksumURL := urlParsed.String()
+
+	req, reqErr := d.newDownloadRequest(ctx, checksumURL, 0)
+	if reqErr != nil {
+		return ""
+	}
+
+	resp, getErr := d.httpClient().Do(req)
+	if getErr != nil {
+		logger.Warnf("error getting the published checksum of %s, not verifying it: %s", RedactURL(urlStr), stripURLFromError(getErr))
+		return ""
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		logger.Debugf("no checksum published at %s (status code %d), not verifying it", RedactURL(checksumURL), resp.StatusCode)
+		return ""
+	}
+
+	contents, readErr := io.ReadAll(io.LimitReader(resp.Body, maxChecksumFileSize))
+	if readErr != nil {
+		logger.Warnf("error reading the published checksum of %s, not verifying it: %s", RedactURL(urlStr), stripURLFromError(readErr))
+		return ""
+	}
+	checksum, checksumErr := parseChecksumFile(contents)
+	if checksumErr != nil {
+		logger.Warnf("the checksum file at %s %s, not verifying it", RedactURL(checksumURL), checksumErr)
+		return ""
+	}
+
+	return checksum
+}
+
+// redactedQueryParams are query parameters that commonly carry credentials,
+// e.g. in pre-signed URLs
+var redactedQueryParams = regexp.MustCompile(`(?i)(token|signature|credential|secret|password|key|auth)`)
+
+// RedactURL returns the URL with any credentials it holds (the password in
+// the user info, and query parameters that look like they hold a secret)
+// replaced, so it's safe to log
+func RedactURL(urlStr string) string {
+	urlParsed, parseErr := url.Parse(urlStr)
+	if parseErr != nil {
+		return "<unparseable URL>"
+	}
+
+	if urlParsed.User != nil {
+		urlParsed.User = url.User("REDACTED")
+	}
+
+	if urlParsed.RawQuery != "" {
+		query := urlParsed.Query()
+		for name := range query {
+			if redactedQueryParams.MatchString(name) {
+				query.Set(name, "REDACTED")
+			}
+		}
+		urlParsed.RawQuery = query.Encode()
+	}
+
+	return urlParsed.String()
+}
+
+// stripURLFromError removes the URL that net/http includes in its errors,
+// which may hold credentials
+func stripURLFromError(err error) error {
+	urlErr := &url.Error{}
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+}
+
+// contentRangeStart parses the first byte position out of a Content-Range
+// header like "bytes 100-199/200"
+func contentRangeStart(contentRange string) (int64, bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, false
+	}
+
+	byteRange := strings.SplitN(strings.TrimPrefix(contentRange, "bytes "), "-", 2)
+	if len(byteRange) != 2 {
+		return 0, false
+	}
+
+	start, err := strconv.ParseInt(byteRange[0], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return start, true
+}
+
+// idleTimeoutReader calls cancel if no data has been read for the given
+// timeout
+type idleTimeoutReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+	fired   int32
+}
+
+func newIdleTimeoutReader(r io.Reader, timeout time.Duration, cancel func()) *idleTimeoutReader {
+	reader := &idleTimeoutReader{
+		r:       r,
+		timeout: timeout,
+	}
+	reader.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&reader.fired, 1)
+		cancel()
+	})
+
+	return reader
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+func (r *idleTimeoutReader) timedOut() bool {
+	return atomic.LoadInt32(&r.fired) == 1
+}
+
+func (r *idleTimeoutReader) stop() {
+	r.timer.Stop()
+}
@@ -3,24 +3,73 @@ package mongobin
 import (
 	"fmt"
 	"os"
+	"path"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 
 	"github.com/acobaugh/osrelease"
+	"github.com/tryvium-travels/memongo/memongolog"
 )
 
-// We define these as package vars so we can override it in tests
-var EtcOsRelease = "/etc/os-release"
-var EtcRedhatRelease = "/etc/redhat-release"
-var GoOS = runtime.GOOS
-var GoArch = runtime.GOARCH
+// Defaults for the SpecOverrides fields that aren't set
+var (
+	// EtcOsRelease is the os-release file the Linux distro is detected from.
+	//
+	// Deprecated: set SpecOverrides.EtcDir instead.
+	EtcOsRelease = "/etc/os-release"
+
+	// EtcRedhatRelease is the redhat-release file the Linux distro is
+	// detected from if there's no os-release file.
+	//
+	// Deprecated: set SpecOverrides.EtcDir instead.
+	EtcRedhatRelease = "/etc/redhat-release"
+
+	// GoOS is the platform to download MongoDB for.
+	//
+	// Deprecated: set SpecOverrides.Platform instead.
+	GoOS = runtime.GOOS
+
+	// GoArch is the architecture to download MongoDB for.
+	//
+	// Deprecated: set SpecOverrides.Arch instead.
+	GoArch = runtime.GOARCH
+)
+
+// Edition is the edition of the MongoDB server
+type Edition string
+
+const (
+	// Community is the free MongoDB Community Server
+	Community Edition = ""
+
+	// Enterprise is MongoDB Enterprise Server, which has the inMemory storage
+	// engine
+	Enterprise Edition = "enterprise"
+)
+
+// ParseEdition parses "community" or "enterprise". An empty string is
+// Community.
+func ParseEdition(edition string) (Edition, error) {
+	switch strings.ToLower(edition) {
+	case "", "community":
+		return Community, nil
+	case "enterprise":
+		return Enterprise, nil
+	default:
+		return "", fmt.Errorf("unknown MongoDB edition %q, expected community or enterprise", edition)
+	}
+}
 
 // DownloadSpec specifies what copy of MongoDB to download
 type DownloadSpec struct {
 	// Version is what version of MongoDB to download
 	Version string
 
+	// Edition is Community or Enterprise
+	Edition Edition
+
 	// Platform is "osx" or "linux"
 	Platform string
 
@@ -32,38 +81,154 @@ type DownloadSpec struct {
 	// - x86_64
 	// - arm64
 	// - aarch64
+	// - ppc64le
+	// - s390x
 	Arch string
 
 	// OSName is one of:
+	// - ubuntu2404
 	// - ubuntu2204
 	// - ubuntu2004
 	// - ubuntu1804
 	// - ubuntu1604
 	// - ubuntu1404
+	// - debian12
+	// - debian11
 	// - debian10
 	// - debian92
 	// - debian81
+	// - suse15
 	// - suse12
-	// - rhel70
+	// - rhel93
+	// - rhel90
+	// - rhel83 (s390x only)
+	// - rhel82 (aarch64 only)
+	// - rhel81 (ppc64le only)
 	// - rhel80
+	// - rhel72 (s390x only)
+	// - rhel71 (ppc64le only)
+	// - rhel70
 	// - rhel62
 	// - amazon
 	// - amazon2
+	// - amazon2023
 	// - "" for other linux or for MacOS
 	OSName string
 }
 
+// SpecOverrides overrides what DetectSpec detects about the system, e.g.
+// inside a container whose /etc/os-release describes the build image, or to
+// download MongoDB for another system. Fields that are empty are detected.
+type SpecOverrides struct {
+	// Platform is "linux" or "osx" (or "darwin")
+	Platform string
+
+	// Arch is "x86_64" (or "amd64"), "aarch64" (or "arm64"), "ppc64le" or
+	// "s390x"
+	Arch string
+
+	// OSName is the OS build of MongoDB to download (see DownloadSpec.OSName).
+	// If it's set, the Linux distro isn't detected.
+	OSName string
+
+	// EtcDir is the directory holding the os-release (or redhat-release)
+	// file the Linux distro is detected from. Defaults to reading
+	// EtcOsRelease and EtcRedhatRelease.
+	EtcDir string
+
+	// Rules are tried before the rules memongo ships with (see
+	// LoadPlatformRules)
+	Rules *PlatformRules
+
+	// Edition of MongoDB to download. Defaults to Community.
+	Edition Edition
+}
+
+// targetSystem is the system a DownloadSpec is detected for
+type targetSystem struct {
+	// platform is "linux" or "osx"
+	platform string
+
+	// goArch is "amd64", "arm64", "ppc64le" or "s390x"
+	goArch string
+
+	osReleasePath     string
+	redhatReleasePath string
+
+	rules *PlatformRules
+}
+
+func (overrides *SpecOverrides) targetSystem() (*targetSystem, error) {
+	system := &targetSystem{
+		platform:          GoOS,
+		goArch:            GoArch,
+		osReleasePath:     EtcOsRelease,
+		redhatReleasePath: EtcRedhatRelease,
+		rules:             defaultPlatformRules,
+	}
+	if overrides != nil {
+		system.rules = mergePlatformRules(overrides.Rules, defaultPlatformRules)
+		if overrides.Platform != "" {
+			system.platform = overrides.Platform
+		}
+		if overrides.Arch != "" {
+			system.goArch = overrides.Arch
+		}
+		if overrides.EtcDir != "" {
+			system.osReleasePath = path.Join(overrides.EtcDir, "os-release")
+			system.redhatReleasePath = path.Join(overrides.EtcDir, "redhat-release")
+		}
+	}
+
+	switch system.platform {
+	case "darwin", "osx":
+		system.platform = "osx"
+	case "linux":
+	default:
+		return nil, &UnsupportedSystemError{msg: "your platform, " + system.platform + ", is not supported"}
+	}
+
+	switch system.goArch {
+	case "amd64", "x86_64":
+		system.goArch = "amd64"
+	case "arm64", "aarch64":
+		system.goArch = "arm64"
+	}
+
+	return system, nil
+}
+
 // MakeDownloadSpec returns a DownloadSpec for the current operating system
 func MakeDownloadSpec(version string) (*DownloadSpec, error) {
+	return DetectSpec(version, nil)
+}
+
+// MakeDownloadSpecWithLogger is like MakeDownloadSpec, but logs how the
+// operating system was detected, e.g. when a derivative distro is mapped
+// onto the distro it's based on
+func MakeDownloadSpecWithLogger(version string, logger *memongolog.Logger) (*DownloadSpec, error) {
+	return DetectSpecWithLogger(version, nil, logger)
+}
+
+// DetectSpec returns a DownloadSpec for the current operating system, with
+// the given overrides applied. overrides may be nil.
+func DetectSpec(version string, overrides *SpecOverrides) (*DownloadSpec, error) {
+	return DetectSpecWithLogger(version, overrides, memongolog.New(nil, memongolog.LogLevelSilent))
+}
+
+// DetectSpecWithLogger is like DetectSpec, but logs how the operating system
+// was detected
+func DetectSpecWithLogger(version string, overrides *SpecOverrides, logger *memongolog.Logger) (*DownloadSpec, error) {
 	parsedVersion, versionErr := parseVersion(version)
 	if versionErr != nil {
 		return nil, versionErr
 	}
 
-	platform, platformErr := detectPlatform()
-	if platformErr != nil {
-		return nil, platformErr
+	system, systemErr := overrides.targetSystem()
+	if systemErr != nil {
+		return nil, systemErr
 	}
+	platform := system.platform
 
 	ssl := false
 	if platform == "osx" && !versionGTE(parsedVersion, []int{4, 2, 0}) {
@@ -71,18 +236,35 @@ func MakeDownloadSpec(version string) (*DownloadSpec, error) {
 		ssl = true
 	}
 
-	osName := detectOSName(parsedVersion)
+	var osName string
+	if overrides != nil && overrides.OSName != "" {
+		if platform != "linux" {
+			return nil, &UnsupportedSystemError{msg: "OSName " + overrides.OSName + " is only used on linux, not " + platform}
+		}
+		osName = overrides.OSName
+	} else {
+		osName = detectOSName(system, parsedVersion, logger)
+	}
 	if platform == "linux" && osName == "" && versionGTE(parsedVersion, []int{4, 2, 0}) {
 		return nil, &UnsupportedSystemError{msg: "MongoDB 4.2 removed support for generic linux tarballs. Specify the download URL manually or use a supported distro. See: https://www.mongodb.com/blog/post/a-proposal-to-endoflife-our-generic-linux-tar-packages"}
 	}
 
-	arch, archErr := detectArch(platform, osName, parsedVersion)
+	edition := Community
+	if overrides != nil {
+		edition = overrides.Edition
+	}
+	if edition == Enterprise && platform == "linux" && osName == "" {
+		return nil, &UnsupportedSystemError{msg: "MongoDB Enterprise is only published for specific distros. Specify the download URL manually or use a supported distro."}
+	}
+
+	arch, archErr := detectArch(system, osName, parsedVersion)
 	if archErr != nil {
 		return nil, archErr
 	}
 
 	return &DownloadSpec{
 		Version:        version,
+		Edition:        edition,
 		Arch:           arch,
 		SSLBuildNeeded: ssl,
 		Platform:       platform,
@@ -133,89 +315,45 @@ func parseVersion(version string) ([]int, error) {
 	return []int{majorVersion, minorVersion, patchVersion}, nil
 }
 
-func detectPlatform() (string, error) {
-	switch GoOS {
-	case "darwin":
-		return "osx", nil
-	case "linux":
-		return "linux", nil
-	default:
-		return "", &UnsupportedSystemError{msg: "your platform, " + GoOS + ", is not supported"}
-	}
-}
-
-func detectArch(platform string, osName string, mongoVersion []int) (string, error) {
-	switch GoArch {
-	case "amd64":
-		return "x86_64", nil
-	case "arm64":
-		return arm64ArchFromOSNameAndVersion(platform, osName, mongoVersion)
-	default:
-		return "", &UnsupportedSystemError{msg: "your architecture, " + GoArch + ", is not supported"}
+func detectArch(system *targetSystem, osName string, mongoVersion []int) (string, error) {
+	if !system.rules.knowsGoArch(system.goArch) {
+		return "", &UnsupportedSystemError{msg: "your architecture, " + system.goArch + ", is not supported"}
 	}
-}
 
-func arm64ArchFromOSNameAndVersion(platform string, osName string, mongoVersion []int) (string, error) {
 	// version numbers extracted from https://www.mongodb.com/download-center/community/releases/archive
-	if !versionGTE(mongoVersion, []int{3, 4, 0}) {
+	if system.goArch == "arm64" && !versionGTE(mongoVersion, []int{3, 4, 0}) {
 		return "", &UnsupportedSystemError{msg: "arm64 support was introduced in Mongo 3.4.0"}
 	}
 
-	// ubuntu1604 arm support was introduced in version 3.4.0 and removed in version 4.0.27
-	if osName == "ubuntu1604" && !versionGTE(mongoVersion, []int{4, 0, 27}) {
-		return "arm64", nil
-	}
-
-	if osName == "ubuntu1804" && versionGTE(mongoVersion, []int{4, 2, 0}) {
-		return "aarch64", nil
-	}
-
-	if osName == "ubuntu2004" && versionGTE(mongoVersion, []int{4, 4, 0}) {
-		return "aarch64", nil
-	}
-
-	if osName == "ubuntu2204" && versionGTE(mongoVersion, []int{6, 0, 4}) {
-		return "aarch64", nil
-	}
-
-	if osName == "amazon2" && versionGTE(mongoVersion, []int{4, 2, 13}) {
-		return "aarch64", nil
-	}
-
-	// TODO: "rhel82" isn't a value that osName can have yet as osNameFromOsRelease doesn't support this version
-	if osName == "rhel82" && versionGTE(mongoVersion, []int{4, 4, 4}) {
-		return "aarch64", nil
-	}
-
-	if platform == "osx" && versionGTE(mongoVersion, []int{6, 0, 0}) {
-		return "arm64", nil
+	if arch, ok := system.rules.arch(system.platform, osName, system.goArch, mongoVersion); ok {
+		return arch, nil
 	}
 
 	os := osName
 	if os == "" {
-		os = platform
+		os = system.platform
 	}
 
 	versionString := fmt.Sprintf("%d.%d.%d", mongoVersion[0], mongoVersion[1], mongoVersion[2])
-	return "", &UnsupportedSystemError{msg: "Mongo doesn't support your environment, " + os + "/" + GoArch + ", on version " + versionString}
+	return "", &UnsupportedSystemError{msg: "Mongo doesn't support your environment, " + os + "/" + system.goArch + ", on version " + versionString}
 }
 
-func detectOSName(mongoVersion []int) string {
-	if GoOS != "linux" {
+func detectOSName(system *targetSystem, mongoVersion []int, logger *memongolog.Logger) string {
+	if system.platform != "linux" {
 		// Not on Linux
 		return ""
 	}
 
-	osRelease, osReleaseErr := osrelease.ReadFile(EtcOsRelease)
+	osRelease, osReleaseErr := osrelease.ReadFile(system.osReleasePath)
 	if osReleaseErr == nil {
-		return osNameFromOsRelease(osRelease, mongoVersion)
+		return osNameFromOsRelease(osRelease, system, mongoVersion, logger)
 	}
 
-	// We control etcRedhatRelease
+	// We control redhatReleasePath
 	//nolint:gosec
-	redhatRelease, redhatReleaseErr := os.ReadFile(EtcRedhatRelease)
+	redhatRelease, redhatReleaseErr := os.ReadFile(system.redhatReleasePath)
 	if redhatReleaseErr == nil {
-		return osNameFromRedhatRelease(string(redhatRelease))
+		return osNameFromRedhatRelease(string(redhatRelease), system, mongoVersion)
 	}
 
 	return ""
@@ -241,85 +379,118 @@ func versionGTE(a []int, b []int) bool {
 	return a[2] >= b[2]
 }
 
-func osNameFromOsRelease(osRelease map[string]string, mongoVersion []int) string {
-	id := osRelease["ID"]
+func osNameFromOsRelease(osRelease map[string]string, system *targetSystem, mongoVersion []int, logger *memongolog.Logger) string {
+	if osName, known := osNameFromDistro(osRelease["ID"], osRelease["VERSION_ID"], system, mongoVersion); known {
+		return osName
+	}
 
-	majorVersionString := strings.Split(osRelease["VERSION_ID"], ".")[0]
-	majorVersion, err := strconv.Atoi(majorVersionString)
-	if err != nil {
+	// Derivative distros, like Linux Mint or Oracle Linux, can use the
+	// builds for the distro they're based on
+	upstreamID, upstreamVersion, source := upstreamDistro(osRelease)
+	if upstreamID == "" {
 		return ""
 	}
 
-	switch id {
-	case "ubuntu":
-		return osNameFromUbuntuRelease(majorVersion, mongoVersion)
-	case "sles":
-		if majorVersion >= 12 {
-			return "suse12"
-		}
-	case "centos", "rhel":
-		if majorVersion >= 8 {
-			return "rhel80"
-		}
-		if majorVersion == 7 {
-			return "rhel70"
-		}
-	case "debian":
-		return osNameFromDebianRelease(majorVersion, mongoVersion)
-	case "amzn":
-		return osNameFromAmznRelease(majorVersion, mongoVersion)
+	osName, _ := osNameFromDistro(upstreamID, upstreamVersion, system, mongoVersion)
+	if osName != "" {
+		logger.Infof("%s %s is based on %s %s (according to %s); using the %s build of MongoDB", osRelease["ID"], osRelease["VERSION_ID"], upstreamID, upstreamVersion, source, osName)
 	}
 
-	return ""
+	return osName
 }
-func osNameFromUbuntuRelease(majorVersion int, mongoVersion []int) string {
-	if majorVersion >= 22 && versionGTE(mongoVersion, []int{6, 0, 4}) {
-		return "ubuntu2204"
-	}
-	if majorVersion >= 20 && versionGTE(mongoVersion, []int{4, 4, 0}) {
-		return "ubuntu2004"
-	}
-	if majorVersion >= 18 && versionGTE(mongoVersion, []int{4, 0, 1}) {
-		return "ubuntu1804"
-	}
-	if majorVersion >= 16 && versionGTE(mongoVersion, []int{3, 2, 7}) {
-		return "ubuntu1604"
-	}
-	if majorVersion >= 14 {
-		return "ubuntu1404"
-	}
-	return ""
+
+// osNameFromDistro returns the OSName for a distro, given its ID and
+// VERSION_ID from /etc/os-release. It returns false if the distro isn't one
+// MongoDB publishes builds for.
+func osNameFromDistro(id string, versionID string, system *targetSystem, mongoVersion []int) (string, bool) {
+	return system.rules.osName(id, leadingVersionParts(versionID), system.goArch, mongoVersion)
 }
 
-func osNameFromDebianRelease(majorVersion int, mongoVersion []int) string {
-	if majorVersion >= 11 && versionGTE(mongoVersion, []int{5, 0, 8}) {
-		return "debian11"
-	}
-	if majorVersion >= 10 && versionGTE(mongoVersion, []int{4, 2, 1}) {
-		return "debian10"
-	}
-	if majorVersion >= 9 && versionGTE(mongoVersion, []int{3, 6, 5}) {
-		return "debian92"
-	}
-	if majorVersion >= 8 && versionGTE(mongoVersion, []int{3, 2, 8}) {
-		return "debian81"
+// leadingVersionParts parses the numeric parts at the start of a VERSION_ID,
+// e.g. [8, 2] for "8.2" or [2018, 3] for "2018.03"
+func leadingVersionParts(versionID string) []int {
+	var parts []int
+	for _, part := range strings.Split(versionID, ".") {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			break
+		}
+		parts = append(parts, number)
 	}
-	return ""
+	return parts
 }
 
-func osNameFromAmznRelease(majorVersion int, mongoVersion []int) string {
-	if majorVersion == 2 && versionGTE(mongoVersion, []int{4, 0, 0}) {
-		return "amazon2"
+// ubuntuCodenames maps the codenames of Ubuntu releases to their versions
+var ubuntuCodenames = map[string]string{
+	"trusty": "14.04",
+	"xenial": "16.04",
+	"bionic": "18.04",
+	"focal":  "20.04",
+	"jammy":  "22.04",
+	"noble":  "24.04",
+}
+
+// debianCodenames maps the codenames of Debian releases to their versions
+var debianCodenames = map[string]string{
+	"jessie":   "8",
+	"stretch":  "9",
+	"buster":   "10",
+	"bullseye": "11",
+	"bookworm": "12",
+	"trixie":   "13",
+}
+
+var enterpriseLinuxPlatformRegex = regexp.MustCompile(`^platform:el(\d+)$`)
+
+// upstreamDistro works out which distro a derivative distro is based on,
+// from its ID_LIKE and codename fields. It returns the upstream ID and
+// VERSION_ID, and the field they were worked out from.
+func upstreamDistro(osRelease map[string]string) (string, string, string) {
+	if version, ok := ubuntuCodenames[osRelease["UBUNTU_CODENAME"]]; ok {
+		return "ubuntu", version, "UBUNTU_CODENAME"
+	}
+
+	for _, like := range strings.Fields(osRelease["ID_LIKE"]) {
+		switch like {
+		case "ubuntu":
+			if version, ok := ubuntuCodenames[osRelease["VERSION_CODENAME"]]; ok {
+				return "ubuntu", version, "VERSION_CODENAME"
+			}
+		case "debian":
+			// Only the codename tells us which Debian release a derivative is
+			// based on; its VERSION_ID is its own
+			for _, field := range []string{"DEBIAN_CODENAME", "VERSION_CODENAME"} {
+				if version, ok := debianCodenames[osRelease[field]]; ok {
+					return "debian", version, field
+				}
+			}
+		case "rhel", "centos", "fedora":
+			// Fedora itself isn't an Enterprise Linux, so we need the
+			// PLATFORM_ID to know which RHEL release a distro is compatible
+			// with
+			if match := enterpriseLinuxPlatformRegex.FindStringSubmatch(osRelease["PLATFORM_ID"]); match != nil {
+				version := match[1]
+				if strings.HasPrefix(osRelease["VERSION_ID"], version+".") {
+					version = osRelease["VERSION_ID"]
+				}
+				return "rhel", version, "PLATFORM_ID"
+			}
+			if like != "fedora" {
+				return "rhel", osRelease["VERSION_ID"], "ID_LIKE"
+			}
+		case "suse", "sles", "opensuse":
+			return "sles", osRelease["VERSION_ID"], "ID_LIKE"
+		}
 	}
 
-	// Version before 2 has the release date, not a real version number
-	return "amazon"
+	return "", "", ""
 }
 
-func osNameFromRedhatRelease(redhatRelease string) string {
+func osNameFromRedhatRelease(redhatRelease string, system *targetSystem, mongoVersion []int) string {
 	// RHEL 7 uses /etc/os-release, so we're just detecting RHEL 6 here
 	if strings.Contains(redhatRelease, "release 6") {
-		return "rhel62"
+		osName, _ := osNameFromDistro("rhel", "6", system, mongoVersion)
+		return osName
 	}
 
 	return ""
@@ -1,10 +1,12 @@
 package mongobin_test
 
 import (
-	"runtime"
+	"bytes"
+	"log"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
 	"github.com/tryvium-travels/memongo/mongobin"
 )
 
@@ -456,6 +458,170 @@ func TestMakeDownloadSpec(t *testing.T) {
 
 			expectedError: "memongo does not support automatic downloading on your system: your platform, foo, is not supported",
 		},
+		"ppc64le RHEL 8": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "rhel82",
+			goArch:       "ppc64le",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "ppc64le",
+				OSName:         "rhel81",
+			},
+		},
+		"ppc64le RHEL 8 older mongo": {
+			mongoVersion: "4.2.1",
+			etcFolder:    "rhel82",
+			goArch:       "ppc64le",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.2.1",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "ppc64le",
+				OSName:         "rhel71",
+			},
+		},
+		"ppc64le RHEL 7": {
+			mongoVersion: "4.2.1",
+			etcFolder:    "rhel7",
+			goArch:       "ppc64le",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.2.1",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "ppc64le",
+				OSName:         "rhel71",
+			},
+		},
+		"ppc64le RHEL 7 newer mongo": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "rhel7",
+			goArch:       "ppc64le",
+
+			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, rhel71/ppc64le, on version 6.0.4",
+		},
+		"ppc64le Ubuntu 18.04": {
+			mongoVersion: "4.4.0",
+			etcFolder:    "ubuntu1804",
+			goArch:       "ppc64le",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.4.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "ppc64le",
+				OSName:         "ubuntu1804",
+			},
+		},
+		"ppc64le Ubuntu 20.04": {
+			mongoVersion: "4.4.0",
+			etcFolder:    "ubuntu2004",
+			goArch:       "ppc64le",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.4.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "ppc64le",
+				OSName:         "ubuntu1804",
+			},
+		},
+		"ppc64le Ubuntu 22.04": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "ubuntu2204",
+			goArch:       "ppc64le",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "ppc64le",
+				OSName:         "ubuntu1804",
+			},
+		},
+		"ppc64le Ubuntu 22.04 newer mongo": {
+			mongoVersion: "7.0.2",
+			etcFolder:    "ubuntu2204",
+			goArch:       "ppc64le",
+
+			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, ubuntu2204/ppc64le, on version 7.0.2",
+		},
+		"s390x RHEL 9": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "rhel90",
+			goArch:       "s390x",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "s390x",
+				OSName:         "rhel83",
+			},
+		},
+		"s390x RHEL 8 older mongo": {
+			mongoVersion: "4.4.0",
+			etcFolder:    "rhel82",
+			goArch:       "s390x",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.4.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "s390x",
+				OSName:         "rhel72",
+			},
+		},
+		"s390x RHEL 7": {
+			mongoVersion: "4.0.6",
+			etcFolder:    "rhel7",
+			goArch:       "s390x",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.0.6",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "s390x",
+				OSName:         "rhel72",
+			},
+		},
+		"s390x RHEL 7 older mongo": {
+			mongoVersion: "4.0.5",
+			etcFolder:    "rhel7",
+			goArch:       "s390x",
+
+			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, rhel72/s390x, on version 4.0.5",
+		},
+		"s390x Ubuntu 22.04": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "ubuntu2204",
+			goArch:       "s390x",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "s390x",
+				OSName:         "ubuntu1804",
+			},
+		},
+		"s390x Ubuntu 18.04": {
+			mongoVersion: "5.0.3",
+			etcFolder:    "ubuntu1804",
+			goArch:       "s390x",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "5.0.3",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "s390x",
+				OSName:         "ubuntu1804",
+			},
+		},
 		"Other Arch": {
 			goArch: "386",
 
@@ -552,7 +718,7 @@ func TestMakeDownloadSpec(t *testing.T) {
 			etcFolder:    "rhel82",
 			goArch:       "arm64",
 
-			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, linux/arm64, on version 4.1.0",
+			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, rhel82/arm64, on version 4.1.0",
 		},
 		"MongoDB Unsupported version for arm mac": {
 			mongoVersion: "4.1.0",
@@ -561,6 +727,370 @@ func TestMakeDownloadSpec(t *testing.T) {
 
 			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, osx/arm64, on version 4.1.0",
 		},
+		"ubuntu 24.04": {
+			mongoVersion: "8.0.0",
+			etcFolder:    "ubuntu2404",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "8.0.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "ubuntu2404",
+			},
+		},
+		"arm64 ubuntu 24.04": {
+			mongoVersion: "8.0.0",
+			etcFolder:    "ubuntu2404",
+			goArch:       "arm64",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "8.0.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "aarch64",
+				OSName:         "ubuntu2404",
+			},
+		},
+		"ubuntu 24.04 older mongo": {
+			mongoVersion: "7.0.2",
+			etcFolder:    "ubuntu2404",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "7.0.2",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "ubuntu2204",
+			},
+		},
+		"debian 12": {
+			mongoVersion: "7.0.3",
+			etcFolder:    "debianbookworm",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "7.0.3",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "debian12",
+			},
+		},
+		"debian 12 older mongo": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "debianbookworm",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "debian11",
+			},
+		},
+		"rhel 8.2": {
+			mongoVersion: "4.4.4",
+			etcFolder:    "rhel82",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.4.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "rhel80",
+			},
+		},
+		"arm64 rhel 8.2": {
+			mongoVersion: "4.4.4",
+			etcFolder:    "rhel82",
+			goArch:       "arm64",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.4.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "aarch64",
+				OSName:         "rhel82",
+			},
+		},
+		"arm64 rocky 8": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "rocky8",
+			goArch:       "arm64",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "aarch64",
+				OSName:         "rhel82",
+			},
+		},
+		"rhel 9.0": {
+			mongoVersion: "6.0.7",
+			etcFolder:    "rhel90",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.7",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "rhel90",
+			},
+		},
+		"arm64 rhel 9.0": {
+			mongoVersion: "6.0.7",
+			etcFolder:    "rhel90",
+			goArch:       "arm64",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.7",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "aarch64",
+				OSName:         "rhel90",
+			},
+		},
+		"rhel 9.0 older mongo": {
+			mongoVersion: "6.0.6",
+			etcFolder:    "rhel90",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.6",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "rhel80",
+			},
+		},
+		"rhel 9.3": {
+			mongoVersion: "8.0.0",
+			etcFolder:    "rhel93",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "8.0.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "rhel93",
+			},
+		},
+		"arm64 rhel 9.3": {
+			mongoVersion: "8.0.0",
+			etcFolder:    "rhel93",
+			goArch:       "arm64",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "8.0.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "aarch64",
+				OSName:         "rhel93",
+			},
+		},
+		"rhel 9.3 older mongo": {
+			mongoVersion: "7.0.2",
+			etcFolder:    "rhel93",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "7.0.2",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "rhel90",
+			},
+		},
+		"almalinux 9": {
+			mongoVersion: "8.0.0",
+			etcFolder:    "almalinux9",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "8.0.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "rhel93",
+			},
+		},
+		"amazon linux 2023": {
+			mongoVersion: "7.0.0",
+			etcFolder:    "amazon2023",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "7.0.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "amazon2023",
+			},
+		},
+		"arm64 amazon linux 2023": {
+			mongoVersion: "7.0.0",
+			etcFolder:    "amazon2023",
+			goArch:       "arm64",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "7.0.0",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "aarch64",
+				OSName:         "amazon2023",
+			},
+		},
+		"amazon linux 2023 older mongo": {
+			// There's no build for Amazon Linux 2023 before 7.0, and the
+			// Amazon Linux 2 build needs OpenSSL 1.x, which it doesn't ship
+			mongoVersion: "6.0.4",
+			etcFolder:    "amazon2023",
+
+			expectedError: "memongo does not support automatic downloading on your system: MongoDB 4.2 removed support for generic linux tarballs. Specify the download URL manually or use a supported distro. See: https://www.mongodb.com/blog/post/a-proposal-to-endoflife-our-generic-linux-tar-packages",
+		},
+		"suse 15": {
+			mongoVersion: "4.2.1",
+			etcFolder:    "suse15",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.2.1",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "suse15",
+			},
+		},
+		"suse 15 older mongo": {
+			mongoVersion: "4.0.5",
+			etcFolder:    "suse15",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "4.0.5",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "suse12",
+			},
+		},
+		"MongoDB Unsupported version for arm64 debian12": {
+			mongoVersion: "7.0.3",
+			etcFolder:    "debianbookworm",
+			goArch:       "arm64",
+
+			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, debian12/arm64, on version 7.0.3",
+		},
+		"MongoDB Unsupported version for arm64 suse15": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "suse15",
+			goArch:       "arm64",
+
+			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, suse15/arm64, on version 6.0.4",
+		},
+		"linux mint 21 (UBUNTU_CODENAME)": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "linuxmint21",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "ubuntu2204",
+			},
+		},
+		"pop!_os 22.04 (UBUNTU_CODENAME)": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "popos2204",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "ubuntu2204",
+			},
+		},
+		"elementary os 7 (UBUNTU_CODENAME)": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "elementary7",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "ubuntu2204",
+			},
+		},
+		"lmde 6 (DEBIAN_CODENAME)": {
+			mongoVersion: "7.0.3",
+			etcFolder:    "lmde6",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "7.0.3",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "debian12",
+			},
+		},
+		"raspbian 11 (VERSION_CODENAME)": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "raspbian11",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "debian11",
+			},
+		},
+		"rocky 8": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "rocky8",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "rhel80",
+			},
+		},
+		"oracle linux 8 (PLATFORM_ID)": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "oraclelinux8",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "rhel80",
+			},
+		},
+		"opensuse leap 15 (ID_LIKE)": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "opensuseleap15",
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:        "6.0.4",
+				Platform:       "linux",
+				SSLBuildNeeded: false,
+				Arch:           "x86_64",
+				OSName:         "suse15",
+			},
+		},
+		"kali rolling has no known upstream release": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "kalirolling",
+
+			expectedError: "memongo does not support automatic downloading on your system: MongoDB 4.2 removed support for generic linux tarballs. Specify the download URL manually or use a supported distro. See: https://www.mongodb.com/blog/post/a-proposal-to-endoflife-our-generic-linux-tar-packages",
+		},
+		"fedora is not an enterprise linux": {
+			mongoVersion: "6.0.4",
+			etcFolder:    "fedora39",
+
+			expectedError: "memongo does not support automatic downloading on your system: MongoDB 4.2 removed support for generic linux tarballs. Specify the download URL manually or use a supported distro. See: https://www.mongodb.com/blog/post/a-proposal-to-endoflife-our-generic-linux-tar-packages",
+		},
 		"MongoDB 3.0": {
 			mongoVersion: "3.0.2",
 
@@ -600,39 +1130,27 @@ func TestMakeDownloadSpec(t *testing.T) {
 
 	for testName, test := range tests {
 		t.Run(testName, func(t *testing.T) {
-			if test.etcFolder == "" {
-				mongobin.EtcOsRelease = "./testdata/etc/empty-etc/os-release"
-				mongobin.EtcRedhatRelease = "./testdata/etc/empty-etc/redhat-release"
-			} else {
-				mongobin.EtcOsRelease = "./testdata/etc/" + test.etcFolder + "/os-release"
-				mongobin.EtcRedhatRelease = "./testdata/etc/" + test.etcFolder + "/redhat-release"
+			overrides := &mongobin.SpecOverrides{
+				Platform: "linux",
+				Arch:     "amd64",
+				EtcDir:   "./testdata/etc/empty-etc",
 			}
-
-			if test.goArch == "" {
-				mongobin.GoArch = "amd64"
-			} else {
-				mongobin.GoArch = test.goArch
+			if test.etcFolder != "" {
+				overrides.EtcDir = "./testdata/etc/" + test.etcFolder
 			}
-
-			if test.goOs == "" {
-				mongobin.GoOS = "linux"
-			} else {
-				mongobin.GoOS = test.goOs
+			if test.goArch != "" {
+				overrides.Arch = test.goArch
+			}
+			if test.goOs != "" {
+				overrides.Platform = test.goOs
 			}
-
-			defer func() {
-				mongobin.EtcOsRelease = "/etc/os-release"
-				mongobin.EtcRedhatRelease = "/etc/redhat-release"
-				mongobin.GoOS = runtime.GOOS
-				mongobin.GoArch = runtime.GOARCH
-			}()
 
 			mongoVersion := test.mongoVersion
 			if mongoVersion == "" {
 				mongoVersion = testMongoVersion
 			}
 
-			result, err := mongobin.MakeDownloadSpec(mongoVersion)
+			result, err := mongobin.DetectSpec(mongoVersion, overrides)
 
 			if test.expectedError != "" {
 				require.Error(t, err)
@@ -649,3 +1167,122 @@ func TestMakeDownloadSpec(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeDownloadSpecLogsUpstreamDistro(t *testing.T) {
+	overrides := &mongobin.SpecOverrides{Platform: "linux", Arch: "amd64", EtcDir: "./testdata/etc/linuxmint21"}
+
+	logOutput := &bytes.Buffer{}
+	spec, err := mongobin.DetectSpecWithLogger("6.0.4", overrides, memongolog.New(log.New(logOutput, "", 0), memongolog.LogLevelInfo))
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu2204", spec.OSName)
+	require.Equal(t, "[memongo] [INFO]  linuxmint 21.2 is based on ubuntu 22.04 (according to UBUNTU_CODENAME); using the ubuntu2204 build of MongoDB\n", logOutput.String())
+}
+
+func TestDetectSpecOverrides(t *testing.T) {
+	tests := map[string]struct {
+		overrides mongobin.SpecOverrides
+
+		expectedSpec  *mongobin.DownloadSpec
+		expectedError string
+	}{
+		"MongoDB arch names": {
+			overrides: mongobin.SpecOverrides{Platform: "linux", Arch: "aarch64", EtcDir: "./testdata/etc/ubuntu2204"},
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:  latestMongoVersion,
+				Platform: "linux",
+				Arch:     "aarch64",
+				OSName:   "ubuntu2204",
+			},
+		},
+		"OSName skips detection": {
+			overrides: mongobin.SpecOverrides{Platform: "linux", Arch: "x86_64", OSName: "rhel80", EtcDir: "./testdata/etc/ubuntu2204"},
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:  latestMongoVersion,
+				Platform: "linux",
+				Arch:     "x86_64",
+				OSName:   "rhel80",
+			},
+		},
+		"OSName gates arm64": {
+			overrides: mongobin.SpecOverrides{Platform: "linux", Arch: "arm64", OSName: "debian11"},
+
+			expectedError: "memongo does not support automatic downloading on your system: Mongo doesn't support your environment, debian11/arm64, on version 6.0.4",
+		},
+		"Enterprise": {
+			overrides: mongobin.SpecOverrides{Platform: "linux", Arch: "amd64", EtcDir: "./testdata/etc/ubuntu2204", Edition: mongobin.Enterprise},
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:  latestMongoVersion,
+				Edition:  mongobin.Enterprise,
+				Platform: "linux",
+				Arch:     "x86_64",
+				OSName:   "ubuntu2204",
+			},
+		},
+		"macOS": {
+			overrides: mongobin.SpecOverrides{Platform: "osx", Arch: "arm64"},
+
+			expectedSpec: &mongobin.DownloadSpec{
+				Version:  latestMongoVersion,
+				Platform: "osx",
+				Arch:     "arm64",
+			},
+		},
+		"OSName on macOS": {
+			overrides: mongobin.SpecOverrides{Platform: "osx", OSName: "ubuntu2204"},
+
+			expectedError: "memongo does not support automatic downloading on your system: OSName ubuntu2204 is only used on linux, not osx",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			result, err := mongobin.DetectSpec(latestMongoVersion, &test.overrides)
+
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				require.Nil(t, result)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, test.expectedSpec, result)
+			}
+		})
+	}
+}
+
+func TestDetectSpecEnterpriseOnOtherLinux(t *testing.T) {
+	_, err := mongobin.DetectSpec(testMongoVersion, &mongobin.SpecOverrides{
+		Platform: "linux",
+		Arch:     "amd64",
+		EtcDir:   "./testdata/etc/empty-etc",
+		Edition:  mongobin.Enterprise,
+	})
+	require.EqualError(t, err, "memongo does not support automatic downloading on your system: MongoDB Enterprise is only published for specific distros. Specify the download URL manually or use a supported distro.")
+}
+
+func TestDeprecatedSystemVarsAreTheDefaults(t *testing.T) {
+	oldGoOS, oldGoArch, oldEtcOsRelease := mongobin.GoOS, mongobin.GoArch, mongobin.EtcOsRelease
+	defer func() {
+		mongobin.GoOS, mongobin.GoArch, mongobin.EtcOsRelease = oldGoOS, oldGoArch, oldEtcOsRelease
+	}()
+	mongobin.GoOS = "linux"
+	mongobin.GoArch = "arm64"
+	mongobin.EtcOsRelease = "./testdata/etc/ubuntu2204/os-release"
+
+	spec, err := mongobin.MakeDownloadSpec(latestMongoVersion)
+	require.NoError(t, err)
+	require.Equal(t, &mongobin.DownloadSpec{
+		Version:  latestMongoVersion,
+		Platform: "linux",
+		Arch:     "aarch64",
+		OSName:   "ubuntu2204",
+	}, spec)
+
+	// Overrides still win
+	spec, err = mongobin.DetectSpec(latestMongoVersion, &mongobin.SpecOverrides{Arch: "amd64", EtcDir: "./testdata/etc/ubuntu2004"})
+	require.NoError(t, err)
+	require.Equal(t, "x86_64", spec.Arch)
+	require.Equal(t, "ubuntu2004", spec.OSName)
+}
@@ -0,0 +1,191 @@
+package mongobin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// downloadStream reads the file at a URL straight from the server, without
+// saving it to disk first. When the connection fails part way through, it
+// reconnects with exponential backoff and picks up where it left off with a
+// range request, or by skipping what it already read if the server doesn't
+// support those. Like downloadArchive, it gives up after DownloadMaxAttempts
+// attempts.
+type downloadStream struct {
+	d      *Downloader
+	ctx    context.Context
+	client *http.Client
+	urlStr string
+
+	// offset is the number of bytes read so far
+	offset int64
+	// noRanges is set once the server sent a range we can't use
+	noRanges bool
+
+	attempt int
+	backoff time.Duration
+	// err is why the last attempt failed
+	err error
+	// failure is set once we gave up
+	failure error
+
+	resp   *http.Response
+	body   *idleTimeoutReader
+	cancel context.CancelFunc
+}
+
+func (d *Downloader) newDownloadStream(ctx context.Context, urlStr string) *downloadStream {
+	return &downloadStream{
+		d:       d,
+		ctx:     ctx,
+		client:  d.httpClient(),
+		urlStr:  urlStr,
+		backoff: DownloadInitialBackoff,
+	}
+}
+
+func (s *downloadStream) Read(p []byte) (int, error) {
+	for {
+		if s.failure != nil {
+			return 0, s.failure
+		}
+
+		if s.body == nil {
+			if connectErr := s.reconnect(); connectErr != nil {
+				s.failure = connectErr
+				return 0, connectErr
+			}
+		}
+
+		n, readErr := s.body.Read(p)
+		s.offset += int64(n)
+		if readErr == nil || readErr == io.EOF {
+			return n, readErr
+		}
+
+		redactedURL := RedactURL(s.urlStr)
+		if s.body.timedOut() {
+			s.err = fmt.Errorf("download from %s stalled for more than %s", redactedURL, DownloadIdleTimeout)
+		} else {
+			s.err = fmt.Errorf("error downloading tarball from %s: %s", redactedURL, stripURLFromError(readErr))
+		}
+		s.disconnect()
+
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the connection to the server, if there is one
+func (s *downloadStream) Close() error {
+	s.disconnect()
+	return nil
+}
+
+// reconnect connects to the server, retrying with backoff until the server
+// sends the rest of the file
+func (s *downloadStream) reconnect() error {
+	logger := s.d.logger()
+
+	for {
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if s.err != nil {
+			permErr := &permanentDownloadError{}
+			if errors.As(s.err, &permErr) || s.attempt >= DownloadMaxAttempts {
+				return s.err
+			}
+
+			logger.Warnf("attempt %d/%d to download %s failed, retrying in %s: %s", s.attempt, DownloadMaxAttempts, RedactURL(s.urlStr), s.backoff, s.err)
+			if sleepErr := sleepContext(s.ctx, s.backoff); sleepErr != nil {
+				return sleepErr
+			}
+
+			s.backoff *= 2
+			if s.backoff > DownloadMaxBackoff {
+				s.backoff = DownloadMaxBackoff
+			}
+		}
+
+		s.attempt++
+		s.err = s.connect()
+		if s.err == nil {
+			return nil
+		}
+		s.disconnect()
+	}
+}
+
+// connect requests the file from the server, starting at offset
+func (s *downloadStream) connect() error {
+	logger := s.d.logger()
+	redactedURL := RedactURL(s.urlStr)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.cancel = cancel
+
+	rangeOffset := s.offset
+	if s.noRanges {
+		rangeOffset = 0
+	}
+	req, reqErr := s.d.newDownloadRequest(ctx, s.urlStr, rangeOffset)
+	if reqErr != nil {
+		return reqErr
+	}
+
+	resp, httpGetErr := s.client.Do(req)
+	if httpGetErr != nil {
+		return fmt.Errorf("error getting tarball from %s: %s", redactedURL, stripURLFromError(httpGetErr))
+	}
+	s.resp = resp
+	s.body = newIdleTimeoutReader(resp.Body, DownloadIdleTimeout, cancel)
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && rangeOffset > 0:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != rangeOffset {
+			s.noRanges = true
+			return fmt.Errorf("server sent an unexpected range (%q) while resuming at byte %d", resp.Header.Get("Content-Range"), rangeOffset)
+		}
+		logger.Debugf("resuming download of %s at byte %d", redactedURL, rangeOffset)
+	case resp.StatusCode == http.StatusOK:
+		if s.offset > 0 {
+			logger.Debugf("server does not support resuming downloads, skipping the first %d bytes of %s", s.offset, redactedURL)
+			if _, skipErr := io.CopyN(io.Discard, s.body, s.offset); skipErr != nil {
+				return fmt.Errorf("error downloading tarball from %s: %s", redactedURL, stripURLFromError(skipErr))
+			}
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		s.noRanges = true
+		return fmt.Errorf("server could not resume download at byte %d", rangeOffset)
+	default:
+		statusErr := fmt.Errorf("HTTP request failed with status code %d", resp.StatusCode)
+		if isRetryableStatus(resp.StatusCode) {
+			return statusErr
+		}
+		return &permanentDownloadError{statusErr}
+	}
+
+	return nil
+}
+
+func (s *downloadStream) disconnect() {
+	if s.body != nil {
+		s.body.stop()
+		s.body = nil
+	}
+	if s.resp != nil {
+		s.resp.Body.Close()
+		s.resp = nil
+	}
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
@@ -0,0 +1,258 @@
+package mongobin_test
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// countingFs counts the bytes read from and written to files, and records
+// the files that are created
+type countingFs struct {
+	afero.Fs
+
+	read    int64
+	written int64
+
+	mu      sync.Mutex
+	created []string
+}
+
+func (fs *countingFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *countingFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *countingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if flag&os.O_CREATE != 0 {
+		fs.mu.Lock()
+		fs.created = append(fs.created, name)
+		fs.mu.Unlock()
+	}
+	return &countingFile{File: file, fs: fs}, nil
+}
+
+func (fs *countingFs) createdIn(dir string) []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var created []string
+	for _, name := range fs.created {
+		if strings.HasPrefix(name, dir+"/") {
+			created = append(created, name)
+		}
+	}
+	return created
+}
+
+type countingFile struct {
+	afero.File
+	fs *countingFs
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	atomic.AddInt64(&f.fs.read, int64(n))
+	return n, err
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(p, off)
+	atomic.AddInt64(&f.fs.read, int64(n))
+	return n, err
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	atomic.AddInt64(&f.fs.written, int64(n))
+	return n, err
+}
+
+func (f *countingFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	atomic.AddInt64(&f.fs.written, int64(n))
+	return n, err
+}
+
+func (f *countingFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func TestDownloadIsExtractedWhileStreaming(t *testing.T) {
+	files := map[string]string{
+		"mongodb/README":     "readme",
+		"mongodb/bin/mongos": "mongos",
+		"mongodb/bin/mongod": "mongod",
+	}
+
+	tests := map[string]struct {
+		archive []byte
+
+		expectSaved bool
+	}{
+		"tar.gz": {
+			archive: makeTarball(t, files),
+		},
+		"tar.xz": {
+			archive: makeTarXz(t, files),
+		},
+		"tar": {
+			archive: makeTar(t, files),
+		},
+		"zip": {
+			archive: makeZip(t, files),
+
+			// Zips are saved to disk first, since they can't be read as a
+			// stream
+			expectSaved: true,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			fs := &countingFs{Fs: afero.NewMemMapFs()}
+			mongobin.Afs = afero.Afero{Fs: fs}
+
+			server, requests := countingServer(t, test.archive)
+			downloader := &mongobin.Downloader{
+				CachePath: "/cache",
+				Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+			}
+
+			binPath, err := downloader.GetOrDownloadMongod(server.URL + "/mongodb.tgz")
+			require.NoError(t, err)
+			assert.Equal(t, int32(1), *requests)
+
+			content, err := mongobin.Afs.ReadFile(binPath)
+			require.NoError(t, err)
+			assert.Equal(t, "mongod", string(content))
+
+			// The checksum covers the whole archive, even though reading it
+			// stopped once the binaries were found
+			metadata := readMetadata(t, path.Dir(binPath))
+			assert.Equal(t, sha256Hex(test.archive), metadata.ArchiveSHA256)
+
+			// The binaries are extracted to a staging directory, but the
+			// archive itself is only saved if it's a zip
+			var saved []string
+			for _, name := range fs.createdIn("/cache/.partial") {
+				if !strings.Contains(name, ".staging/") {
+					saved = append(saved, name)
+				}
+			}
+			if test.expectSaved {
+				assert.Len(t, saved, 1)
+			} else {
+				assert.Empty(t, saved)
+			}
+
+			partials, err := mongobin.Afs.ReadDir("/cache/.partial")
+			require.NoError(t, err)
+			assert.Empty(t, partials)
+		})
+	}
+}
+
+func TestDownloadResumesPartialDownloadFromEarlierAttempt(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	mongodContent := string(bytes.Repeat([]byte("mongod"), 100000))
+	server := &flakyServer{
+		content:       makeTarball(t, map[string]string{"mongodb/bin/mongod": mongodContent}),
+		supportRanges: true,
+	}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	// An earlier process was interrupted half way through the download
+	urlStr := httpServer.URL + "/mongodb.tgz"
+	partialPath := "/cache/.partial/mongodb_tgz_" + sha256Hex([]byte(urlStr))[0:10] + ".partial"
+	require.NoError(t, mongobin.Afs.WriteFile(partialPath, server.content[:len(server.content)/2], 0644))
+
+	downloader := &mongobin.Downloader{
+		CachePath: "/cache",
+		Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+	}
+	binPath, err := downloader.GetOrDownloadMongod(urlStr)
+	require.NoError(t, err)
+
+	content, err := mongobin.Afs.ReadFile(binPath)
+	require.NoError(t, err)
+	assert.Equal(t, mongodContent, string(content))
+
+	requests, rangeRequests := server.requestLog()
+	require.Equal(t, 1, requests)
+	assert.Equal(t, "bytes="+strconv.Itoa(len(server.content)/2)+"-", rangeRequests[0])
+
+	exists, err := mongobin.Afs.Exists(partialPath)
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+// BenchmarkDownload reports how many bytes are read from and written to disk
+// to download and extract an archive, when it's extracted while streaming,
+// and when it's saved to disk first, with ResumableDownloads
+func BenchmarkDownload(b *testing.B) {
+	random := rand.New(rand.NewSource(1))
+	mongod := make([]byte, 8<<20)
+	_, _ = random.Read(mongod)
+	mongos := make([]byte, 4<<20)
+	_, _ = random.Read(mongos)
+
+	archive := makeTarball(b, map[string]string{
+		"mongodb/bin/mongod": string(mongod),
+		"mongodb/bin/mongos": string(mongos),
+	})
+	server := httptest.NewServer(&flakyServer{content: archive, supportRanges: true})
+	defer server.Close()
+	urlStr := server.URL + "/mongodb.tgz"
+
+	benchmarks := map[string]bool{
+		"streamed":  false,
+		"resumable": true,
+	}
+
+	for name, resumable := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			var read, written int64
+			for i := 0; i < b.N; i++ {
+				fs := &countingFs{Fs: afero.NewMemMapFs()}
+				mongobin.Afs = afero.Afero{Fs: fs}
+
+				downloader := &mongobin.Downloader{
+					CachePath:          "/cache",
+					Logger:             memongolog.New(nil, memongolog.LogLevelSilent),
+					ResumableDownloads: resumable,
+				}
+				_, err := downloader.GetOrDownloadMongod(urlStr)
+				require.NoError(b, err)
+
+				read += atomic.LoadInt64(&fs.read)
+				written += atomic.LoadInt64(&fs.written)
+			}
+
+			b.ReportMetric(float64(read)/float64(b.N), "disk-read-B/op")
+			b.ReportMetric(float64(written)/float64(b.N), "disk-written-B/op")
+		})
+	}
+}
@@ -1,14 +1,68 @@
 package mongobin
 
-import "fmt"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultDownloadBaseURL is where official MongoDB archives are downloaded
+// from when no mirror is configured
+const DefaultDownloadBaseURL = "https://fastdl.mongodb.org"
+
+// DefaultEnterpriseDownloadBaseURL is where official MongoDB Enterprise
+// archives are downloaded from when no mirror is configured
+const DefaultEnterpriseDownloadBaseURL = "https://downloads.mongodb.com"
 
 // GetDownloadURL returns the download URL to download the binary
 // from the MongoDB website
 func (spec *DownloadSpec) GetDownloadURL() string {
+	if spec.Edition == Enterprise {
+		return spec.downloadURLFromBase(DefaultEnterpriseDownloadBaseURL)
+	}
+	return spec.downloadURLFromBase(DefaultDownloadBaseURL)
+}
+
+// GetMirrorDownloadURLs returns the URLs to download the binary from each of
+// the given mirrors, in order. A mirror is either a base URL that mirrors the
+// layout of fastdl.mongodb.org (e.g. https://mirror.example.com/mongodb), or
+// a URL template (see ExpandURLTemplate).
+func (spec *DownloadSpec) GetMirrorDownloadURLs(mirrors []string) ([]string, error) {
+	urls := make([]string, 0, len(mirrors))
+	for _, mirror := range mirrors {
+		if strings.Contains(mirror, "{") {
+			urlStr, err := spec.ExpandURLTemplate(mirror)
+			if err != nil {
+				return nil, err
+			}
+			urls = append(urls, urlStr)
+		} else {
+			urls = append(urls, spec.downloadURLFromBase(mirror))
+		}
+	}
+
+	return urls, nil
+}
+
+func (spec *DownloadSpec) downloadURLFromBase(baseURL string) string {
+	return fmt.Sprintf(
+		"%s/%s/%s",
+		strings.TrimSuffix(baseURL, "/"),
+		spec.Platform,
+		spec.archiveName(),
+	)
+}
+
+func (spec *DownloadSpec) archiveName() string {
 	archiveName := "mongodb-"
 
+	edition := ""
+	if spec.Edition == Enterprise {
+		edition = "enterprise-"
+	}
+
 	if spec.Platform == "linux" {
-		archiveName += "linux-" + spec.Arch + "-"
+		archiveName += "linux-" + spec.Arch + "-" + edition
 
 		if spec.OSName != "" {
 			archiveName += spec.OSName + "-"
@@ -16,18 +70,69 @@ func (spec *DownloadSpec) GetDownloadURL() string {
 
 		archiveName += spec.Version + ".tgz"
 	} else {
-		if spec.SSLBuildNeeded {
+		// Enterprise builds always had SSL, but the old ones still have the
+		// osx name
+		if spec.SSLBuildNeeded && edition != "" {
+			archiveName += "osx-"
+		} else if spec.SSLBuildNeeded {
 			archiveName += "osx-ssl-"
 		} else {
 			archiveName += "macos-"
 		}
 
-		archiveName += spec.Arch + "-" + spec.Version + ".tgz"
+		archiveName += spec.Arch + "-" + edition + spec.Version + ".tgz"
 	}
 
-	return fmt.Sprintf(
-		"https://fastdl.mongodb.org/%s/%s",
-		spec.Platform,
-		archiveName,
-	)
+	return archiveName
+}
+
+var urlTemplatePlaceholderRegex = regexp.MustCompile(`{([^{}]*)}`)
+
+// ExpandURLTemplate fills in the placeholders of a download URL template,
+// like https://mirror.example.com/mongo/{version}/{platform}-{arch}-{os}.tgz.
+// The supported placeholders are:
+// - {version}: the Version, e.g. 6.0.4
+// - {platform}: the Platform, e.g. linux
+// - {arch}: the Arch, e.g. x86_64
+// - {os}: the OSName, e.g. ubuntu2204
+// - {ssl}: "ssl" if SSLBuildNeeded, "" otherwise
+// - {edition}: "enterprise" for Enterprise, "" otherwise
+// - {archive}: the name of the official archive, e.g. mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz
+//
+// Any other placeholder is an error.
+func (spec *DownloadSpec) ExpandURLTemplate(template string) (string, error) {
+	ssl := ""
+	if spec.SSLBuildNeeded {
+		ssl = "ssl"
+	}
+
+	values := map[string]string{
+		"version":  spec.Version,
+		"platform": spec.Platform,
+		"arch":     spec.Arch,
+		"os":       spec.OSName,
+		"ssl":      ssl,
+		"edition":  string(spec.Edition),
+		"archive":  spec.archiveName(),
+	}
+
+	var unknown []string
+	expanded := urlTemplatePlaceholderRegex.ReplaceAllStringFunc(template, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value, ok := values[name]
+		if !ok {
+			unknown = append(unknown, placeholder)
+		}
+		return value
+	})
+
+	if len(unknown) > 0 {
+		return "", fmt.Errorf("unknown placeholder(s) %s in download URL template %q", strings.Join(unknown, ", "), template)
+	}
+
+	if strings.ContainsAny(expanded, "{}") {
+		return "", fmt.Errorf("unbalanced braces in download URL template %q", template)
+	}
+
+	return expanded, nil
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tryvium-travels/memongo/mongobin"
 )
 
@@ -267,3 +268,103 @@ func TestGetDownloadURL(t *testing.T) {
 		}
 	}
 }
+
+func TestGetEnterpriseDownloadURL(t *testing.T) {
+	tests := map[string]struct {
+		spec *mongobin.DownloadSpec
+
+		expectedURL string
+	}{
+		"Linux": {
+			spec:        &mongobin.DownloadSpec{Version: "7.0.2", Platform: "linux", Arch: "x86_64", OSName: "ubuntu2204"},
+			expectedURL: "https://downloads.mongodb.com/linux/mongodb-linux-x86_64-enterprise-ubuntu2204-7.0.2.tgz",
+		},
+		"Linux arm64": {
+			spec:        &mongobin.DownloadSpec{Version: "7.0.2", Platform: "linux", Arch: "aarch64", OSName: "rhel82"},
+			expectedURL: "https://downloads.mongodb.com/linux/mongodb-linux-aarch64-enterprise-rhel82-7.0.2.tgz",
+		},
+		"mac": {
+			spec:        &mongobin.DownloadSpec{Version: "6.0.4", Platform: "osx", Arch: "arm64"},
+			expectedURL: "https://downloads.mongodb.com/osx/mongodb-macos-arm64-enterprise-6.0.4.tgz",
+		},
+		"Older mac": {
+			spec:        &mongobin.DownloadSpec{Version: "4.0.5", Platform: "osx", Arch: "x86_64", SSLBuildNeeded: true},
+			expectedURL: "https://downloads.mongodb.com/osx/mongodb-osx-x86_64-enterprise-4.0.5.tgz",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			test.spec.Edition = mongobin.Enterprise
+			assert.Equal(t, test.expectedURL, test.spec.GetDownloadURL())
+		})
+	}
+}
+
+func TestGetMirrorDownloadURLs(t *testing.T) {
+	spec := &mongobin.DownloadSpec{
+		Version:  "6.0.4",
+		Platform: "linux",
+		Arch:     "x86_64",
+		OSName:   "ubuntu2204",
+	}
+
+	urls, err := spec.GetMirrorDownloadURLs([]string{
+		"https://mirror.example.com/mongodb/",
+		"https://mirror.example.com/mongo/{version}/{platform}-{arch}-{os}.tgz",
+		"https://other.example.com/{archive}",
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"https://mirror.example.com/mongodb/linux/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+		"https://mirror.example.com/mongo/6.0.4/linux-x86_64-ubuntu2204.tgz",
+		"https://other.example.com/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+	}, urls)
+}
+
+func TestExpandURLTemplate(t *testing.T) {
+	spec := &mongobin.DownloadSpec{
+		Version:        "4.0.5",
+		Platform:       "osx",
+		Arch:           "x86_64",
+		SSLBuildNeeded: true,
+	}
+
+	tests := map[string]struct {
+		template string
+
+		expectedURL   string
+		expectedError string
+	}{
+		"all placeholders": {
+			template:    "https://mirror/{platform}/{arch}/{os}/{ssl}/{edition}/{version}/{archive}",
+			expectedURL: "https://mirror/osx/x86_64//ssl//4.0.5/mongodb-osx-ssl-x86_64-4.0.5.tgz",
+		},
+		"no placeholders": {
+			template:    "https://mirror/mongodb.tgz",
+			expectedURL: "https://mirror/mongodb.tgz",
+		},
+		"unknown placeholder": {
+			template:      "https://mirror/{version}/{distro}-{flavor}.tgz",
+			expectedError: `unknown placeholder(s) {distro}, {flavor} in download URL template "https://mirror/{version}/{distro}-{flavor}.tgz"`,
+		},
+		"unbalanced braces": {
+			template:      "https://mirror/{version.tgz",
+			expectedError: `unbalanced braces in download URL template "https://mirror/{version.tgz"`,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			urlStr, err := spec.ExpandURLTemplate(test.template)
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedURL, urlStr)
+		})
+	}
+}
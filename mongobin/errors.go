@@ -1,5 +1,7 @@
 package mongobin
 
+import "strings"
+
 // UnsupportedSystemError is used to indicate that memongo does not support
 // automatic selection of the right MongoDB binary for your system
 type UnsupportedSystemError struct {
@@ -20,3 +22,30 @@ type UnsupportedMongoVersionError struct {
 func (err *UnsupportedMongoVersionError) Error() string {
 	return "memongo does not support MongoDB version \"" + err.version + "\": " + err.msg
 }
+
+// MissingSharedLibraryError is used to indicate that a downloaded binary
+// can't run because shared libraries it needs are missing, or too old (e.g.
+// glibc)
+type MissingSharedLibraryError struct {
+	// Binary is the path to the binary
+	Binary string
+
+	// Libraries are the libraries the dynamic loader couldn't find, e.g.
+	// libcrypto.so.1.1. A library that's too old is followed by the version
+	// that's needed, e.g. "libc.so.6 (GLIBC_2.34)".
+	Libraries []string
+
+	// OSName is the OS build of MongoDB that was downloaded, e.g. ubuntu2204.
+	// It's empty for macOS and generic Linux builds.
+	OSName string
+}
+
+func (err *MissingSharedLibraryError) Error() string {
+	binary := err.Binary
+	if err.OSName != "" {
+		binary += " (from the " + err.OSName + " build of MongoDB)"
+	}
+
+	return binary + " can't run because these shared libraries are missing or too old: " +
+		strings.Join(err.Libraries, ", ") + ". Install them, or download a build for a different OS."
+}
@@ -0,0 +1,163 @@
+package mongobin
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/spf13/afero"
+	"github.com/ulikunitz/xz"
+)
+
+// archiveFormat is the container/compression format of a MongoDB archive
+type archiveFormat string
+
+const (
+	archiveFormatTarGz archiveFormat = "tar.gz"
+	archiveFormatTarXz archiveFormat = "tar.xz"
+	archiveFormatTar   archiveFormat = "tar"
+	archiveFormatZip   archiveFormat = "zip"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zipMagic  = []byte{'P', 'K', 0x03, 0x04}
+	// An empty zip file starts with the end of central directory record
+	emptyZipMagic = []byte{'P', 'K', 0x05, 0x06}
+	tarMagic      = []byte("ustar")
+)
+
+// tarMagicOffset is where the "ustar" magic is in a tar header
+const tarMagicOffset = 257
+
+// detectArchiveFormat detects the format of an archive from its first bytes.
+// We look at the contents rather than the file name because download URLs
+// often don't have a meaningful extension.
+func detectArchiveFormat(header []byte) (archiveFormat, error) {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return archiveFormatTarGz, nil
+	case bytes.HasPrefix(header, xzMagic):
+		return archiveFormatTarXz, nil
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, emptyZipMagic):
+		return archiveFormatZip, nil
+	case len(header) >= tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic):
+		return archiveFormatTar, nil
+	default:
+		return "", errors.New("unrecognized archive format, expected a zip, tar, tar.gz or tar.xz archive")
+	}
+}
+
+// walkArchive calls fn with the name and contents of each regular file in the
+// archive, until fn returns false or an error
+func walkArchive(archive afero.File, fn func(name string, contents io.Reader) (bool, error)) error {
+	header := make([]byte, tarMagicOffset+len(tarMagic))
+	n, readErr := io.ReadFull(archive, header)
+	if readErr != nil && readErr != io.ErrUnexpectedEOF {
+		return fmt.Errorf("error reading archive header: %s", readErr)
+	}
+
+	format, formatErr := detectArchiveFormat(header[:n])
+	if formatErr != nil {
+		return formatErr
+	}
+
+	_, seekErr := archive.Seek(0, io.SeekStart)
+	if seekErr != nil {
+		return fmt.Errorf("error seeking back to start of file: %s", seekErr)
+	}
+
+	if format == archiveFormatZip {
+		return walkZip(archive, fn)
+	}
+	return walkTarStream(archive, format, fn)
+}
+
+// walkTarStream is like walkArchive, but reads a tar archive in the given
+// format as a stream, so it doesn't need to be saved to a file first. Zips
+// can't be read this way, since their index is at the end.
+func walkTarStream(r io.Reader, format archiveFormat, fn func(name string, contents io.Reader) (bool, error)) error {
+	switch format {
+	case archiveFormatTarGz:
+		gzReader, gzErr := gzip.NewReader(r)
+		if gzErr != nil {
+			return fmt.Errorf("error initializing gzip reader: %w", gzErr)
+		}
+		defer gzReader.Close()
+
+		return walkTar(gzReader, fn)
+	case archiveFormatTarXz:
+		xzReader, xzErr := xz.NewReader(r)
+		if xzErr != nil {
+			return fmt.Errorf("error initializing xz reader: %w", xzErr)
+		}
+
+		return walkTar(xzReader, fn)
+	case archiveFormatTar:
+		return walkTar(r, fn)
+	default:
+		return fmt.Errorf("%s archives can't be read as a stream", format)
+	}
+}
+
+func walkTar(r io.Reader, fn func(name string, contents io.Reader) (bool, error)) error {
+	tarReader := tar.NewReader(r)
+	for {
+		nextFile, tarErr := tarReader.Next()
+		if tarErr == io.EOF {
+			return nil
+		}
+		if tarErr != nil {
+			return fmt.Errorf("error reading from tar: %s", tarErr)
+		}
+
+		if nextFile.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		more, err := fn(nextFile.Name, tarReader)
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+func walkZip(archive afero.File, fn func(name string, contents io.Reader) (bool, error)) error {
+	info, statErr := archive.Stat()
+	if statErr != nil {
+		return fmt.Errorf("error getting size of zip: %s", statErr)
+	}
+
+	zipReader, zipErr := zip.NewReader(archive, info.Size())
+	if zipErr != nil {
+		return fmt.Errorf("error reading zip: %s", zipErr)
+	}
+
+	for _, file := range zipReader.File {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+
+		more, err := walkZipFile(file, fn)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func walkZipFile(file *zip.File, fn func(name string, contents io.Reader) (bool, error)) (bool, error) {
+	contents, openErr := file.Open()
+	if openErr != nil {
+		return false, fmt.Errorf("error reading %s from zip: %s", file.Name, openErr)
+	}
+	defer contents.Close()
+
+	return fn(file.Name, contents)
+}
@@ -0,0 +1,130 @@
+package mongobin_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+	"github.com/ulikunitz/xz"
+)
+
+// makeTar builds an uncompressed tar holding the given files, keyed by path
+func makeTar(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+
+	for name, content := range files {
+		require.NoError(t, tarWriter.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0755,
+			Size: int64(len(content)),
+		}))
+		_, err := tarWriter.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tarWriter.Close())
+
+	return buf.Bytes()
+}
+
+// makeTarXz builds a .tar.xz holding the given files, keyed by path
+func makeTarXz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	xzWriter, err := xz.NewWriter(&buf)
+	require.NoError(t, err)
+
+	_, err = xzWriter.Write(makeTar(t, files))
+	require.NoError(t, err)
+	require.NoError(t, xzWriter.Close())
+
+	return buf.Bytes()
+}
+
+// makeZip builds a .zip holding the given files, keyed by path
+func makeZip(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+
+	for name, content := range files {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		header.SetMode(0755)
+		fileWriter, err := zipWriter.CreateHeader(header)
+		require.NoError(t, err)
+		_, err = fileWriter.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, zipWriter.Close())
+
+	return buf.Bytes()
+}
+
+func TestGetOrDownloadArchiveFormats(t *testing.T) {
+	files := map[string]string{
+		"mongodb/README":     "readme",
+		"mongodb/bin/mongos": "mongos",
+		"mongodb/bin/mongod": "mongod",
+	}
+
+	tests := map[string]struct {
+		archive []byte
+
+		expectedError string
+	}{
+		"tar.gz": {
+			archive: makeTarball(t, files),
+		},
+		"tar.xz": {
+			archive: makeTarXz(t, files),
+		},
+		"tar": {
+			archive: makeTar(t, files),
+		},
+		"zip": {
+			archive: makeZip(t, files),
+		},
+		"no mongod": {
+			archive: makeZip(t, map[string]string{"mongodb/bin/mongos": "mongos"}),
+
+			expectedError: "did not find a mongod binary in the archive from /archives/mongodb.tgz",
+		},
+		"not an archive": {
+			archive: []byte("<html>Please log in</html>"),
+
+			expectedError: "error extracting binaries from /archives/mongodb.tgz: unrecognized archive format, expected a zip, tar, tar.gz or tar.xz archive",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			// The archive is always named .tgz; the format is detected from its
+			// contents
+			require.NoError(t, mongobin.Afs.WriteFile("/archives/mongodb.tgz", test.archive, 0644))
+
+			downloader := &mongobin.Downloader{
+				CachePath: "/cache",
+				Logger:    memongolog.New(nil, memongolog.LogLevelDebug),
+			}
+
+			path, err := downloader.GetOrDownloadMongod("/archives/mongodb.tgz")
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			content, err := mongobin.Afs.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, "mongod", string(content))
+		})
+	}
+}
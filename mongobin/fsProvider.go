@@ -0,0 +1,233 @@
+package mongobin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// FSProvider is a BinaryProvider for a mongod shipped in an fs.FS, e.g. one
+// embedded in a test binary with go:embed, so no download is needed. The
+// file may be mongod itself, or an archive holding it. Either way, it's
+// extracted into the cache once, in an entry keyed by its checksum, since
+// binaries can only be run from a real file.
+type FSProvider struct {
+	// Downloader's CachePath, Logger and VerifyChecksums are used
+	Downloader *Downloader
+
+	// FS holds the binary
+	FS fs.FS
+
+	// Path of the binary, or of the archive holding it, in FS. Defaults to
+	// mongod.
+	Path string
+}
+
+// Resolve extracts the binary into the cache, unless it's already there
+func (p *FSProvider) Resolve(ctx context.Context, version string) (*BinaryPaths, error) {
+	fsPath := p.path()
+
+	sha, hashErr := hashFSFile(p.FS, fsPath)
+	if hashErr != nil {
+		return nil, hashErr
+	}
+
+	dirname := fmt.Sprintf("%s_%s", sanitizeFilename(path.Base(fsPath)), sha[0:10])
+	dirPath := path.Join(p.Downloader.CachePath, dirname)
+	paths := map[string]string{"mongod": path.Join(dirPath, "mongod")}
+
+	missing, verifyErr := p.Downloader.verifyCacheEntry(dirPath, paths, false)
+	corruptErr := &CorruptCacheEntryError{}
+	if verifyErr != nil && !errors.As(verifyErr, &corruptErr) {
+		return nil, fmt.Errorf("error while checking for mongod in cache: %s", verifyErr)
+	}
+	if verifyErr == nil && len(missing) == 0 {
+		p.Downloader.logger().Debugf("mongod from %s exists in cache at %s", fsPath, dirPath)
+		if touchErr := touchCacheEntry(dirPath); touchErr != nil {
+			p.Downloader.logger().Debugf("error recording use of cache entry %s: %s", dirPath, touchErr)
+		}
+	} else if extractErr := p.lockAndExtract(ctx, dirname, sha, paths); extractErr != nil {
+		return nil, extractErr
+	}
+
+	cache := &Cache{
+		Path:   p.Downloader.CachePath,
+		Logger: p.Downloader.Logger,
+	}
+	marker, markErr := cache.MarkInUse(paths["mongod"])
+	if markErr != nil {
+		return nil, fmt.Errorf("error marking %s as in use: %s", paths["mongod"], markErr)
+	}
+
+	return &BinaryPaths{Mongod: paths["mongod"], Release: marker.Release}, nil
+}
+
+// lockAndExtract extracts the binary into the cache entry named dirname,
+// while holding the lock on that cache entry
+func (p *FSProvider) lockAndExtract(ctx context.Context, dirname string, sha string, paths map[string]string) error {
+	logger := p.Downloader.logger()
+	cachePath := p.Downloader.CachePath
+	dirPath := path.Join(cachePath, dirname)
+	fsPath := p.path()
+
+	lock, lockErr := acquireFileLock(ctx, path.Join(cachePath, lockDirName, dirname+".lock"), logger)
+	if lockErr != nil {
+		return lockErr
+	}
+	defer func() {
+		if releaseErr := lock.release(); releaseErr != nil {
+			logger.Warnf("error releasing lock: %s", releaseErr)
+		}
+	}()
+
+	// Another process may have extracted the binary while we were waiting
+	// for the lock
+	missing, verifyErr := p.Downloader.verifyCacheEntry(dirPath, paths, true)
+	corruptErr := &CorruptCacheEntryError{}
+	if verifyErr != nil && !errors.As(verifyErr, &corruptErr) {
+		return fmt.Errorf("error while checking for mongod in cache: %s", verifyErr)
+	}
+	if verifyErr == nil && len(missing) == 0 {
+		return nil
+	}
+	if verifyErr != nil {
+		quarantinePath, quarantineErr := quarantineCacheEntry(cachePath, dirname)
+		if quarantineErr != nil {
+			return quarantineErr
+		}
+		logger.Warnf("%s; moved the cache entry to %s and extracting it again", verifyErr, quarantinePath)
+	}
+
+	logger.Infof("extracting mongod from %s to %s", fsPath, dirPath)
+
+	binMetadata, extractErr := p.extract(dirname, paths["mongod"])
+	if extractErr != nil {
+		return fmt.Errorf("error extracting mongod from %s: %w", fsPath, extractErr)
+	}
+
+	version, checkErr := p.Downloader.checkBinary(ctx, paths["mongod"], "")
+	if checkErr != nil {
+		_ = Afs.Remove(paths["mongod"])
+		return checkErr
+	}
+
+	metadata := &CacheMetadata{
+		SourceURL:     fsPath,
+		ArchiveSHA256: sha,
+		Version:       version,
+		Binaries:      map[string]BinaryMetadata{"mongod": binMetadata},
+		ExtractedAt:   time.Now(),
+	}
+	metadata.LastUsedAt = metadata.ExtractedAt
+
+	return writeCacheMetadata(dirPath, metadata)
+}
+
+// extract writes mongod to mongodPath: the file itself, or the mongod in
+// it if it's an archive
+func (p *FSProvider) extract(dirname string, mongodPath string) (BinaryMetadata, error) {
+	logger := p.Downloader.logger()
+
+	file, openErr := p.FS.Open(p.path())
+	if openErr != nil {
+		return BinaryMetadata{}, openErr
+	}
+	defer file.Close()
+
+	header := make([]byte, tarMagicOffset+len(tarMagic))
+	n, readErr := io.ReadFull(file, header)
+	if readErr != nil && readErr != io.ErrUnexpectedEOF && readErr != io.EOF {
+		return BinaryMetadata{}, readErr
+	}
+	header = header[:n]
+	contents := io.MultiReader(bytes.NewReader(header), file)
+
+	format, formatErr := detectArchiveFormat(header)
+	if formatErr != nil {
+		// Not an archive, so it's mongod itself
+		return saveFile(mongodPath, contents, logger)
+	}
+
+	var binMetadata *BinaryMetadata
+	saveMongod := func(name string, contents io.Reader) (bool, error) {
+		if path.Base(name) != "mongod" {
+			return true, nil
+		}
+
+		extracted, saveErr := saveFile(mongodPath, contents, logger)
+		if saveErr != nil {
+			return false, saveErr
+		}
+		binMetadata = &extracted
+		return false, nil
+	}
+
+	walkErr := p.walkArchive(dirname, format, contents, saveMongod)
+	if walkErr != nil {
+		return BinaryMetadata{}, walkErr
+	}
+	if binMetadata == nil {
+		return BinaryMetadata{}, errors.New("did not find a mongod binary in the archive")
+	}
+
+	return *binMetadata, nil
+}
+
+// walkArchive walks the archive in contents. Tarballs are read as a stream,
+// but zips need to be read at random, so they're copied into the cache
+// first.
+func (p *FSProvider) walkArchive(dirname string, format archiveFormat, contents io.Reader, fn func(name string, contents io.Reader) (bool, error)) error {
+	if format != archiveFormatZip {
+		return walkTarStream(contents, format, fn)
+	}
+
+	archivePath := path.Join(p.Downloader.CachePath, partialDirName, dirname+".partial")
+	if mkdirErr := Afs.MkdirAll(path.Dir(archivePath), 0755); mkdirErr != nil {
+		return fmt.Errorf("error creating directory %s: %s", path.Dir(archivePath), mkdirErr)
+	}
+	defer func() {
+		_ = Afs.Remove(archivePath)
+	}()
+	if writeErr := Afs.WriteReader(archivePath, contents); writeErr != nil {
+		return fmt.Errorf("error copying archive to %s: %s", archivePath, writeErr)
+	}
+
+	archiveFile, archiveErr := Afs.Open(archivePath)
+	if archiveErr != nil {
+		return archiveErr
+	}
+	defer archiveFile.Close()
+
+	return walkArchive(archiveFile, fn)
+}
+
+func (p *FSProvider) path() string {
+	if p.Path == "" {
+		return "mongod"
+	}
+	return strings.TrimPrefix(p.Path, "/")
+}
+
+// hashFSFile returns the SHA-256 checksum of a file in fsys
+func hashFSFile(fsys fs.FS, name string) (string, error) {
+	file, openErr := fsys.Open(name)
+	if openErr != nil {
+		return "", fmt.Errorf("error opening %s: %s", name, openErr)
+	}
+	defer file.Close()
+
+	shasum := sha256.New()
+	if _, copyErr := io.Copy(shasum, file); copyErr != nil {
+		return "", fmt.Errorf("error reading %s: %s", name, copyErr)
+	}
+
+	return hex.EncodeToString(shasum.Sum(nil)), nil
+}
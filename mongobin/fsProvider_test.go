@@ -0,0 +1,113 @@
+package mongobin_test
+
+import (
+	"context"
+	"testing"
+	"testing/fstest"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+func TestFSProvider(t *testing.T) {
+	fsys := fstest.MapFS{
+		"mongod":                  {Data: []byte("mongod")},
+		"testdata/mongodb.tgz":    {Data: makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod from tarball"})},
+		"testdata/no-mongod.tgz":  {Data: makeTarball(t, map[string]string{"mongodb/bin/mongos": "mongos"})},
+		"testdata/bin/not-mongod": {Data: []byte("something else")},
+	}
+
+	tests := map[string]struct {
+		path string
+
+		expectedContents string
+		expectedError    string
+	}{
+		"default path": {
+			expectedContents: "mongod",
+		},
+		"tarball": {
+			path:             "/testdata/mongodb.tgz",
+			expectedContents: "mongod from tarball",
+		},
+		"tarball without mongod": {
+			path:          "testdata/no-mongod.tgz",
+			expectedError: "error extracting mongod from testdata/no-mongod.tgz: did not find a mongod binary in the archive",
+		},
+		"missing file": {
+			path:          "testdata/missing",
+			expectedError: "error opening testdata/missing: open testdata/missing: file does not exist",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			provider := &mongobin.FSProvider{
+				Downloader: &mongobin.Downloader{
+					CachePath: "/cache",
+					Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+				},
+				FS:   fsys,
+				Path: test.path,
+			}
+
+			paths, err := provider.Resolve(context.Background(), "6.0.4")
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			defer paths.Release()
+
+			contents, err := mongobin.Afs.ReadFile(paths.Mongod)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedContents, string(contents))
+
+			info, err := mongobin.Afs.Stat(paths.Mongod)
+			require.NoError(t, err)
+			assert.NotZero(t, info.Mode()&0100, "mongod should be executable")
+		})
+	}
+}
+
+func TestFSProviderCache(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	fsys := fstest.MapFS{"mongod": {Data: []byte("mongod")}}
+	provider := &mongobin.FSProvider{
+		Downloader: &mongobin.Downloader{
+			CachePath: "/cache",
+			Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+		},
+		FS: fsys,
+	}
+
+	paths, err := provider.Resolve(context.Background(), "6.0.4")
+	require.NoError(t, err)
+	require.NoError(t, paths.Release())
+
+	// The cached binary is reused, but not once the binary in the FS changes
+	again, err := provider.Resolve(context.Background(), "6.0.4")
+	require.NoError(t, err)
+	require.NoError(t, again.Release())
+	assert.Equal(t, paths.Mongod, again.Mongod)
+
+	fsys["mongod"] = &fstest.MapFile{Data: []byte("a newer mongod")}
+	changed, err := provider.Resolve(context.Background(), "6.0.4")
+	require.NoError(t, err)
+	require.NoError(t, changed.Release())
+	assert.NotEqual(t, paths.Mongod, changed.Mongod)
+
+	contents, err := mongobin.Afs.ReadFile(changed.Mongod)
+	require.NoError(t, err)
+	assert.Equal(t, "a newer mongod", string(contents))
+
+	entries, err := newTestCache().List()
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -1,8 +1,8 @@
 package mongobin
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
@@ -12,164 +12,875 @@ import (
 	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/afero"
 	"github.com/tryvium-travels/memongo/memongolog"
+	"golang.org/x/sync/singleflight"
 )
 
 var Afs afero.Afero
 
+// DefaultExtractBinaries are the binaries extracted from an archive by
+// default
+var DefaultExtractBinaries = []string{"mongod", "mongos"}
+
+// downloadGroup deduplicates concurrent downloads of the same cache entry
+// within this process
+var downloadGroup singleflight.Group
+
+// sharedDownloads holds the context of each download in downloadGroup, which
+// is only cancelled once every caller waiting for the download gave up
+var (
+	sharedDownloadsMu sync.Mutex
+	sharedDownloads   = map[string]*sharedDownload{}
+)
+
+type sharedDownload struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// joinSharedDownload returns the context to run the download with the given
+// key with, and a function to call once the caller stops waiting for it
+func joinSharedDownload(key string) (context.Context, func()) {
+	sharedDownloadsMu.Lock()
+	defer sharedDownloadsMu.Unlock()
+
+	download, ok := sharedDownloads[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		download = &sharedDownload{ctx: ctx, cancel: cancel}
+		sharedDownloads[key] = download
+	}
+	download.waiters++
+
+	return download.ctx, func() {
+		sharedDownloadsMu.Lock()
+		defer sharedDownloadsMu.Unlock()
+
+		download.waiters--
+		if download.waiters == 0 {
+			download.cancel()
+			delete(sharedDownloads, key)
+		}
+	}
+}
+
+// partialDirName is the directory in the cache where in-progress downloads
+// are kept
+const partialDirName = ".partial"
+
 func init() {
 	Afs = afero.Afero{
 		Fs: afero.NewOsFs(),
 	}
 }
 
+// Downloader downloads MongoDB archives and extracts them into a cache
+type Downloader struct {
+	// CachePath is the directory downloaded binaries are extracted to
+	CachePath string
+
+	// Logger for printing messages. Defaults to a logger at the default
+	// level.
+	Logger *memongolog.Logger
+
+	// HTTPClient is used to download archives. Defaults to a client that
+	// uses DownloadConnectTimeout. DownloadIdleTimeout is enforced for any
+	// client.
+	HTTPClient *http.Client
+
+	// Headers are added to download requests, e.g. to authenticate with an
+	// artifact store. They're never sent to MongoDB's download servers.
+	Headers http.Header
+
+	// HeaderHosts are the hosts Headers are sent to. Defaults to every host
+	// but MongoDB's.
+	HeaderHosts []string
+
+	// ExtractBinaries are the binaries extracted from an archive when it's
+	// downloaded, in addition to the ones that were asked for. Defaults to
+	// DefaultExtractBinaries.
+	ExtractBinaries []string
+
+	// VerifyChecksums makes the Downloader check the SHA-256 checksum of
+	// cached binaries against the cache metadata before using them. Their
+	// size is always checked.
+	VerifyChecksums bool
+
+	// OSName is the OS build of MongoDB being downloaded (see
+	// DownloadSpec.OSName). It's only used to explain why a binary can't
+	// run. Defaults to the OSName in the name of the archive.
+	OSName string
+
+	// Platform and Arch are the system the binaries being downloaded are
+	// built for (see DownloadSpec.Platform and DownloadSpec.Arch), e.g. when
+	// prefetching them for another system. Binaries built for another system
+	// than this one aren't run to check them. Default to the platform and
+	// architecture in the name of the archive.
+	Platform string
+	Arch     string
+
+	// ArchiveDir is a directory of vendored archives. If it holds an archive
+	// with the same name as the one being downloaded, that archive is used
+	// instead of going to the network.
+	ArchiveDir string
+
+	// ResumableDownloads makes the Downloader save tarballs to the cache
+	// before extracting them, rather than extracting them as they're
+	// downloaded, so that a download interrupted by the process exiting can
+	// be resumed by the next attempt. It takes up the archive's size on disk
+	// while it's downloaded.
+	ResumableDownloads bool
+
+	// RemoteCache, if set, is checked for binaries that aren't in the cache
+	// before downloading them, and binaries that had to be downloaded are
+	// uploaded to it
+	RemoteCache RemoteCache
+}
+
 // GetOrDownloadMongod returns the path to the mongod binary from the tarball
 // at the given URL. If the URL has not yet been downloaded, it's downloaded
 // and saved the the cache. If it has been downloaded, the existing mongod
 // path is returned.
+//
+// Deprecated: use Downloader.GetOrDownloadMongod, which also allows
+// configuring the HTTP client and headers used for the download.
 func GetOrDownloadMongod(urlStr string, cachePath string, logger *memongolog.Logger) (string, error) {
+	downloader := &Downloader{
+		CachePath: cachePath,
+		Logger:    logger,
+	}
+
+	return downloader.GetOrDownloadMongod(urlStr)
+}
+
+// GetOrDownloadBinaries returns the paths to the named binaries (e.g. "mongod"
+// and "mongos") from the tarball at the given URL, keyed by name, downloading
+// it to the cache if needed. To configure the HTTP client or headers used for
+// the download, use Downloader.GetOrDownloadBinaries.
+func GetOrDownloadBinaries(urlStr string, cachePath string, logger *memongolog.Logger, names ...string) (map[string]string, error) {
+	downloader := &Downloader{
+		CachePath: cachePath,
+		Logger:    logger,
+	}
+
+	return downloader.GetOrDownloadBinaries(urlStr, names...)
+}
+
+// GetOrDownloadMongod returns the path to the mongod binary from the tarball
+// at the given URL. If the URL has not yet been downloaded, it's downloaded
+// and saved the the cache. If it has been downloaded, the existing mongod
+// path is returned. The URL may also be a file:// URL or a plain path to a
+// local tarball.
+//
+// If mirrorURLs are given, the tarball is downloaded from each of them in
+// order, falling back to urlStr if all of them fail. The cache entry is
+// always keyed by urlStr, so switching mirrors doesn't invalidate the cache.
+func (d *Downloader) GetOrDownloadMongod(urlStr string, mirrorURLs ...string) (string, error) {
+	sources := append(append([]string{}, mirrorURLs...), urlStr)
+	paths, err := d.getOrDownloadBinaries(context.Background(), urlStr, sources, []string{"mongod"})
+	if err != nil {
+		return "", err
+	}
+
+	return paths["mongod"], nil
+}
+
+// GetOrDownloadBinaries is like GetOrDownloadMongod, but returns the paths to
+// each of the named binaries (e.g. "mongod" and "mongos") from the archive,
+// keyed by name. The archive is only extracted again if one of the named
+// binaries is missing from the cache.
+func (d *Downloader) GetOrDownloadBinaries(urlStr string, names ...string) (map[string]string, error) {
+	return d.getOrDownloadBinaries(context.Background(), urlStr, []string{urlStr}, names)
+}
+
+// HasArchive returns whether mongod from the archive at urlStr can be had
+// without going to the network: it's in the cache, or the archive is a
+// local file or vendored in ArchiveDir
+func (d *Downloader) HasArchive(urlStr string) bool {
+	if localPath, isLocal := localArchivePath(urlStr); isLocal {
+		exists, _ := Afs.Exists(localPath)
+		return exists
+	}
+
+	if _, vendored := d.findVendoredArchive(urlStr); vendored {
+		return true
+	}
+
 	dirname, dirErr := directoryNameForURL(urlStr)
 	if dirErr != nil {
-		return "", dirErr
+		return false
+	}
+	dirPath := path.Join(d.CachePath, dirname)
+	paths := map[string]string{"mongod": path.Join(dirPath, "mongod")}
+
+	// Entries created before memongo kept metadata can be used too, they're
+	// only backfilled once they're used
+	if exists, _ := Afs.Exists(path.Join(dirPath, metadataFileName)); !exists {
+		missing, missingErr := missingBinaries(paths)
+		return missingErr == nil && len(missing) == 0
+	}
+
+	missing, verifyErr := d.verifyCacheEntry(dirPath, paths, false)
+	return verifyErr == nil && len(missing) == 0
+}
+
+// getOrDownloadBinaries returns the paths to the named binaries in the cache
+// entry for the archive at urlStr. If they aren't cached, the archive is
+// downloaded from each of sourceURLs in order, which are urlStr or copies of
+// it.
+func (d *Downloader) getOrDownloadBinaries(ctx context.Context, urlStr string, sourceURLs []string, names []string) (map[string]string, error) {
+	logger := d.logger()
+	cachePath := d.CachePath
+	redactedURL := RedactURL(urlStr)
+	namesStr := strings.Join(names, ", ")
+
+	dirname, dirErr := directoryNameForURL(urlStr)
+	if dirErr != nil {
+		return nil, dirErr
 	}
 
 	dirPath := path.Join(cachePath, dirname)
-	mongodPath := path.Join(dirPath, "mongod")
+	paths := map[string]string{}
+	for _, name := range names {
+		paths[name] = path.Join(dirPath, name)
+	}
 
 	// Check the cache
-	existsInCache, existsErr := Afs.Exists(mongodPath)
-	if existsErr != nil {
-		return "", fmt.Errorf("error while checking for mongod in cache: %s", existsErr)
+	missing, verifyErr := d.verifyCacheEntry(dirPath, paths, false)
+	corruptErr := &CorruptCacheEntryError{}
+	if verifyErr != nil && !errors.As(verifyErr, &corruptErr) {
+		return nil, fmt.Errorf("error while checking for %s in cache: %s", namesStr, verifyErr)
+	}
+	if verifyErr == nil && len(missing) == 0 {
+		logger.Debugf("%s from %s exists in cache at %s", namesStr, redactedURL, dirPath)
+		if touchErr := touchCacheEntry(dirPath); touchErr != nil {
+			logger.Debugf("error recording use of cache entry %s: %s", dirPath, touchErr)
+		}
+		return paths, nil
+	}
+
+	// Only download once at a time per cache entry: within this process by
+	// sharing the download between concurrent callers, and between processes
+	// with a lock file. Every caller stops waiting for a shared download once
+	// their own context is done, but the download only stops once all of
+	// them did.
+	sortedNames := append([]string{}, names...)
+	sort.Strings(sortedNames)
+	key := dirPath + "|" + strings.Join(sortedNames, ",")
+
+	var result singleflight.Result
+	for {
+		sharedCtx, leave := joinSharedDownload(key)
+		resultCh := downloadGroup.DoChan(key, func() (interface{}, error) {
+			return nil, d.lockAndDownload(sharedCtx, urlStr, sourceURLs, dirname, paths)
+		})
+
+		select {
+		case result = <-resultCh:
+		case <-ctx.Done():
+			leave()
+			return nil, ctx.Err()
+		}
+		leave()
+
+		// We may have joined a download just as every caller that was
+		// waiting for it gave up, in which case we start another one
+		if !errors.Is(result.Err, context.Canceled) || ctx.Err() != nil {
+			break
+		}
+	}
+	if result.Shared {
+		logger.Debugf("shared download of %s from %s with concurrent callers", namesStr, redactedURL)
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	return paths, nil
+}
+
+// lockAndDownload downloads the archive at urlStr from one of sourceURLs and
+// extracts the binaries at paths into the cache entry named dirname, while
+// holding the lock on that cache entry
+func (d *Downloader) lockAndDownload(ctx context.Context, urlStr string, sourceURLs []string, dirname string, paths map[string]string) error {
+	logger := d.logger()
+	cachePath := d.CachePath
+	redactedURL := RedactURL(urlStr)
+	dirPath := path.Join(cachePath, dirname)
+
+	lock, lockErr := acquireFileLock(ctx, path.Join(cachePath, lockDirName, dirname+".lock"), logger)
+	if lockErr != nil {
+		return lockErr
+	}
+	defer func() {
+		if releaseErr := lock.release(); releaseErr != nil {
+			logger.Warnf("error releasing lock: %s", releaseErr)
+		}
+	}()
+
+	// Another process may have downloaded the binaries while we were waiting
+	// for the lock
+	missing, verifyErr := d.verifyCacheEntry(dirPath, paths, true)
+	corruptErr := &CorruptCacheEntryError{}
+	if verifyErr != nil && !errors.As(verifyErr, &corruptErr) {
+		return fmt.Errorf("error while checking for binaries in cache: %s", verifyErr)
 	}
-	if existsInCache {
-		logger.Debugf("mongod from %s exists in cache at %s", urlStr, mongodPath)
-		return mongodPath, nil
+	if verifyErr == nil && len(missing) == 0 {
+		logger.Debugf("binaries from %s were downloaded to %s by another process", redactedURL, dirPath)
+		return nil
+	}
+
+	// We keep the metadata of the binaries we don't extract again
+	metadata, _ := readCacheMetadata(dirPath)
+
+	if verifyErr != nil {
+		quarantinePath, quarantineErr := quarantineCacheEntry(cachePath, dirname)
+		if quarantineErr != nil {
+			return quarantineErr
+		}
+		logger.Warnf("%s; moved the cache entry to %s and downloading it again", verifyErr, quarantinePath)
+
+		metadata = nil
+		missing = make([]string, 0, len(paths))
+		for name := range paths {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
 	}
+	missingStr := strings.Join(missing, ", ")
 
-	logger.Infof("mongod from %s does not exist in cache, downloading to %s", urlStr, mongodPath)
+	logger.Infof("%s from %s does not exist in cache, downloading to %s", missingStr, redactedURL, dirPath)
 	downloadStartTime := time.Now()
 
-	// Download the file
-	// nolint:gosec
-	resp, httpGetErr := http.Get(urlStr)
-	if httpGetErr != nil {
-		return "", fmt.Errorf("error getting tarball from %s: %s", urlStr, httpGetErr)
+	// Extract every binary we might want in one pass, so we don't have to
+	// download the archive again later on. Only the requested ones are
+	// required to be in the archive.
+	wanted := map[string]bool{}
+	for _, name := range d.extractBinaries() {
+		wanted[name] = false
+	}
+	for name := range paths {
+		wanted[name] = true
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP request failed with status code %d", resp.StatusCode)
+	// Partial downloads are kept in the cache directory so that an
+	// interrupted download can be resumed by the next attempt, even in
+	// another process
+	partialDir := path.Join(cachePath, partialDirName)
+	mkdirErr := Afs.MkdirAll(partialDir, 0755)
+	if mkdirErr != nil {
+		return fmt.Errorf("error creating directory %s: %s", partialDir, mkdirErr)
 	}
 
-	tgzTempFile, tmpFileErr := Afs.TempFile("", "")
-	if tmpFileErr != nil {
-		return "", fmt.Errorf("error creating temp file for tarball: %s", tmpFileErr)
+	// The binaries are extracted and checked next to the partial downloads,
+	// and only moved into the cache entry once they're known to be good.
+	// Being in the cache directory, they can always be renamed rather than
+	// copied.
+	stagingPath := path.Join(partialDir, dirname+".staging")
+	if removeErr := Afs.RemoveAll(stagingPath); removeErr != nil {
+		return fmt.Errorf("error removing %s: %s", stagingPath, removeErr)
+	}
+	if mkdirErr := Afs.MkdirAll(stagingPath, 0755); mkdirErr != nil {
+		return fmt.Errorf("error creating directory %s: %s", stagingPath, mkdirErr)
 	}
 	defer func() {
-		_ = tgzTempFile.Close()
-		_ = Afs.Remove(tgzTempFile.Name())
+		_ = Afs.RemoveAll(stagingPath)
 	}()
 
-	_, copyErr := io.Copy(tgzTempFile, resp.Body)
-	if copyErr != nil {
-		return "", fmt.Errorf("error downloading tarball from %s: %s", urlStr, copyErr)
+	// A vendored archive is already on this machine, so there's no need to
+	// ask the remote cache
+	vendoredPath, vendored := d.findVendoredArchive(urlStr)
+
+	var extracted *CacheMetadata
+	if d.RemoteCache != nil && !vendored {
+		var remoteErr error
+		extracted, remoteErr = d.fetchFromRemoteCache(ctx, dirname, stagingPath, wanted)
+		switch {
+		case remoteErr == nil:
+			logger.Infof("fetched %s from the remote cache", missingStr)
+		case errors.Is(remoteErr, ErrRemoteCacheMiss):
+			logger.Debugf("%s from %s is not in the remote cache", missingStr, redactedURL)
+		default:
+			logger.Warnf("error fetching %s from the remote cache, downloading it instead: %s", missingStr, remoteErr)
+		}
 	}
+	fromRemoteCache := extracted != nil
+
+	var sources []string
+	if !fromRemoteCache {
+		sources = append([]string{}, sourceURLs...)
+		if vendored {
+			logger.Infof("using vendored archive %s", vendoredPath)
+			sources = append([]string{vendoredPath}, sources...)
+		}
+	}
+	var verified bool
+	var downloadErr error
+	for i, sourceURL := range sources {
+		if len(sources) > 1 {
+			logger.Infof("downloading %s from %s (source %d/%d)", missingStr, RedactURL(sourceURL), i+1, len(sources))
+		}
+
+		// Each source has its own partial download, so a download from one
+		// isn't resumed from another
+		partialName := dirname
+		if sourceURL != urlStr {
+			if sourceName, nameErr := directoryNameForURL(sourceURL); nameErr == nil {
+				partialName = sourceName
+			}
+		}
+		partialPath := path.Join(partialDir, partialName+".partial")
+
+		extracted, verified, downloadErr = d.downloadAndExtract(ctx, sourceURL, partialPath, stagingPath, wanted)
+		if downloadErr == nil {
+			break
+		}
 
-	_, seekErr := tgzTempFile.Seek(0, 0)
-	if seekErr != nil {
-		return "", fmt.Errorf("error seeking back to start of file: %s", seekErr)
+		if len(sources) > 1 {
+			logger.Warnf("downloading %s from %s failed: %s", missingStr, RedactURL(sourceURL), downloadErr)
+		}
+	}
+	if downloadErr != nil {
+		return downloadErr
 	}
 
-	// Extract mongod
-	gzReader, gzErr := gzip.NewReader(tgzTempFile)
-	if gzErr != nil {
-		return "", fmt.Errorf("error initializing gzip reader from %s: %w, %s", tgzTempFile.Name(), gzErr, urlStr)
+	// Make sure the binaries can run on this system before keeping them,
+	// to catch missing shared libraries early
+	if extracted.Version == "" {
+		extracted.Version = versionFromURL(urlStr)
+	}
+	staged := sortedKeys(extracted.Binaries)
+	for _, name := range staged {
+		version, checkErr := d.checkBinary(ctx, path.Join(stagingPath, name), urlStr)
+		if checkErr != nil {
+			return checkErr
+		}
+		if version != "" {
+			logger.Debugf("%s reports version %s", name, version)
+			extracted.Version = version
+		}
 	}
-	defer gzReader.Close()
 
-	tarReader := tar.NewReader(gzReader)
-	for {
-		nextFile, tarErr := tarReader.Next()
-		if tarErr == io.EOF {
-			return "", fmt.Errorf("did not find a mongod binary in the tar from %s", urlStr)
+	if metadata != nil {
+		for name, binMetadata := range metadata.Binaries {
+			if _, ok := extracted.Binaries[name]; !ok {
+				extracted.Binaries[name] = binMetadata
+			}
 		}
-		if tarErr != nil {
-			return "", fmt.Errorf("error reading from tar: %s", tarErr)
+	}
+	extracted.ExtractedAt = time.Now()
+	extracted.LastUsedAt = extracted.ExtractedAt
+	if writeErr := writeCacheMetadata(stagingPath, extracted); writeErr != nil {
+		return writeErr
+	}
+	if moveErr := moveStagedEntry(stagingPath, dirPath, staged); moveErr != nil {
+		return moveErr
+	}
+
+	logger.Infof("finished downloading %s to %s in %s", missingStr, dirPath, time.Since(downloadStartTime).String())
+
+	// Share what we downloaded with other machines, as long as we know it's
+	// what was published. They can still download it themselves if this
+	// fails.
+	if d.RemoteCache != nil && !fromRemoteCache && !verified {
+		logger.Debugf("not uploading %s to the remote cache, since there was no checksum to check %s against", missingStr, redactedURL)
+	} else if d.RemoteCache != nil && !fromRemoteCache {
+		if uploadErr := d.uploadToRemoteCache(ctx, dirname, dirPath, extracted); uploadErr != nil {
+			logger.Warnf("error uploading %s to the remote cache: %s", missingStr, uploadErr)
+		} else {
+			logger.Debugf("uploaded %s to the remote cache", missingStr)
 		}
+	}
 
-		if strings.HasSuffix(nextFile.Name, "bin/mongod") {
-			err := saveFile(path.Join(dirPath, filepath.Base(nextFile.Name)), tarReader, logger)
-			if err != nil {
-				return "", err
+	return nil
+}
+
+// moveStagedEntry moves the binaries with the given names from stagingPath,
+// and then their metadata, into the cache entry at dirPath. The binaries
+// already in the entry that weren't extracted again are kept.
+func moveStagedEntry(stagingPath string, dirPath string, names []string) error {
+	if mkdirErr := Afs.MkdirAll(dirPath, 0755); mkdirErr != nil {
+		return fmt.Errorf("error creating directory %s: %s", dirPath, mkdirErr)
+	}
+
+	for _, name := range append(names, metadataFileName) {
+		stagedPath := path.Join(stagingPath, name)
+		if renameErr := Afs.Rename(stagedPath, path.Join(dirPath, name)); renameErr != nil {
+			return fmt.Errorf("error moving %s into %s: %s", stagedPath, dirPath, renameErr)
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(binaries map[string]BinaryMetadata) []string {
+	keys := make([]string, 0, len(binaries))
+	for key := range binaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// missingBinaries returns the names of the binaries that don't exist at the
+// given paths
+func missingBinaries(paths map[string]string) ([]string, error) {
+	var missing []string
+	for name, binPath := range paths {
+		exists, existsErr := Afs.Exists(binPath)
+		if existsErr != nil {
+			return nil, existsErr
+		}
+		if !exists {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing, nil
+}
+
+// downloadAndExtract extracts the wanted binaries from the archive at urlStr
+// into dirPath. wanted maps binary names to whether they're required.
+//
+// Tarballs are extracted as they're downloaded, without saving them to disk
+// first, unless ResumableDownloads is set. Zips can't be read that way, so
+// they're downloaded to partialPath first, as are tarballs with
+// ResumableDownloads, and an archive whose download an earlier, interrupted
+// attempt left at partialPath, so it can be resumed. Local archives are
+// extracted in place. Archives are checked against the checksum next to
+// them, if there is one: the .sha256 file of a local archive, or the one
+// MongoDB publishes.
+//
+// It returns metadata describing the archive and the extracted binaries, and
+// whether the archive was checked against a checksum.
+func (d *Downloader) downloadAndExtract(ctx context.Context, urlStr string, partialPath string, dirPath string, wanted map[string]bool) (*CacheMetadata, bool, error) {
+	logger := d.logger()
+
+	archivePath, isLocal := localArchivePath(urlStr)
+	if isLocal {
+		verified, checksumErr := verifyLocalChecksum(archivePath, logger)
+		if checksumErr != nil {
+			return nil, false, checksumErr
+		}
+
+		extracted, extractErr := d.extractArchiveFile(urlStr, archivePath, dirPath, wanted)
+		return extracted, verified, extractErr
+	}
+
+	// We're done with the download once we've tried extracting it, since an
+	// archive we couldn't extract from shouldn't be resumed. Only a download
+	// that was interrupted is kept, for the next attempt to resume.
+	keepPartial := false
+	defer func() {
+		if !keepPartial {
+			_ = Afs.Remove(partialPath)
+		}
+	}()
+
+	publishedSHA := d.publishedChecksum(ctx, urlStr)
+
+	var extracted *CacheMetadata
+	var extractErr error
+	if exists, _ := Afs.Exists(partialPath); exists || d.ResumableDownloads {
+		if exists {
+			logger.Debugf("found a partial download of %s at %s, resuming it", RedactURL(urlStr), partialPath)
+		}
+		downloadErr := d.downloadArchive(ctx, urlStr, partialPath)
+		if downloadErr != nil {
+			keepPartial = isResumable(downloadErr)
+			return nil, false, downloadErr
+		}
+
+		extracted, extractErr = d.extractArchiveFile(urlStr, partialPath, dirPath, wanted)
+	} else {
+		extracted, extractErr = d.streamAndExtract(ctx, urlStr, partialPath, dirPath, wanted)
+		interruptedErr := &interruptedDownloadError{}
+		keepPartial = errors.As(extractErr, &interruptedErr)
+	}
+	if extractErr != nil {
+		return nil, false, extractErr
+	}
+
+	if publishedSHA != "" {
+		if extracted.ArchiveSHA256 != publishedSHA {
+			return nil, false, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", RedactURL(urlStr), publishedSHA, extracted.ArchiveSHA256)
+		}
+		logger.Debugf("verified checksum of %s", RedactURL(urlStr))
+	}
+
+	return extracted, publishedSHA != "", nil
+}
+
+// streamAndExtract extracts the wanted binaries from the archive at urlStr
+// as it's downloaded. A zip is downloaded to partialPath instead, and
+// extracted from there.
+func (d *Downloader) streamAndExtract(ctx context.Context, urlStr string, partialPath string, dirPath string, wanted map[string]bool) (*CacheMetadata, error) {
+	logger := d.logger()
+	redactedURL := RedactURL(urlStr)
+
+	stream := d.newDownloadStream(ctx, urlStr)
+	defer stream.Close()
+
+	// The archive is hashed as it's read
+	archiveHash := sha256.New()
+	archive := bufio.NewReader(io.TeeReader(stream, archiveHash))
+
+	header, peekErr := archive.Peek(tarMagicOffset + len(tarMagic))
+	if peekErr != nil && peekErr != io.EOF {
+		return nil, peekErr
+	}
+	format, formatErr := detectArchiveFormat(header)
+	if formatErr != nil {
+		return nil, fmt.Errorf("error extracting binaries from %s: %w", redactedURL, formatErr)
+	}
+
+	if format == archiveFormatZip {
+		logger.Debugf("%s is a zip, which can't be extracted while it's downloaded, saving it to %s first", redactedURL, partialPath)
+		if writeErr := Afs.WriteReader(partialPath, archive); writeErr != nil {
+			if stream.failure != nil {
+				if isResumable(stream.failure) {
+					return nil, &interruptedDownloadError{stream.failure}
+				}
+				return nil, stream.failure
 			}
-			break
+			return nil, fmt.Errorf("error saving %s to %s: %s", redactedURL, partialPath, writeErr)
 		}
+
+		return d.extractArchiveFile(urlStr, partialPath, dirPath, wanted)
 	}
 
-	logger.Infof("finished downloading mongod to %s in %s", mongodPath, time.Since(downloadStartTime).String())
+	extractor := newBinaryExtractor(dirPath, wanted, logger)
+	walkErr := walkTarStream(archive, format, extractor.visit)
+	if walkErr == nil {
+		// Read the rest of the archive, so the checksum covers all of it
+		_, walkErr = io.Copy(io.Discard, archive)
+	}
+	if walkErr != nil {
+		extractor.removeExtracted()
+		if stream.failure != nil {
+			return nil, stream.failure
+		}
+		return nil, fmt.Errorf("error extracting binaries from %s: %w", redactedURL, walkErr)
+	}
+
+	if foundErr := extractor.checkFound(redactedURL); foundErr != nil {
+		return nil, foundErr
+	}
 
-	return mongodPath, nil
+	return &CacheMetadata{
+		SourceURL:     redactedURL,
+		ArchiveSHA256: hex.EncodeToString(archiveHash.Sum(nil)),
+		Binaries:      extractor.binaries,
+	}, nil
 }
 
-func saveFile(mongodPath string, tarReader *tar.Reader, logger *memongolog.Logger) error {
+// extractArchiveFile extracts the wanted binaries from the archive at
+// archivePath, which was downloaded from urlStr, into dirPath
+func (d *Downloader) extractArchiveFile(urlStr string, archivePath string, dirPath string, wanted map[string]bool) (*CacheMetadata, error) {
+	redactedURL := RedactURL(urlStr)
+
+	archiveFile, openErr := Afs.Open(archivePath)
+	if openErr != nil {
+		return nil, fmt.Errorf("error opening downloaded archive: %s", openErr)
+	}
+	defer archiveFile.Close()
+
+	archiveSHA, _, hashErr := hashFile(archivePath)
+	if hashErr != nil {
+		return nil, hashErr
+	}
+
+	// Extract the binaries in a single pass
+	extractor := newBinaryExtractor(dirPath, wanted, d.logger())
+	walkErr := walkArchive(archiveFile, extractor.visit)
+	if walkErr != nil {
+		return nil, fmt.Errorf("error extracting binaries from %s: %w", redactedURL, walkErr)
+	}
+
+	if foundErr := extractor.checkFound(redactedURL); foundErr != nil {
+		return nil, foundErr
+	}
+
+	return &CacheMetadata{
+		SourceURL:     redactedURL,
+		ArchiveSHA256: archiveSHA,
+		Binaries:      extractor.binaries,
+	}, nil
+}
+
+// binaryExtractor saves the wanted binaries in an archive to dirPath, as
+// the archive is walked. wanted maps binary names to whether they're
+// required.
+type binaryExtractor struct {
+	dirPath string
+	wanted  map[string]bool
+	logger  *memongolog.Logger
+
+	binaries map[string]BinaryMetadata
+}
+
+func newBinaryExtractor(dirPath string, wanted map[string]bool, logger *memongolog.Logger) *binaryExtractor {
+	return &binaryExtractor{
+		dirPath:  dirPath,
+		wanted:   wanted,
+		logger:   logger,
+		binaries: map[string]BinaryMetadata{},
+	}
+}
+
+// visit is called by walkArchive for each file in the archive
+func (e *binaryExtractor) visit(name string, contents io.Reader) (bool, error) {
+	binName := path.Base(name)
+	if _, ok := e.wanted[binName]; !ok || !strings.HasSuffix(name, "bin/"+binName) {
+		return true, nil
+	}
+	if _, ok := e.binaries[binName]; ok {
+		return true, nil
+	}
+
+	binMetadata, err := saveFile(path.Join(e.dirPath, binName), contents, e.logger)
+	if err != nil {
+		return false, err
+	}
+	e.binaries[binName] = binMetadata
+
+	return len(e.binaries) < len(e.wanted), nil
+}
+
+// checkFound returns an error if a required binary wasn't in the archive
+func (e *binaryExtractor) checkFound(redactedURL string) error {
+	for name, required := range e.wanted {
+		if _, ok := e.binaries[name]; ok {
+			continue
+		}
+		if required {
+			return fmt.Errorf("did not find a %s binary in the archive from %s", name, redactedURL)
+		}
+		e.logger.Debugf("did not find a %s binary in the archive from %s", name, redactedURL)
+	}
+
+	return nil
+}
+
+// removeExtracted removes the binaries extracted so far
+func (e *binaryExtractor) removeExtracted() {
+	for name := range e.binaries {
+		_ = Afs.Remove(path.Join(e.dirPath, name))
+	}
+}
+
+func (d *Downloader) extractBinaries() []string {
+	if d.ExtractBinaries == nil {
+		return DefaultExtractBinaries
+	}
+	return d.ExtractBinaries
+}
+
+func (d *Downloader) logger() *memongolog.Logger {
+	if d.Logger == nil {
+		return memongolog.New(nil, 0)
+	}
+	return d.Logger
+}
+
+// saveFile writes the binary to mongodPath and makes it executable. It returns
+// the binary's size and checksum.
+func saveFile(mongodPath string, contents io.Reader, logger *memongolog.Logger) (BinaryMetadata, error) {
 	mkdirErr := Afs.MkdirAll(path.Dir(mongodPath), 0755)
 	if mkdirErr != nil {
-		return fmt.Errorf("error creating directory %s: %s", path.Dir(mongodPath), mkdirErr)
+		return BinaryMetadata{}, fmt.Errorf("error creating directory %s: %s", path.Dir(mongodPath), mkdirErr)
 	}
 
-	// Extract to a temp file first, then copy to the destination, so we get
-	// atomic behavior if there's multiple parallel downloaders
-	mongodTmpFile, tmpFileErr := Afs.TempFile("", "")
+	// Extract to a temp file next to the destination first, then rename it,
+	// so we get atomic behavior if there's multiple parallel downloaders.
+	// Being in the same directory, it can always be renamed rather than
+	// copied.
+	mongodTmpFile, tmpFileErr := Afs.TempFile(path.Dir(mongodPath), "."+path.Base(mongodPath)+".tmp")
 	if tmpFileErr != nil {
-		return fmt.Errorf("error creating temp file for mongod: %s", tmpFileErr)
+		return BinaryMetadata{}, fmt.Errorf("error creating temp file for mongod: %s", tmpFileErr)
 	}
+	tmpPath := mongodTmpFile.Name()
+	renamed := false
 	defer func() {
 		_ = mongodTmpFile.Close()
+		if !renamed {
+			_ = Afs.Remove(tmpPath)
+		}
 	}()
 
-	_, writeErr := io.Copy(mongodTmpFile, tarReader)
+	shasum := sha256.New()
+	size, writeErr := io.Copy(mongodTmpFile, io.TeeReader(contents, shasum))
 	if writeErr != nil {
-		return fmt.Errorf("error writing mongod binary at %s: %s", mongodTmpFile.Name(), writeErr)
+		return BinaryMetadata{}, fmt.Errorf("error writing mongod binary at %s: %s", tmpPath, writeErr)
 	}
 
-	_ = mongodTmpFile.Close()
+	closeErr := mongodTmpFile.Close()
+	if closeErr != nil {
+		return BinaryMetadata{}, fmt.Errorf("error writing mongod binary at %s: %s", tmpPath, closeErr)
+	}
 
-	renameErr := Afs.Rename(mongodTmpFile.Name(), mongodPath)
-	if renameErr != nil {
-		linkErr := &os.LinkError{}
-		if errors.As(renameErr, &linkErr) {
-			// If /tmp is on another filesystem, we have to copy the file instead.
-			logger.Debugf("Unable to move %s to %s, copying instead", mongodTmpFile.Name(), mongodPath)
-			mongodFile, err := Afs.Create(mongodPath)
-			if err != nil {
-				return fmt.Errorf("creating mongod binary at %s: %s", mongodTmpFile, err)
-			}
-			defer mongodFile.Close()
+	chmodErr := Afs.Chmod(tmpPath, 0755)
+	if chmodErr != nil {
+		return BinaryMetadata{}, fmt.Errorf("error chmod-ing mongodb binary at %s: %s", tmpPath, chmodErr)
+	}
 
-			content, err := Afs.ReadFile(mongodTmpFile.Name())
-			if err != nil {
-				return fmt.Errorf("read file err: %w", err)
-			}
-			_, copyErr := mongodFile.Write(content)
-			if copyErr != nil {
-				return fmt.Errorf("error copying mongod binary from %s to %s: %w", mongodTmpFile.Name(), mongodPath, copyErr)
-			}
+	renameErr := Afs.Rename(tmpPath, mongodPath)
+	linkErr := &os.LinkError{}
+	switch {
+	case renameErr == nil:
+		renamed = true
+	case errors.As(renameErr, &linkErr):
+		// The cache may be on a filesystem that can't rename, so we have to
+		// copy the file instead
+		logger.Debugf("Unable to move %s to %s, copying instead", tmpPath, mongodPath)
+		if copyErr := copyFile(tmpPath, mongodPath, 0755); copyErr != nil {
+			return BinaryMetadata{}, fmt.Errorf("error copying mongod binary from %s to %s: %w", tmpPath, mongodPath, copyErr)
 		}
+	default:
+		return BinaryMetadata{}, fmt.Errorf("error moving mongod binary from %s to %s: %s", tmpPath, mongodPath, renameErr)
 	}
 
-	chmodErr := Afs.Chmod(mongodPath, 0755)
-	if chmodErr != nil {
-		return fmt.Errorf("error chmod-ing mongodb binary at %s: %s", mongodTmpFile, chmodErr)
+	binMetadata := BinaryMetadata{
+		SHA256: hex.EncodeToString(shasum.Sum(nil)),
+		Size:   size,
 	}
+	logger.Debugf("saved %s (%d bytes, SHA-256 %s)", mongodPath, binMetadata.Size, binMetadata.SHA256)
 
-	fmt.Println(Afs.Fs.Stat(mongodPath))
-	return nil
+	return binMetadata, nil
+}
+
+// copyFile copies the file at src to dst, and gives it the given mode
+func copyFile(src string, dst string, mode os.FileMode) error {
+	srcFile, openErr := Afs.Open(src)
+	if openErr != nil {
+		return openErr
+	}
+	defer srcFile.Close()
+
+	dstFile, createErr := Afs.Create(dst)
+	if createErr != nil {
+		return createErr
+	}
+	defer dstFile.Close()
+
+	if _, copyErr := io.Copy(dstFile, srcFile); copyErr != nil {
+		return copyErr
+	}
+	if closeErr := dstFile.Close(); closeErr != nil {
+		return closeErr
+	}
+
+	return Afs.Chmod(dst, mode)
 }
 
 // After the download a tarball, we extract it to a directory in the cache.
@@ -190,12 +901,13 @@ func directoryNameForURL(urlStr string) (string, error) {
 	shahex := hex.EncodeToString(shasum.Sum(nil))
 	hash := shahex[0:10]
 
-	urlParsed, parseErr := url.Parse(urlStr)
-	if parseErr != nil {
-		return "", fmt.Errorf("could not parse url: %s", parseErr)
+	if _, parseErr := url.Parse(urlStr); parseErr != nil {
+		if _, isLocal := localArchivePath(urlStr); !isLocal {
+			return "", fmt.Errorf("could not parse url: %s", parseErr)
+		}
 	}
 
-	basename := sanitizeFilename(path.Base(urlParsed.Path))
+	basename := sanitizeFilename(archiveBaseName(urlStr))
 
 	return fmt.Sprintf("%s_%s", basename, hash), nil
 }
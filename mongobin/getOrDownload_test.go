@@ -3,8 +3,12 @@ package mongobin_test
 import (
 	"errors"
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/spf13/afero"
@@ -59,7 +63,7 @@ func TestGetOrDownloadDifferentFilesystems(t *testing.T) {
 	defer ctrl.Finish()
 	m := mockAfero.NewMockFs(ctrl)
 
-	m.EXPECT().Rename(gomock.Any(), gomock.Any()).Return(&os.LinkError{"rename", "oldname", "newname", errors.New("rename error")}).Times(1)
+	m.EXPECT().Rename(gomock.Any(), gomock.Any()).Return(&os.LinkError{Op: "rename", Old: "oldname", New: "newname", Err: errors.New("rename error")}).Times(2) // mongod and mongos
 
 	// General mock faking :)
 	m.EXPECT().Mkdir(gomock.Any(), gomock.Any()).DoAndReturn(func(dir string, perm fs.FileMode) error { return FS.Mkdir(dir, perm) }).AnyTimes()
@@ -74,6 +78,7 @@ func TestGetOrDownloadDifferentFilesystems(t *testing.T) {
 	m.EXPECT().Chmod(gomock.Any(), gomock.Any()).DoAndReturn(func(name string, mode os.FileMode) error { return FS.Chmod(name, mode) }).AnyTimes()
 	m.EXPECT().Create(gomock.Any()).DoAndReturn(func(name string) (afero.File, error) { return FS.Create(name) }).AnyTimes()
 	m.EXPECT().Open(gomock.Any()).DoAndReturn(func(name string) (afero.File, error) { return FS.Open(name) }).AnyTimes()
+	m.EXPECT().Chtimes(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(func(name string, atime time.Time, mtime time.Time) error { return FS.Chtimes(name, atime, mtime) }).AnyTimes()
 
 	mongobin.Afs = afero.Afero{Fs: m}
 
@@ -113,3 +118,102 @@ func TestGetOrDownloadDifferentFilesystems(t *testing.T) {
 
 	assert.Equal(t, stat.ModTime(), stat2.ModTime())
 }
+
+func TestGetOrDownloadFromMirrors(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	tarball := makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"})
+
+	var mirrorRequests int32
+	brokenMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrorRequests, 1)
+		http.NotFound(w, r)
+	}))
+	defer brokenMirror.Close()
+
+	workingMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&mirrorRequests, 1)
+		_, _ = w.Write(tarball)
+	}))
+	defer workingMirror.Close()
+
+	cacheDir, err := mongobin.Afs.TempDir("", "")
+	require.NoError(t, err)
+
+	downloader := &mongobin.Downloader{
+		CachePath: cacheDir,
+		Logger:    memongolog.New(nil, memongolog.LogLevelDebug),
+	}
+
+	archiveURL := "https://fastdl.mongodb.org/linux/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+	path, err := downloader.GetOrDownloadMongod(archiveURL, brokenMirror.URL+"/mongodb.tgz", workingMirror.URL+"/mongodb.tgz")
+	require.NoError(t, err)
+
+	assert.Equal(t, cacheDir+"/mongodb-linux-x86_64-ubuntu2204-6_0_4_tgz_45051fa336/mongod", path)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&mirrorRequests))
+
+	// Switching mirrors shouldn't trigger a new download
+	path2, err := downloader.GetOrDownloadMongod(archiveURL, workingMirror.URL+"/other-mirror.tgz")
+	require.NoError(t, err)
+
+	assert.Equal(t, path, path2)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&mirrorRequests))
+}
+
+func TestGetOrDownloadBinaries(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	tarball := makeTarball(t, map[string]string{
+		"mongodb/bin/mongod":    "mongod",
+		"mongodb/bin/mongos":    "mongos",
+		"mongodb/bin/install":   "install",
+		"mongodb/other/mongos2": "mongos2",
+	})
+
+	var requests int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(tarball)
+	}))
+	defer httpServer.Close()
+
+	downloader := &mongobin.Downloader{
+		CachePath: "/cache",
+		Logger:    memongolog.New(nil, memongolog.LogLevelDebug),
+	}
+	archiveURL := httpServer.URL + "/mongodb.tgz"
+
+	// Asking for mongod extracts mongos as well
+	mongodPath, err := downloader.GetOrDownloadMongod(archiveURL)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	paths, err := downloader.GetOrDownloadBinaries(archiveURL, "mongod", "mongos")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	assert.Equal(t, mongodPath, paths["mongod"])
+
+	for name, binPath := range paths {
+		content, err := mongobin.Afs.ReadFile(binPath)
+		require.NoError(t, err)
+		assert.Equal(t, name, string(content))
+	}
+
+	// The package level function shares the cache
+	packagePaths, err := mongobin.GetOrDownloadBinaries(archiveURL, "/cache", memongolog.New(nil, memongolog.LogLevelSilent), "mongod", "mongos")
+	require.NoError(t, err)
+	assert.Equal(t, paths, packagePaths)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// A binary missing from the cache entry is extracted again
+	require.NoError(t, mongobin.Afs.Remove(paths["mongos"]))
+
+	paths2, err := downloader.GetOrDownloadBinaries(archiveURL, "mongos")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, paths["mongos"], paths2["mongos"])
+
+	// A binary that's not in the archive is an error
+	_, err = downloader.GetOrDownloadBinaries(archiveURL, "mongod", "mongosh")
+	require.EqualError(t, err, "did not find a mongosh binary in the archive from "+archiveURL)
+}
@@ -0,0 +1,145 @@
+package mongobin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/tryvium-travels/memongo/memongolog"
+)
+
+// localArchivePath returns the path to the archive if urlStr points to a
+// local file, either with a file:// URL or as a plain path
+func localArchivePath(urlStr string) (string, bool) {
+	// A Windows path like C:\archives\mongodb.zip would parse as a URL with
+	// the scheme "c"
+	if filepath.IsAbs(urlStr) || filepath.VolumeName(urlStr) != "" || hasDriveLetter(urlStr) {
+		return urlStr, true
+	}
+
+	urlParsed, parseErr := url.Parse(urlStr)
+	if parseErr != nil {
+		// Not a valid URL, so it can only be a path
+		return urlStr, true
+	}
+
+	switch urlParsed.Scheme {
+	case "file":
+		return urlParsed.Path, true
+	case "":
+		return urlStr, true
+	default:
+		return "", false
+	}
+}
+
+// hasDriveLetter reports whether path starts with a Windows drive letter,
+// like C:\ or C:/. filepath.VolumeName only recognizes those on Windows. No
+// download URL has a one letter scheme, so they're safe to check for
+// everywhere.
+func hasDriveLetter(path string) bool {
+	if len(path) < 3 || path[1] != ':' || (path[2] != '\\' && path[2] != '/') {
+		return false
+	}
+	letter := path[0] | 0x20
+	return letter >= 'a' && letter <= 'z'
+}
+
+// archiveBaseName returns the file name of the archive at urlStr, which can be
+// a URL or a local path
+func archiveBaseName(urlStr string) string {
+	if localPath, ok := localArchivePath(urlStr); ok {
+		// Split on both separators, since Windows paths may be handled
+		// on other systems too
+		return localPath[strings.LastIndexAny(localPath, `/\`)+1:]
+	}
+
+	urlParsed, parseErr := url.Parse(urlStr)
+	if parseErr != nil {
+		return ""
+	}
+	return path.Base(urlParsed.Path)
+}
+
+// findVendoredArchive looks for an archive with the same name as the one at
+// urlStr in the Downloader's ArchiveDir
+func (d *Downloader) findVendoredArchive(urlStr string) (string, bool) {
+	if d.ArchiveDir == "" {
+		return "", false
+	}
+
+	archiveName := archiveBaseName(urlStr)
+	if archiveName == "" {
+		return "", false
+	}
+
+	archivePath := path.Join(d.ArchiveDir, archiveName)
+	exists, existsErr := Afs.Exists(archivePath)
+	if existsErr != nil || !exists {
+		d.logger().Debugf("archive %s not found in %s", archiveName, d.ArchiveDir)
+		return "", false
+	}
+
+	return archivePath, true
+}
+
+// verifyLocalChecksum checks the archive at archivePath against the SHA-256
+// checksum in archivePath.sha256, if there is one, and returns whether there
+// was. The checksum file can hold either just the hex checksum, or the output
+// of sha256sum, as published by MongoDB alongside their archives.
+func verifyLocalChecksum(archivePath string, logger *memongolog.Logger) (bool, error) {
+	checksumPath := archivePath + ".sha256"
+	checksumFile, readErr := Afs.ReadFile(checksumPath)
+	if os.IsNotExist(readErr) {
+		logger.Debugf("no checksum file found at %s, skipping checksum verification", checksumPath)
+		return false, nil
+	}
+	if readErr != nil {
+		return false, fmt.Errorf("error reading checksum file %s: %s", checksumPath, readErr)
+	}
+
+	expected, parseErr := parseChecksumFile(checksumFile)
+	if parseErr != nil {
+		return false, fmt.Errorf("checksum file %s %s", checksumPath, parseErr)
+	}
+
+	archive, openErr := Afs.Open(archivePath)
+	if openErr != nil {
+		return false, fmt.Errorf("error opening archive %s: %s", archivePath, openErr)
+	}
+	defer archive.Close()
+
+	shasum := sha256.New()
+	if _, copyErr := io.Copy(shasum, archive); copyErr != nil {
+		return false, fmt.Errorf("error reading archive %s: %s", archivePath, copyErr)
+	}
+
+	actual := hex.EncodeToString(shasum.Sum(nil))
+	if actual != expected {
+		return false, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", archivePath, expected, actual)
+	}
+
+	logger.Debugf("verified checksum of %s", archivePath)
+	return true, nil
+}
+
+// parseChecksumFile returns the SHA-256 checksum in a checksum file, which
+// holds either just the hex checksum, or the output of sha256sum
+func parseChecksumFile(contents []byte) (string, error) {
+	fields := strings.Fields(string(contents))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("is empty")
+	}
+
+	checksum := strings.ToLower(fields[0])
+	if !sha256Regex.MatchString(checksum) {
+		return "", fmt.Errorf("doesn't hold a SHA-256 checksum")
+	}
+	return checksum, nil
+}
@@ -0,0 +1,131 @@
+package mongobin_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+func TestGetOrDownloadLocalArchive(t *testing.T) {
+	tarball := makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"})
+	shasum := sha256.Sum256(tarball)
+
+	tests := map[string]struct {
+		archiveURL string
+		checksum   string
+
+		expectedError string
+	}{
+		"plain path": {
+			archiveURL: "/archives/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+		},
+		"file URL": {
+			archiveURL: "file:///archives/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+		},
+		"matching checksum": {
+			archiveURL: "/archives/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+			checksum:   hex.EncodeToString(shasum[:]) + "  mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz\n",
+		},
+		"checksum mismatch": {
+			archiveURL: "/archives/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+			checksum:   "0000000000000000000000000000000000000000000000000000000000000000",
+
+			expectedError: "checksum mismatch for /archives/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz: expected 0000000000000000000000000000000000000000000000000000000000000000, got " + hex.EncodeToString(shasum[:]),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+			require.NoError(t, mongobin.Afs.WriteFile("/archives/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz", tarball, 0644))
+			if test.checksum != "" {
+				require.NoError(t, mongobin.Afs.WriteFile("/archives/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz.sha256", []byte(test.checksum), 0644))
+			}
+
+			downloader := &mongobin.Downloader{
+				CachePath: "/cache",
+				Logger:    memongolog.New(nil, memongolog.LogLevelDebug),
+			}
+
+			path, err := downloader.GetOrDownloadMongod(test.archiveURL)
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			content, err := mongobin.Afs.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, "mongod", string(content))
+
+			// The local archive should be left alone
+			exists, err := mongobin.Afs.Exists("/archives/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz")
+			require.NoError(t, err)
+			assert.True(t, exists)
+		})
+	}
+}
+
+func TestGetOrDownloadFromArchiveDir(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	tarball := makeTarball(t, map[string]string{"mongodb/bin/mongod": "vendored mongod"})
+	require.NoError(t, mongobin.Afs.WriteFile("/vendor/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz", tarball, 0644))
+
+	var requests int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer httpServer.Close()
+
+	downloader := &mongobin.Downloader{
+		CachePath:  "/cache",
+		Logger:     memongolog.New(nil, memongolog.LogLevelDebug),
+		ArchiveDir: "/vendor",
+	}
+
+	path, err := downloader.GetOrDownloadMongod(httpServer.URL + "/linux/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz")
+	require.NoError(t, err)
+
+	content, err := mongobin.Afs.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "vendored mongod", string(content))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+
+	// An archive that isn't vendored is downloaded as usual
+	_, err = downloader.GetOrDownloadMongod(httpServer.URL + "/linux/mongodb-linux-x86_64-ubuntu2204-7.0.0.tgz")
+	require.EqualError(t, err, "HTTP request failed with status code 404")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestGetOrDownloadLocalArchiveWindowsPath(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	// MemMapFs takes the whole path as a file name, so it stands in for a
+	// Windows filesystem
+	archivePath := `C:\archives\mongodb-windows-x86_64-6.0.4.zip`
+	require.NoError(t, mongobin.Afs.WriteFile(archivePath, makeZip(t, map[string]string{"mongodb/bin/mongod": "mongod"}), 0644))
+
+	downloader := &mongobin.Downloader{
+		CachePath: "/cache",
+		Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+	}
+
+	path, err := downloader.GetOrDownloadMongod(archivePath)
+	require.NoError(t, err)
+	assert.Regexp(t, `^/cache/mongodb-windows-x86_64-6_0_4_zip_[0-9a-f]{10}/mongod$`, path)
+
+	content, err := mongobin.Afs.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "mongod", string(content))
+}
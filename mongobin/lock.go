@@ -0,0 +1,281 @@
+package mongobin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/tryvium-travels/memongo/memongolog"
+)
+
+// Timings of the locks taken on cache entries while they're downloaded
+var (
+	// LockRefreshInterval is how often the holder of a lock refreshes it, to
+	// show it's still alive
+	LockRefreshInterval = 10 * time.Second
+
+	// LockStaleAge is how long a lock can go without being refreshed before
+	// it's considered to be left over by a killed process, and broken
+	LockStaleAge = 2 * time.Minute
+
+	// LockPollInterval is how often a process waiting for a lock checks
+	// whether it has been released
+	LockPollInterval = 250 * time.Millisecond
+)
+
+// lockDirName is the directory in the cache where lock files are kept
+const lockDirName = ".locks"
+
+// fileLock is a lock on a cache entry that's shared between processes.
+//
+// On the OS filesystem, it's an OS lock (flock or LockFileEx) on the lock
+// file, which the OS releases when the owner dies. On other filesystems, it's
+// held by creating the lock file, which holds the PID and host of the owner.
+// While the lock is held, the lock file's modification time is refreshed
+// periodically, so that a lock left behind by a killed process can be told
+// apart from one held by a slow download.
+type fileLock struct {
+	path  string
+	owner string
+	// file is the locked file, when the lock is an OS lock
+	file *os.File
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireFileLock blocks until it holds the lock at lockPath, or ctx is done
+func acquireFileLock(ctx context.Context, lockPath string, logger *memongolog.Logger) (*fileLock, error) {
+	loggedWait := false
+
+	for {
+		lock, lockErr := tryAcquireFileLock(lockPath, logger)
+		if lockErr != nil || lock != nil {
+			return lock, lockErr
+		}
+
+		if !loggedWait {
+			logger.Infof("waiting for another process to finish downloading (lock %s)", lockPath)
+			loggedWait = true
+		}
+		if sleepErr := sleepContext(ctx, LockPollInterval); sleepErr != nil {
+			return nil, sleepErr
+		}
+	}
+}
+
+// tryAcquireFileLock takes the lock at lockPath if it's free (or stale). It
+// returns a nil lock if the lock is held by someone else.
+func tryAcquireFileLock(lockPath string, logger *memongolog.Logger) (*fileLock, error) {
+	mkdirErr := Afs.MkdirAll(path.Dir(lockPath), 0755)
+	if mkdirErr != nil {
+		return nil, fmt.Errorf("error creating directory %s: %s", path.Dir(lockPath), mkdirErr)
+	}
+
+	if _, isOsFs := Afs.Fs.(*afero.OsFs); isOsFs {
+		return tryAcquireOSLock(lockPath)
+	}
+
+	owner := lockOwner()
+
+	for {
+		lockFile, createErr := Afs.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if createErr == nil {
+			_, writeErr := lockFile.WriteString(owner)
+			_ = lockFile.Close()
+			if writeErr != nil {
+				_ = Afs.Remove(lockPath)
+				return nil, fmt.Errorf("error writing lock file %s: %s", lockPath, writeErr)
+			}
+
+			lock := &fileLock{
+				path:  lockPath,
+				owner: owner,
+				stop:  make(chan struct{}),
+				done:  make(chan struct{}),
+			}
+			go lock.refresh()
+
+			return lock, nil
+		}
+		if !os.IsExist(createErr) {
+			return nil, fmt.Errorf("error creating lock file %s: %s", lockPath, createErr)
+		}
+
+		broken, breakErr := breakStaleLock(lockPath, logger)
+		if breakErr != nil || !broken {
+			return nil, breakErr
+		}
+	}
+}
+
+// tryAcquireOSLock takes an OS lock on the file at lockPath if nobody else
+// holds one. It returns a nil lock if someone else does.
+func tryAcquireOSLock(lockPath string) (*fileLock, error) {
+	for {
+		file, openErr := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if openErr != nil {
+			return nil, fmt.Errorf("error opening lock file %s: %s", lockPath, openErr)
+		}
+
+		locked, lockErr := lockFile(file)
+		if lockErr != nil || !locked {
+			_ = file.Close()
+			if lockErr != nil {
+				return nil, fmt.Errorf("error locking %s: %s", lockPath, lockErr)
+			}
+			return nil, nil
+		}
+
+		// The previous owner removes the file when it releases the lock. If
+		// it did so after we opened it, we locked a file nobody else will
+		// look at, so we have to try again.
+		fileInfo, fileStatErr := file.Stat()
+		pathInfo, pathStatErr := os.Stat(lockPath)
+		if fileStatErr != nil || pathStatErr != nil || !os.SameFile(fileInfo, pathInfo) {
+			_ = file.Close()
+			continue
+		}
+
+		// The owner is only written for people looking at the cache, the
+		// lock itself is the OS lock
+		owner := lockOwner()
+		_ = file.Truncate(0)
+		_, _ = file.WriteAt([]byte(owner), 0)
+
+		return &fileLock{path: lockPath, owner: owner, file: file}, nil
+	}
+}
+
+// breakStaleLock removes the lock file at lockPath if it was left behind by a
+// process that's no longer running. It returns whether it did.
+//
+// Several processes may find the same stale lock at once, and one of them
+// may take the lock before another one gets to removing it. So rather than
+// removing the lock file right away, it's first moved out of the way, and
+// only removed if it's still the stale lock. Otherwise it's put back.
+func breakStaleLock(lockPath string, logger *memongolog.Logger) (bool, error) {
+	staleOwner, readErr := Afs.ReadFile(lockPath)
+	if readErr != nil {
+		// It was probably just released, so try again right away
+		return os.IsNotExist(readErr), nil
+	}
+
+	stale, reason := isLockStale(lockPath)
+	if !stale {
+		return false, nil
+	}
+
+	movedPath := fmt.Sprintf("%s.stale-%d-%d", lockPath, os.Getpid(), time.Now().UnixNano())
+	if renameErr := Afs.Rename(lockPath, movedPath); renameErr != nil {
+		// Someone else got to it first
+		return os.IsNotExist(renameErr), nil
+	}
+
+	moved, readErr := Afs.ReadFile(movedPath)
+	if readErr != nil || string(moved) != string(staleOwner) {
+		// Someone else broke the stale lock and took it in the meantime
+		if restoreErr := Afs.Rename(movedPath, lockPath); restoreErr != nil {
+			return false, fmt.Errorf("error restoring lock file %s: %s", lockPath, restoreErr)
+		}
+		return false, nil
+	}
+
+	logger.Warnf("breaking stale lock %s: %s", lockPath, reason)
+	_ = Afs.Remove(movedPath)
+
+	return true, nil
+}
+
+// release releases the lock
+func (l *fileLock) release() error {
+	if l.file != nil {
+		// Remove the file while it's still locked, so nobody can lock it in
+		// between. Windows doesn't allow removing open files, so there it's
+		// left behind, which is harmless.
+		_ = os.Remove(l.path)
+		return l.file.Close()
+	}
+
+	close(l.stop)
+	<-l.done
+
+	// Make sure we don't remove a lock that was broken and taken over by
+	// another process
+	contents, readErr := Afs.ReadFile(l.path)
+	if readErr != nil || string(contents) != l.owner {
+		return fmt.Errorf("lock %s was taken over by another process", l.path)
+	}
+
+	return Afs.Remove(l.path)
+}
+
+func (l *fileLock) refresh() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(LockRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			_ = Afs.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+// lockOwner identifies this process in a lock file
+func lockOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%d\n%s\n", os.Getpid(), hostname)
+}
+
+// isLockStale returns whether the lock at lockPath was left behind by a
+// process that's no longer running, and why
+func isLockStale(lockPath string) (bool, string) {
+	info, statErr := Afs.Stat(lockPath)
+	if statErr != nil {
+		// It was probably just released
+		return false, ""
+	}
+
+	if age := time.Since(info.ModTime()); age > LockStaleAge {
+		return true, fmt.Sprintf("it hasn't been refreshed for %s", age.Round(time.Second))
+	}
+
+	return isOwnerGone(lockPath)
+}
+
+// isOwnerGone returns whether the process that wrote the owner file at
+// ownerPath (see lockOwner) is no longer running, and why. We can only tell
+// for processes on this host.
+func isOwnerGone(ownerPath string) (bool, string) {
+	contents, readErr := Afs.ReadFile(ownerPath)
+	if readErr != nil {
+		return false, ""
+	}
+
+	lines := strings.Split(string(contents), "\n")
+	if len(lines) < 2 {
+		// The owner may not have written to the file yet
+		return false, ""
+	}
+
+	pid, pidErr := strconv.Atoi(lines[0])
+	if pidErr != nil {
+		return false, ""
+	}
+
+	hostname, _ := os.Hostname()
+	if lines[1] == hostname && !processExists(pid) {
+		return true, fmt.Sprintf("its owner (PID %d) is no longer running", pid)
+	}
+
+	return false, ""
+}
@@ -0,0 +1,281 @@
+package mongobin_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// countingServer serves the given file and counts the requests it gets
+func countingServer(t *testing.T, content []byte) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		// Give concurrent callers a chance to pile up
+		time.Sleep(50 * time.Millisecond)
+		_, _ = w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func setFastLocks(t *testing.T) {
+	oldPollInterval := mongobin.LockPollInterval
+	mongobin.LockPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		mongobin.LockPollInterval = oldPollInterval
+	})
+}
+
+// deadPID returns the PID of a process that has exited
+func deadPID(t *testing.T) int {
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	return cmd.Process.Pid
+}
+
+func TestConcurrentDownloadsAreDeduplicated(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+	setFastLocks(t)
+
+	server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+
+	var wg sync.WaitGroup
+	paths := make([]string, 10)
+	errs := make([]error, 10)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			downloader := &mongobin.Downloader{
+				CachePath: "/cache",
+				Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+			}
+			paths[i], errs[i] = downloader.GetOrDownloadMongod(server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz")
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range paths {
+		require.NoError(t, errs[i])
+		assert.Equal(t, paths[0], paths[i])
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	// The lock is released once the download is done
+	locks, err := mongobin.Afs.ReadDir("/cache/.locks")
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+}
+
+func TestDownloadWaitsForLock(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+	setFastLocks(t)
+
+	server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+	archiveURL := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+	downloader := &mongobin.Downloader{
+		CachePath: "/cache",
+		Logger:    memongolog.New(nil, memongolog.LogLevelDebug),
+	}
+
+	// Find out where the cache entry lives, then start over with a clean cache
+	mongodPath, err := downloader.GetOrDownloadMongod(archiveURL)
+	require.NoError(t, err)
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	// Pretend another (live) process is downloading
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	lockPath := "/cache/.locks/" + path.Base(path.Dir(mongodPath)) + ".lock"
+	require.NoError(t, mongobin.Afs.WriteFile(lockPath, []byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), hostname)), 0644))
+
+	done := make(chan error)
+	go func() {
+		_, err := downloader.GetOrDownloadMongod(archiveURL)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("download finished while the lock was held: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The other process finishes its download and releases the lock
+	require.NoError(t, mongobin.Afs.WriteFile(mongodPath, []byte("mongod"), 0755))
+	require.NoError(t, mongobin.Afs.Remove(lockPath))
+
+	require.NoError(t, <-done)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+}
+
+func TestStaleLocksAreBroken(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		lockContents string
+		lockAge      time.Duration
+	}{
+		"dead owner": {
+			lockContents: fmt.Sprintf("%d\n%s\n", deadPID(t), hostname),
+		},
+		"not refreshed": {
+			lockContents: "1234\nsome-other-host\n",
+			lockAge:      time.Hour,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+			setFastLocks(t)
+
+			server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+			archiveURL := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+			downloader := &mongobin.Downloader{
+				CachePath: "/cache",
+				Logger:    memongolog.New(nil, memongolog.LogLevelDebug),
+			}
+
+			// Find out where the cache entry lives, then start over with a clean
+			// cache
+			mongodPath, err := downloader.GetOrDownloadMongod(archiveURL)
+			require.NoError(t, err)
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			lockPath := "/cache/.locks/" + path.Base(path.Dir(mongodPath)) + ".lock"
+			require.NoError(t, mongobin.Afs.WriteFile(lockPath, []byte(test.lockContents), 0644))
+			lockTime := time.Now().Add(-test.lockAge)
+			require.NoError(t, mongobin.Afs.Chtimes(lockPath, lockTime, lockTime))
+
+			_, err = downloader.GetOrDownloadMongod(archiveURL)
+			require.NoError(t, err)
+			assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+
+			exists, err := mongobin.Afs.Exists(lockPath)
+			require.NoError(t, err)
+			assert.False(t, exists)
+		})
+	}
+}
+
+func TestStaleLockIsBrokenOnce(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+	setFastLocks(t)
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+	archiveURL := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+	newDownloader := func() *mongobin.Downloader {
+		return &mongobin.Downloader{
+			CachePath: "/cache",
+			Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+		}
+	}
+
+	// Find out where the cache entry lives, then start over with a clean cache
+	mongodPath, err := newDownloader().GetOrDownloadMongod(archiveURL)
+	require.NoError(t, err)
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	lockPath := "/cache/.locks/" + path.Base(path.Dir(mongodPath)) + ".lock"
+	require.NoError(t, mongobin.Afs.WriteFile(lockPath, []byte(fmt.Sprintf("%d\n%s\n", deadPID(t), hostname)), 0644))
+
+	// Everyone finds the stale lock at once, but only one of them may break
+	// it and download
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = newDownloader().GetOrDownloadMongod(archiveURL)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+
+	locks, err := mongobin.Afs.ReadDir("/cache/.locks")
+	require.NoError(t, err)
+	assert.Empty(t, locks)
+}
+
+func TestOSLocks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binaries are shell scripts")
+	}
+
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+	setFastLocks(t)
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "#!/bin/sh\necho 'db version v6.0.4'\n"}))
+	archiveURL := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+	newDownloader := func(cachePath string) *mongobin.Downloader {
+		return &mongobin.Downloader{
+			CachePath: cachePath,
+			Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+		}
+	}
+
+	// Find out where the cache entry lives, then switch to a real cache
+	mongodPath, err := newDownloader("/cache").GetOrDownloadMongod(archiveURL)
+	require.NoError(t, err)
+
+	useOsFs(t)
+
+	// A lock file that names a live owner but isn't locked was left behind,
+	// and is ignored
+	cachePath := t.TempDir()
+	lockPath := path.Join(cachePath, ".locks", path.Base(path.Dir(mongodPath))+".lock")
+	require.NoError(t, os.MkdirAll(path.Dir(lockPath), 0755))
+	require.NoError(t, os.WriteFile(lockPath, []byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), hostname)), 0644))
+
+	// Concurrent downloads still wait for each other
+	var wg sync.WaitGroup
+	paths := make([]string, 10)
+	errs := make([]error, 10)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = newDownloader(cachePath).GetOrDownloadMongod(archiveURL)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range paths {
+		require.NoError(t, errs[i])
+		assert.Equal(t, paths[0], paths[i])
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+}
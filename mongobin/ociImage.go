@@ -0,0 +1,760 @@
+package mongobin
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultImageBinaryPath is where mongod is in the official mongo image
+const DefaultImageBinaryPath = "usr/bin/mongod"
+
+// tagDirName is the directory in the cache where the digests that image tags
+// pointed to are recorded
+const tagDirName = ".tags"
+
+// opaqueWhiteout marks a directory whose contents in lower layers were
+// deleted
+const opaqueWhiteout = ".wh..wh..opq"
+
+// imageLibraryDirs are the directories shared libraries are looked up in,
+// within an image
+var imageLibraryDirs = []string{"lib/", "lib64/", "usr/lib/", "usr/lib64/", "usr/local/lib/"}
+
+// OCIImageProvider is a BinaryProvider that pulls mongod, and the shared
+// libraries it needs, out of a container image in an OCI registry (like the
+// official mongo image on Docker Hub), without a container runtime. It's
+// for systems MongoDB doesn't publish an archive for, like Alpine.
+//
+// The binary is run with the dynamic loader from the image, so it doesn't
+// depend on the libraries installed on the system.
+type OCIImageProvider struct {
+	// Downloader downloads the image's layers. Its CachePath, HTTPClient,
+	// Headers and Logger are used.
+	Downloader *Downloader
+
+	// Image is the image reference, e.g. "mongo:7.0.2" or
+	// "registry.example.com/mongo@sha256:...". Pin a digest to make sure
+	// the image can't change under you. Images without a registry are
+	// pulled from Docker Hub. Defaults to "mongo:<version>".
+	Image string
+
+	// Username and Password are the registry credentials. Without them, an
+	// anonymous token is asked for if the registry wants one.
+	Username string
+	Password string
+
+	// Arch is the CPU architecture to pull the image for, as GOARCH names
+	// it. Defaults to runtime.GOARCH.
+	Arch string
+
+	// BinaryPath is the path of mongod in the image. Defaults to
+	// DefaultImageBinaryPath.
+	BinaryPath string
+}
+
+// Resolve pulls the image, or finds it in the cache
+func (p *OCIImageProvider) Resolve(ctx context.Context, version string) (*BinaryPaths, error) {
+	image := p.Image
+	if image == "" {
+		if version == "" {
+			return nil, errors.New("an image or a MongoDB version is needed to pull mongod from an image")
+		}
+		image = "mongo:" + version
+	}
+
+	ref, refErr := parseImageReference(image)
+	if refErr != nil {
+		return nil, refErr
+	}
+
+	registry := &registryClient{
+		client:   p.Downloader.httpClient(),
+		ref:      ref,
+		headers:  p.Downloader.Headers,
+		username: p.Username,
+		password: p.Password,
+	}
+
+	// Images pinned to a digest can be found in the cache without asking
+	// the registry
+	digest := ref.Digest
+	var manifest *ociManifest
+	if digest == "" {
+		var tagErr error
+		digest, manifest, tagErr = p.resolveTag(ctx, registry)
+		if tagErr != nil {
+			return nil, tagErr
+		}
+	}
+
+	dirname := p.directoryName(ref, digest)
+	dirPath := path.Join(p.Downloader.CachePath, dirname)
+	binPath := path.Join(dirPath, "mongod")
+
+	if found, verifyErr := p.verifyCacheEntry(dirPath); verifyErr != nil {
+		return nil, verifyErr
+	} else if !found {
+		pullErr := p.lockAndPull(ctx, registry, manifest, digest, dirname)
+		if pullErr != nil {
+			return nil, pullErr
+		}
+	} else {
+		p.Downloader.logger().Debugf("mongod from %s exists in cache at %s", ref, dirPath)
+		if touchErr := touchCacheEntry(dirPath); touchErr != nil {
+			p.Downloader.logger().Debugf("error recording use of cache entry %s: %s", dirPath, touchErr)
+		}
+	}
+
+	if ref.Digest == "" {
+		p.recordTag(ref, digest)
+	}
+
+	cache := &Cache{
+		Path:   p.Downloader.CachePath,
+		Logger: p.Downloader.Logger,
+	}
+	marker, markErr := cache.MarkInUse(binPath)
+	if markErr != nil {
+		return nil, fmt.Errorf("error marking %s as in use: %s", binPath, markErr)
+	}
+
+	return &BinaryPaths{Mongod: binPath, Release: marker.Release}, nil
+}
+
+// resolveTag returns the digest the image's tag points to, and the manifest
+// if it had to be fetched to find out. If the registry can't be reached, the
+// digest the tag pointed to last time is used, as long as that image is
+// still in the cache.
+func (p *OCIImageProvider) resolveTag(ctx context.Context, registry *registryClient) (string, *ociManifest, error) {
+	ref := registry.ref
+
+	digest, resolveErr := registry.resolveTag(ctx, ref.Tag)
+	if resolveErr == nil && digest != "" {
+		return digest, nil, nil
+	}
+	if resolveErr == nil {
+		// Not every registry sends the digest in reply to a HEAD request
+		var manifest *ociManifest
+		manifest, digest, resolveErr = registry.fetchManifest(ctx, ref.Tag)
+		if resolveErr == nil {
+			return digest, manifest, nil
+		}
+	}
+	if ctx.Err() != nil {
+		return "", nil, resolveErr
+	}
+
+	recorded, readErr := Afs.ReadFile(p.tagPath(ref))
+	cachedDigest := strings.TrimSpace(string(recorded))
+	if readErr != nil || !digestRegex.MatchString(cachedDigest) {
+		return "", nil, resolveErr
+	}
+	if _, metadataErr := readCacheMetadata(path.Join(p.Downloader.CachePath, p.directoryName(ref, cachedDigest))); metadataErr != nil {
+		return "", nil, resolveErr
+	}
+
+	p.Downloader.logger().Warnf("%s; using the cached image %s pointed to before, %s", resolveErr, ref, cachedDigest)
+	return cachedDigest, nil, nil
+}
+
+// tagPath is where the digest the image's tag last pointed to is recorded
+func (p *OCIImageProvider) tagPath(ref *imageReference) string {
+	shasum := sha256.Sum256([]byte(ref.Registry + "/" + ref.Repository + ":" + ref.Tag))
+
+	return path.Join(p.Downloader.CachePath, tagDirName, fmt.Sprintf("%s_%s", sanitizeFilename(path.Base(ref.Repository)), hex.EncodeToString(shasum[:])[0:10]))
+}
+
+// recordTag records the digest the image's tag points to, so the image can be
+// found in the cache when the registry can't be reached
+func (p *OCIImageProvider) recordTag(ref *imageReference, digest string) {
+	tagPath := p.tagPath(ref)
+	if mkdirErr := Afs.MkdirAll(path.Dir(tagPath), 0755); mkdirErr != nil {
+		p.Downloader.logger().Debugf("error recording the digest of %s: %s", ref, mkdirErr)
+		return
+	}
+	if writeErr := Afs.WriteFile(tagPath, []byte(digest), 0644); writeErr != nil {
+		p.Downloader.logger().Debugf("error recording the digest of %s: %s", ref, writeErr)
+	}
+}
+
+// directoryName names the cache entry for the image with the given digest,
+// e.g. mongo_<hash>. The digest is of the manifest, or of the index of
+// manifests for every platform, so the arch is part of the hash too. The tag
+// isn't, so the entry is shared with references pinned to the digest.
+func (p *OCIImageProvider) directoryName(ref *imageReference, digest string) string {
+	shasum := sha256.Sum256([]byte(ref.Registry + "/" + ref.Repository + "@" + digest + "|" + p.arch() + "|" + p.binaryPath()))
+
+	return fmt.Sprintf("%s_%s", sanitizeFilename(path.Base(ref.Repository)), hex.EncodeToString(shasum[:])[0:10])
+}
+
+// verifyCacheEntry returns whether the cache entry holds every file in its
+// metadata. A corrupt entry is quarantined, so it's pulled again.
+func (p *OCIImageProvider) verifyCacheEntry(dirPath string) (bool, error) {
+	metadata, readErr := readCacheMetadata(dirPath)
+	if readErr != nil {
+		return false, nil
+	}
+
+	paths := map[string]string{}
+	for name := range metadata.Binaries {
+		paths[name] = path.Join(dirPath, name)
+	}
+
+	missing, verifyErr := p.Downloader.verifyCacheEntry(dirPath, paths, false)
+	corruptErr := &CorruptCacheEntryError{}
+	if errors.As(verifyErr, &corruptErr) {
+		quarantinePath, quarantineErr := quarantineCacheEntry(p.Downloader.CachePath, path.Base(dirPath))
+		if quarantineErr != nil {
+			return false, quarantineErr
+		}
+		p.Downloader.logger().Warnf("%s; moved the cache entry to %s and pulling it again", verifyErr, quarantinePath)
+		return false, nil
+	}
+	if verifyErr != nil {
+		return false, fmt.Errorf("error while checking for mongod in cache: %s", verifyErr)
+	}
+
+	return len(missing) == 0 && len(paths) > 0, nil
+}
+
+// lockAndPull pulls the image into the cache entry named dirname, while
+// holding the lock on that cache entry
+func (p *OCIImageProvider) lockAndPull(ctx context.Context, registry *registryClient, manifest *ociManifest, digest string, dirname string) error {
+	logger := p.Downloader.logger()
+	cachePath := p.Downloader.CachePath
+	dirPath := path.Join(cachePath, dirname)
+
+	lock, lockErr := acquireFileLock(ctx, path.Join(cachePath, lockDirName, dirname+".lock"), logger)
+	if lockErr != nil {
+		return lockErr
+	}
+	defer func() {
+		if releaseErr := lock.release(); releaseErr != nil {
+			logger.Warnf("error releasing lock: %s", releaseErr)
+		}
+	}()
+
+	// Another process may have pulled the image while we were waiting for
+	// the lock
+	if found, verifyErr := p.verifyCacheEntry(dirPath); verifyErr != nil || found {
+		return verifyErr
+	}
+
+	logger.Infof("mongod from %s does not exist in cache, pulling it to %s", registry.ref, dirPath)
+	pullStartTime := time.Now()
+
+	if manifest == nil {
+		var fetchErr error
+		manifest, _, fetchErr = registry.fetchManifest(ctx, digest)
+		if fetchErr != nil {
+			return fetchErr
+		}
+	}
+
+	layers, layersErr := p.platformLayers(ctx, registry, manifest)
+	if layersErr != nil {
+		return layersErr
+	}
+
+	layerPaths, downloadErr := p.downloadLayers(ctx, registry, layers, dirname)
+	defer func() {
+		for _, layerPath := range layerPaths {
+			_ = Afs.Remove(layerPath)
+		}
+	}()
+	if downloadErr != nil {
+		return downloadErr
+	}
+
+	extracted, extractErr := p.extract(layers, layerPaths, dirPath)
+	if extractErr != nil {
+		return fmt.Errorf("error extracting mongod from %s: %w", registry.ref, extractErr)
+	}
+
+	extracted.SourceURL = registry.ref.String()
+	if registry.ref.Digest == "" {
+		extracted.SourceURL += "@" + digest
+	}
+	extracted.ArchiveSHA256 = strings.TrimPrefix(digest, "sha256:")
+
+	version, checkErr := p.Downloader.checkBinary(ctx, path.Join(dirPath, "mongod"), "")
+	if checkErr != nil {
+		_ = Afs.RemoveAll(dirPath)
+		return checkErr
+	}
+	extracted.Version = version
+	extracted.ExtractedAt = time.Now()
+	extracted.LastUsedAt = extracted.ExtractedAt
+	if writeErr := writeCacheMetadata(dirPath, extracted); writeErr != nil {
+		return writeErr
+	}
+
+	logger.Infof("finished pulling mongod from %s to %s in %s", registry.ref, dirPath, time.Since(pullStartTime).String())
+
+	return nil
+}
+
+// platformLayers returns the layers of the image for linux and the arch. If
+// the manifest is an index, the manifest for the platform is fetched.
+func (p *OCIImageProvider) platformLayers(ctx context.Context, registry *registryClient, manifest *ociManifest) ([]ociDescriptor, error) {
+	if len(manifest.Manifests) == 0 {
+		if len(manifest.Layers) == 0 {
+			return nil, fmt.Errorf("image %s has no layers", registry.ref)
+		}
+		return manifest.Layers, nil
+	}
+
+	var platforms []string
+	for _, descriptor := range manifest.Manifests {
+		if descriptor.Platform == nil {
+			continue
+		}
+		if descriptor.Platform.OS == "linux" && descriptor.Platform.Architecture == p.arch() {
+			platformManifest, _, fetchErr := registry.fetchManifest(ctx, descriptor.Digest)
+			if fetchErr != nil {
+				return nil, fetchErr
+			}
+			return p.platformLayers(ctx, registry, platformManifest)
+		}
+		platforms = append(platforms, descriptor.Platform.OS+"/"+descriptor.Platform.Architecture)
+	}
+
+	return nil, fmt.Errorf("image %s is not published for linux/%s, only for %s", registry.ref, p.arch(), strings.Join(platforms, ", "))
+}
+
+// downloadLayers downloads each layer into the cache's partial directory,
+// and checks it against its digest. It returns the paths to the layers it
+// downloaded, even if it fails, so they can be removed.
+func (p *OCIImageProvider) downloadLayers(ctx context.Context, registry *registryClient, layers []ociDescriptor, dirname string) ([]string, error) {
+	partialDir := path.Join(p.Downloader.CachePath, partialDirName)
+	if mkdirErr := Afs.MkdirAll(partialDir, 0755); mkdirErr != nil {
+		return nil, fmt.Errorf("error creating directory %s: %s", partialDir, mkdirErr)
+	}
+
+	// The registry's token is only good for the registry, so it's only sent
+	// along with the layer requests, which may be redirected elsewhere
+	downloader := *p.Downloader
+	downloader.Headers = registry.blobHeaders()
+
+	var layerPaths []string
+	for i, layer := range layers {
+		if !digestRegex.MatchString(layer.Digest) {
+			return layerPaths, fmt.Errorf("layer %d of %s has an unsupported digest %q", i, registry.ref, layer.Digest)
+		}
+
+		layerPath := path.Join(partialDir, fmt.Sprintf("%s_layer%d.partial", dirname, i))
+		layerPaths = append(layerPaths, layerPath)
+
+		p.Downloader.logger().Debugf("downloading layer %d/%d of %s (%d bytes)", i+1, len(layers), registry.ref, layer.Size)
+		if downloadErr := downloader.downloadArchive(ctx, registry.blobURL(layer.Digest), layerPath); downloadErr != nil {
+			return layerPaths, fmt.Errorf("error downloading layer %s of %s: %w", layer.Digest, registry.ref, downloadErr)
+		}
+
+		sha, _, hashErr := hashFile(layerPath)
+		if hashErr != nil {
+			return layerPaths, hashErr
+		}
+		if "sha256:"+sha != layer.Digest {
+			return layerPaths, fmt.Errorf("layer %s of %s has digest sha256:%s; the registry may have been tampered with", layer.Digest, registry.ref, sha)
+		}
+	}
+
+	return layerPaths, nil
+}
+
+// extract extracts mongod into dirPath/bin, and the shared libraries it
+// needs (and the ones they need) into dirPath/lib, then writes a mongod
+// wrapper into dirPath that runs it with those libraries.
+//
+// Which libraries are needed is only known once a binary is extracted, so
+// the layers are walked again until no more are needed.
+func (p *OCIImageProvider) extract(layers []ociDescriptor, layerPaths []string, dirPath string) (*CacheMetadata, error) {
+	logger := p.Downloader.logger()
+	binaryPath := p.binaryPath()
+
+	metadata := &CacheMetadata{Binaries: map[string]BinaryMetadata{}}
+
+	// wanted maps the names of the libraries to extract to whether they've
+	// been extracted. aliases maps the targets of symlinked libraries to the
+	// names of the symlinks.
+	wanted := map[string]bool{}
+	aliases := map[string][]string{}
+	interpreter := ""
+
+	// sources maps the extracted files to where in the image they came from,
+	// and links maps the links in the image to their targets, so that files
+	// deleted by later layers can be deleted too
+	sources := map[string]imagePath{}
+	links := map[string]imagePath{}
+
+	var toInspect []string
+	for pass := 1; pass == 1 || len(toInspect) > 0; pass++ {
+		if pass > 1 {
+			logger.Debugf("looking for shared libraries %s", strings.Join(toInspect, ", "))
+		}
+		newNames := map[string]bool{}
+
+		for i, layerPath := range layerPaths {
+			walkErr := walkLayer(layers[i].MediaType, layerPath, func(header *tar.Header, contents io.Reader) error {
+				name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+				dir, base := path.Split(name)
+
+				if strings.HasPrefix(base, ".wh.") {
+					deleted := path.Join(dir, strings.TrimPrefix(base, ".wh."))
+					if base == opaqueWhiteout {
+						deleted = path.Clean(dir)
+					}
+					return removeWhitedOut(dirPath, deleted, i, sources, links, wanted, metadata)
+				}
+
+				switch header.Typeflag {
+				case tar.TypeSymlink:
+					target := header.Linkname
+					if !path.IsAbs(target) {
+						target = path.Join(dir, target)
+					}
+					links[name] = imagePath{path: strings.TrimPrefix(path.Clean("/"+target), "/"), layer: i}
+				case tar.TypeLink:
+					// Hard links are relative to the root of the image
+					links[name] = imagePath{path: strings.TrimPrefix(path.Clean("/"+header.Linkname), "/"), layer: i}
+				default:
+					delete(links, name)
+				}
+
+				var destPath string
+				switch {
+				case name == binaryPath && pass == 1:
+					destPath = "bin/mongod"
+				case inLibraryDir(dir) && contains(toInspect, base):
+					destPath = "lib/" + base
+				default:
+					return nil
+				}
+
+				switch header.Typeflag {
+				case tar.TypeReg:
+					binMetadata, saveErr := saveFile(path.Join(dirPath, destPath), contents, logger)
+					if saveErr != nil {
+						return saveErr
+					}
+					metadata.Binaries[destPath] = binMetadata
+					sources[destPath] = imagePath{path: name, layer: i}
+					if strings.HasPrefix(destPath, "lib/") {
+						wanted[base] = true
+					}
+				case tar.TypeSymlink, tar.TypeLink:
+					// Extract the target under this name too
+					target := path.Base(header.Linkname)
+					if target != base && strings.HasPrefix(destPath, "lib/") && !contains(aliases[target], base) {
+						aliases[target] = append(aliases[target], base)
+						if _, ok := wanted[target]; !ok {
+							wanted[target] = false
+							newNames[target] = true
+						}
+					}
+				}
+				return nil
+			})
+			if walkErr != nil {
+				return nil, fmt.Errorf("error reading layer %s: %w", layers[i].Digest, walkErr)
+			}
+		}
+
+		if pass == 1 {
+			if _, ok := metadata.Binaries["bin/mongod"]; !ok {
+				// mongod may be a link to where it really is in the image
+				resolved, resolveErr := resolveImageLinks(links, binaryPath)
+				if resolveErr != nil {
+					return nil, resolveErr
+				}
+				if resolved == binaryPath {
+					return nil, fmt.Errorf("did not find %s in the image", p.binaryPath())
+				}
+				logger.Debugf("%s links to %s in the image", binaryPath, resolved)
+				binaryPath = resolved
+				pass = 0
+				continue
+			}
+		}
+
+		// Find the libraries the binaries we just extracted need
+		var inspect []string
+		if pass == 1 {
+			inspect = []string{"bin/mongod"}
+		}
+		for _, name := range toInspect {
+			if wanted[name] {
+				inspect = append(inspect, "lib/"+name)
+			}
+		}
+		for _, name := range inspect {
+			binInterpreter, needed, elfErr := elfDependencies(path.Join(dirPath, name))
+			if elfErr != nil {
+				logger.Debugf("not looking for the shared libraries %s needs: %s", name, elfErr)
+				continue
+			}
+			if name == "bin/mongod" && binInterpreter != "" {
+				interpreter = path.Base(binInterpreter)
+				needed = append(needed, interpreter)
+			}
+			for _, library := range needed {
+				if _, ok := wanted[library]; !ok {
+					wanted[library] = false
+					newNames[library] = true
+				}
+			}
+		}
+
+		toInspect = make([]string, 0, len(newNames))
+		for name := range newNames {
+			toInspect = append(toInspect, name)
+		}
+		sort.Strings(toInspect)
+	}
+
+	if copyErr := copyLibraryAliases(dirPath, aliases, wanted, metadata); copyErr != nil {
+		return nil, copyErr
+	}
+
+	var missing []string
+	for name, found := range wanted {
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		logger.Warnf("did not find shared libraries %s in the image; mongod may not run without them", strings.Join(missing, ", "))
+	}
+	if interpreter != "" && !wanted[interpreter] {
+		interpreter = ""
+	}
+
+	wrapperMetadata, wrapperErr := saveFile(path.Join(dirPath, "mongod"), strings.NewReader(imageWrapperScript(interpreter)), logger)
+	if wrapperErr != nil {
+		return nil, wrapperErr
+	}
+	metadata.Binaries["mongod"] = wrapperMetadata
+
+	return metadata, nil
+}
+
+// copyLibraryAliases copies extracted libraries to the names of the symlinks
+// that pointed to them, e.g. libcurl.so.4.8.0 to libcurl.so.4
+func copyLibraryAliases(dirPath string, aliases map[string][]string, wanted map[string]bool, metadata *CacheMetadata) error {
+	for progress := true; progress; {
+		progress = false
+		for target, names := range aliases {
+			if !wanted[target] {
+				continue
+			}
+			for _, name := range names {
+				if wanted[name] {
+					continue
+				}
+
+				contents, readErr := Afs.ReadFile(path.Join(dirPath, "lib", target))
+				if readErr != nil {
+					return fmt.Errorf("error copying %s to %s: %s", target, name, readErr)
+				}
+				if writeErr := Afs.WriteFile(path.Join(dirPath, "lib", name), contents, 0755); writeErr != nil {
+					return fmt.Errorf("error copying %s to %s: %s", target, name, writeErr)
+				}
+				metadata.Binaries["lib/"+name] = metadata.Binaries["lib/"+target]
+				wanted[name] = true
+				progress = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// imageWrapperScript returns a script that runs the extracted mongod with
+// the extracted libraries. With the image's dynamic loader, the system's
+// libraries aren't used at all, so a glibc build runs on a musl system.
+func imageWrapperScript(interpreter string) string {
+	script := "#!/bin/sh\n" +
+		"# Runs mongod extracted from a container image by memongo\n" +
+		"dir=$(dirname \"$0\")\n"
+	if interpreter != "" {
+		return script + "exec \"$dir/lib/" + interpreter + "\" --library-path \"$dir/lib\" \"$dir/bin/mongod\" \"$@\"\n"
+	}
+	return script + "LD_LIBRARY_PATH=\"$dir/lib${LD_LIBRARY_PATH:+:$LD_LIBRARY_PATH}\" exec \"$dir/bin/mongod\" \"$@\"\n"
+}
+
+// elfDependencies returns the dynamic loader an ELF binary asks for, and the
+// shared libraries it needs
+func elfDependencies(binPath string) (string, []string, error) {
+	file, openErr := Afs.Open(binPath)
+	if openErr != nil {
+		return "", nil, openErr
+	}
+	defer file.Close()
+
+	elfFile, elfErr := elf.NewFile(file)
+	if elfErr != nil {
+		return "", nil, elfErr
+	}
+	defer elfFile.Close()
+
+	interpreter := ""
+	for _, prog := range elfFile.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+		contents, readErr := io.ReadAll(prog.Open())
+		if readErr != nil {
+			return "", nil, readErr
+		}
+		interpreter = strings.TrimRight(string(contents), "\x00")
+	}
+
+	needed, importErr := elfFile.ImportedLibraries()
+	if importErr != nil {
+		return "", nil, importErr
+	}
+
+	return interpreter, needed, nil
+}
+
+// walkLayer calls fn with each entry of a layer, in order
+func walkLayer(mediaType string, layerPath string, fn func(header *tar.Header, contents io.Reader) error) error {
+	layerFile, openErr := Afs.Open(layerPath)
+	if openErr != nil {
+		return openErr
+	}
+	defer layerFile.Close()
+
+	var r io.Reader = layerFile
+	switch {
+	case strings.HasSuffix(mediaType, "gzip"):
+		gzReader, gzErr := gzip.NewReader(layerFile)
+		if gzErr != nil {
+			return fmt.Errorf("error initializing gzip reader: %w", gzErr)
+		}
+		defer gzReader.Close()
+		r = gzReader
+	case strings.HasSuffix(mediaType, ".tar"):
+	default:
+		return fmt.Errorf("unsupported layer media type %q", mediaType)
+	}
+
+	tarReader := tar.NewReader(r)
+	for {
+		header, tarErr := tarReader.Next()
+		if tarErr == io.EOF {
+			return nil
+		}
+		if tarErr != nil {
+			return fmt.Errorf("error reading from tar: %s", tarErr)
+		}
+
+		if fnErr := fn(header, tarReader); fnErr != nil {
+			return fnErr
+		}
+	}
+}
+
+// imagePath is a path in the image, and the layer it comes from
+type imagePath struct {
+	path  string
+	layer int
+}
+
+// removeWhitedOut removes the extracted files, and forgets the links, that
+// layers below layer put at deleted or in it
+func removeWhitedOut(dirPath string, deleted string, layer int, sources map[string]imagePath, links map[string]imagePath, wanted map[string]bool, metadata *CacheMetadata) error {
+	under := func(name string) bool {
+		return deleted == "." || name == deleted || strings.HasPrefix(name, deleted+"/")
+	}
+
+	for destPath, source := range sources {
+		if source.layer >= layer || !under(source.path) {
+			continue
+		}
+		if removeErr := removeExtracted(dirPath, destPath, metadata); removeErr != nil {
+			return removeErr
+		}
+		delete(sources, destPath)
+		if strings.HasPrefix(destPath, "lib/") {
+			wanted[path.Base(destPath)] = false
+		}
+	}
+
+	for name, target := range links {
+		if target.layer < layer && under(name) {
+			delete(links, name)
+		}
+	}
+
+	return nil
+}
+
+// resolveImageLinks follows the links in the image that name, or any of its
+// parent directories, goes through, without leaving the image
+func resolveImageLinks(links map[string]imagePath, name string) (string, error) {
+	for hops := 0; hops < 40; hops++ {
+		parts := strings.Split(name, "/")
+		followed := false
+		for i := range parts {
+			target, ok := links[strings.Join(parts[:i+1], "/")]
+			if !ok {
+				continue
+			}
+			name = strings.TrimPrefix(path.Clean("/"+path.Join(append([]string{target.path}, parts[i+1:]...)...)), "/")
+			followed = true
+			break
+		}
+		if !followed {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("too many links to follow to %s in the image", name)
+}
+
+// removeExtracted removes a file a later layer deleted, if it was extracted
+func removeExtracted(dirPath string, name string, metadata *CacheMetadata) error {
+	delete(metadata.Binaries, name)
+	if removeErr := Afs.Remove(path.Join(dirPath, name)); removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	return nil
+}
+
+func inLibraryDir(dir string) bool {
+	for _, libraryDir := range imageLibraryDirs {
+		if strings.HasPrefix(dir, libraryDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *OCIImageProvider) arch() string {
+	if p.Arch == "" {
+		return runtime.GOARCH
+	}
+	return p.Arch
+}
+
+func (p *OCIImageProvider) binaryPath() string {
+	if p.BinaryPath == "" {
+		return DefaultImageBinaryPath
+	}
+	return strings.TrimPrefix(path.Clean("/"+p.BinaryPath), "/")
+}
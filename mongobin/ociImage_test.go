@@ -0,0 +1,571 @@
+package mongobin_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// layerEntry is a file or symlink in an image layer
+type layerEntry struct {
+	name     string
+	content  string
+	linkname string
+}
+
+// makeLayer makes a gzipped tar layer holding the entries, in order
+func makeLayer(t *testing.T, entries ...layerEntry) []byte {
+	var buf bytes.Buffer
+	gzWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzWriter)
+
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0755, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}
+		if entry.linkname != "" {
+			header = &tar.Header{Name: entry.name, Mode: 0777, Linkname: entry.linkname, Typeflag: tar.TypeSymlink}
+		}
+		require.NoError(t, tarWriter.WriteHeader(header))
+		_, err := tarWriter.Write([]byte(entry.content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tarWriter.Close())
+	require.NoError(t, gzWriter.Close())
+
+	return buf.Bytes()
+}
+
+func sha256Digest(content []byte) string {
+	shasum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(shasum[:])
+}
+
+// testRegistry is a stand-in for an OCI registry serving one repository
+type testRegistry struct {
+	server *httptest.Server
+
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	requests  []string
+
+	// If set, clients need a token, which is given out for these
+	// credentials
+	username string
+	password string
+
+	// If set, clients need these credentials with basic auth
+	basicAuth bool
+
+	// If set, manifests are served without their digest in the
+	// Docker-Content-Digest header
+	omitDigestHeader bool
+}
+
+func newTestRegistry(t *testing.T) *testRegistry {
+	registry := &testRegistry{
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+	}
+	registry.server = httptest.NewTLSServer(http.HandlerFunc(registry.serveHTTP))
+	t.Cleanup(registry.server.Close)
+
+	return registry
+}
+
+func (r *testRegistry) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+
+	if req.URL.Path == "/token" {
+		username, password, _ := req.BasicAuth()
+		if username != r.username || password != r.password || req.URL.Query().Get("scope") != "repository:team/mongo:pull" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "letmein"})
+		return
+	}
+
+	switch {
+	case r.basicAuth:
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	case r.username != "":
+		if req.Header.Get("Authorization") != "Bearer letmein" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+r.server.URL+`/token",service="test",scope="repository:team/mongo:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if reference := strings.TrimPrefix(req.URL.Path, "/v2/team/mongo/manifests/"); reference != req.URL.Path {
+		manifest, ok := r.manifests[reference]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !r.omitDigestHeader {
+			w.Header().Set("Docker-Content-Digest", sha256Digest(manifest))
+		}
+		_, _ = w.Write(manifest)
+		return
+	}
+	if digest := strings.TrimPrefix(req.URL.Path, "/v2/team/mongo/blobs/"); digest != req.URL.Path {
+		blob, ok := r.blobs[digest]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(blob)
+		return
+	}
+
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// pushImage adds an image with the given layers for each arch, behind an
+// index tagged with tag. It returns the digest of the index.
+func (r *testRegistry) pushImage(t *testing.T, tag string, layersByArch map[string][][]byte) string {
+	index := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+	}
+	var manifests []map[string]interface{}
+	for arch, layers := range layersByArch {
+		manifestDigest := r.pushManifest(t, "", layers)
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    manifestDigest,
+			"platform":  map[string]string{"os": "linux", "architecture": arch},
+		})
+	}
+	index["manifests"] = manifests
+
+	contents, err := json.Marshal(index)
+	require.NoError(t, err)
+
+	return r.pushRaw(tag, contents)
+}
+
+// pushManifest adds an image manifest with the given layers, tagged with tag
+// if it's not empty. It returns the digest of the manifest.
+func (r *testRegistry) pushManifest(t *testing.T, tag string, layers [][]byte) string {
+	var descriptors []map[string]interface{}
+	for _, layer := range layers {
+		digest := sha256Digest(layer)
+		r.mu.Lock()
+		r.blobs[digest] = layer
+		r.mu.Unlock()
+
+		descriptors = append(descriptors, map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+			"digest":    digest,
+			"size":      len(layer),
+		})
+	}
+
+	contents, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"layers":        descriptors,
+	})
+	require.NoError(t, err)
+
+	return r.pushRaw(tag, contents)
+}
+
+func (r *testRegistry) pushRaw(tag string, contents []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	digest := sha256Digest(contents)
+	r.manifests[digest] = contents
+	if tag != "" {
+		r.manifests[tag] = contents
+	}
+
+	return digest
+}
+
+func (r *testRegistry) image(reference string) string {
+	return r.server.Listener.Addr().String() + "/team/mongo" + reference
+}
+
+func (r *testRegistry) requestCount(pathPart string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := 0
+	for _, requestPath := range r.requests {
+		if strings.Contains(requestPath, pathPart) {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *testRegistry) provider(image string) *mongobin.OCIImageProvider {
+	return &mongobin.OCIImageProvider{
+		Downloader: &mongobin.Downloader{
+			CachePath:  "/cache",
+			HTTPClient: r.server.Client(),
+			Logger:     memongolog.New(nil, memongolog.LogLevelSilent),
+		},
+		Image: image,
+		Arch:  "arm64",
+	}
+}
+
+func TestOCIImageProvider(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	registry := newTestRegistry(t)
+	registry.username = "user"
+	registry.password = "hunter2"
+	indexDigest := registry.pushImage(t, "7.0.2", map[string][][]byte{
+		"amd64": {makeLayer(t, layerEntry{name: "usr/bin/mongod", content: "amd64 mongod"})},
+		"arm64": {
+			makeLayer(t, layerEntry{name: "usr/bin/mongod", content: "old mongod"}),
+			makeLayer(t, layerEntry{name: "./usr/bin/mongod", content: "arm64 mongod"}, layerEntry{name: "usr/bin/mongos", content: "mongos"}),
+		},
+	})
+
+	provider := registry.provider(registry.image(":7.0.2"))
+	provider.Username = "user"
+	provider.Password = "hunter2"
+
+	paths, err := provider.Resolve(context.Background(), "")
+	require.NoError(t, err)
+
+	// The last layer wins
+	contents, err := mongobin.Afs.ReadFile(path.Join(path.Dir(paths.Mongod), "bin", "mongod"))
+	require.NoError(t, err)
+	assert.Equal(t, "arm64 mongod", string(contents))
+
+	wrapper, err := mongobin.Afs.ReadFile(paths.Mongod)
+	require.NoError(t, err)
+	assert.Contains(t, string(wrapper), `exec "$dir/bin/mongod" "$@"`)
+
+	entries, err := newTestCache().List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, registry.image(":7.0.2")+"@"+indexDigest, entries[0].SourceURL)
+	assert.Regexp(t, `^mongo_[0-9a-f]{10}$`, entries[0].Name)
+	require.NoError(t, paths.Release())
+
+	// A tagged image is looked up again, but its layers come from the cache
+	blobRequests := registry.requestCount("/blobs/")
+	cachedPaths, err := provider.Resolve(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, paths.Mongod, cachedPaths.Mongod)
+	assert.Equal(t, blobRequests, registry.requestCount("/blobs/"))
+	require.NoError(t, cachedPaths.Release())
+
+	// Images pinned to a digest come from the cache without the registry
+	requests := registry.requestCount("/")
+	pinned := registry.provider(registry.image("@" + indexDigest))
+	pinnedPaths, err := pinned.Resolve(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, paths.Mongod, pinnedPaths.Mongod)
+	assert.Equal(t, requests, registry.requestCount("/"))
+	require.NoError(t, pinnedPaths.Release())
+}
+
+func TestOCIImageProviderTags(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	registry := newTestRegistry(t)
+	registry.pushImage(t, "7.0.2", map[string][][]byte{
+		"arm64": {makeLayer(t, layerEntry{name: "usr/bin/mongod", content: "arm64 mongod"})},
+	})
+	provider := registry.provider(registry.image(":7.0.2"))
+
+	paths, err := provider.Resolve(context.Background(), "")
+	require.NoError(t, err)
+	require.NoError(t, paths.Release())
+
+	// Once the image is cached, the tag is resolved without downloading its
+	// manifest
+	manifestRequests := registry.requestCount("GET /v2/team/mongo/manifests/")
+	cachedPaths, err := provider.Resolve(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, paths.Mongod, cachedPaths.Mongod)
+	assert.Equal(t, manifestRequests, registry.requestCount("GET /v2/team/mongo/manifests/"))
+	assert.Equal(t, 2, registry.requestCount("HEAD /v2/team/mongo/manifests/7.0.2"))
+	require.NoError(t, cachedPaths.Release())
+
+	// Registries that don't send the digest are asked for the manifest
+	registry.omitDigestHeader = true
+	cachedPaths, err = provider.Resolve(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, paths.Mongod, cachedPaths.Mongod)
+	assert.Equal(t, manifestRequests+1, registry.requestCount("GET /v2/team/mongo/manifests/"))
+	assert.Equal(t, 1, registry.requestCount("GET /v2/team/mongo/manifests/7.0.2"))
+	require.NoError(t, cachedPaths.Release())
+
+	// Without the registry, the tag resolves to the cached image it pointed
+	// to before
+	registry.server.Close()
+	offlinePaths, err := provider.Resolve(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, paths.Mongod, offlinePaths.Mongod)
+	require.NoError(t, offlinePaths.Release())
+
+	// ...but other tags still fail
+	_, err = registry.provider(registry.image(":7.0.3")).Resolve(context.Background(), "")
+	assert.Error(t, err)
+}
+
+func TestOCIImageProviderErrors(t *testing.T) {
+	registry := newTestRegistry(t)
+	goodLayer := makeLayer(t, layerEntry{name: "usr/bin/mongod", content: "mongod"})
+	indexDigest := registry.pushImage(t, "7.0.2", map[string][][]byte{"amd64": {goodLayer}})
+	registry.pushManifest(t, "no-mongod", [][]byte{makeLayer(t, layerEntry{name: "usr/bin/mongo", content: "shell"})})
+	registry.pushManifest(t, "deleted-mongod", [][]byte{goodLayer, makeLayer(t, layerEntry{name: "usr/bin/.wh.mongod"})})
+	registry.pushManifest(t, "deleted-bin", [][]byte{goodLayer, makeLayer(t, layerEntry{name: "usr/bin/.wh..wh..opq"})})
+	registry.pushManifest(t, "dangling-link", [][]byte{makeLayer(t, layerEntry{name: "usr/bin/mongod", linkname: "/opt/mongodb/bin/mongod"})})
+
+	// The registry serves another layer than the one in the manifest
+	tamperedLayer := makeLayer(t, layerEntry{name: "usr/bin/mongod", content: "evil mongod"})
+	expectedLayer := makeLayer(t, layerEntry{name: "usr/bin/mongod", content: "other mongod"})
+	registry.pushManifest(t, "tampered", [][]byte{expectedLayer})
+	registry.blobs[sha256Digest(expectedLayer)] = tamperedLayer
+
+	// The registry serves the index when asked for another digest
+	otherDigest := sha256Digest([]byte("not the index"))
+	registry.manifests[otherDigest] = registry.manifests[indexDigest]
+
+	tests := map[string]struct {
+		image string
+		arch  string
+
+		expectedError string
+	}{
+		"Unknown tag": {
+			image:         registry.image(":6.0.4"),
+			expectedError: "request for " + registry.server.URL + "/v2/team/mongo/manifests/6.0.4 failed with status code 404",
+		},
+		"Other platform": {
+			image:         registry.image(":7.0.2"),
+			arch:          "s390x",
+			expectedError: "image " + registry.image(":7.0.2") + " is not published for linux/s390x, only for linux/amd64",
+		},
+		"Pinned digest doesn't match": {
+			image:         registry.image("@" + otherDigest),
+			expectedError: "manifest " + otherDigest + " of team/mongo has digest " + indexDigest + "; the registry may have been tampered with",
+		},
+		"Tampered layer": {
+			image:         registry.image(":tampered"),
+			expectedError: "layer " + sha256Digest(expectedLayer) + " of " + registry.image(":tampered") + " has digest " + sha256Digest(tamperedLayer) + "; the registry may have been tampered with",
+		},
+		"No mongod": {
+			image:         registry.image(":no-mongod"),
+			expectedError: "error extracting mongod from " + registry.image(":no-mongod") + ": did not find usr/bin/mongod in the image",
+		},
+		"Deleted mongod": {
+			image:         registry.image(":deleted-mongod"),
+			expectedError: "error extracting mongod from " + registry.image(":deleted-mongod") + ": did not find usr/bin/mongod in the image",
+		},
+		"Deleted directory": {
+			image:         registry.image(":deleted-bin"),
+			expectedError: "error extracting mongod from " + registry.image(":deleted-bin") + ": did not find usr/bin/mongod in the image",
+		},
+		"Dangling link": {
+			image:         registry.image(":dangling-link"),
+			expectedError: "error extracting mongod from " + registry.image(":dangling-link") + ": did not find usr/bin/mongod in the image",
+		},
+		"Invalid digest": {
+			image:         registry.image("@sha512:abc"),
+			expectedError: `invalid image reference "` + registry.image("@sha512:abc") + `": only sha256 digests are supported`,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			provider := registry.provider(test.image)
+			provider.Arch = "amd64"
+			if test.arch != "" {
+				provider.Arch = test.arch
+			}
+
+			_, err := provider.Resolve(context.Background(), "")
+			require.EqualError(t, err, test.expectedError)
+		})
+	}
+}
+
+func TestOCIImageProviderLinksAndWhiteouts(t *testing.T) {
+	tests := map[string]struct {
+		layers [][]layerEntry
+
+		expectedContent string
+	}{
+		"Relative link": {
+			layers: [][]layerEntry{{
+				{name: "usr/bin/mongod", linkname: "../lib/mongodb/mongod"},
+				{name: "usr/lib/mongodb/mongod", content: "mongod"},
+			}},
+			expectedContent: "mongod",
+		},
+		"Link to a link in a later layer": {
+			layers: [][]layerEntry{
+				{{name: "usr/bin/mongod", linkname: "/opt/mongodb/bin/mongod"}},
+				{{name: "opt/mongodb", linkname: "mongodb-7.0.2"}, {name: "opt/mongodb-7.0.2/bin/mongod", content: "mongod 7.0.2"}},
+			},
+			expectedContent: "mongod 7.0.2",
+		},
+		"Link out of the image": {
+			layers: [][]layerEntry{{
+				{name: "usr/bin/mongod", linkname: "../../../../mongod"},
+				{name: "mongod", content: "mongod at the root"},
+			}},
+			expectedContent: "mongod at the root",
+		},
+		"Directory replaced in a later layer": {
+			layers: [][]layerEntry{
+				{{name: "usr/bin/mongod", content: "old mongod"}},
+				{{name: "usr/bin/mongod", content: "new mongod"}, {name: "usr/bin/.wh..wh..opq"}},
+			},
+			expectedContent: "new mongod",
+		},
+		"Link replaced by a file": {
+			layers: [][]layerEntry{
+				{{name: "usr/bin/mongod", linkname: "mongod-old"}, {name: "usr/bin/mongod-old", content: "old mongod"}},
+				{{name: "usr/bin/.wh.mongod"}},
+				{{name: "usr/bin/mongod", content: "new mongod"}},
+			},
+			expectedContent: "new mongod",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			registry := newTestRegistry(t)
+			layers := make([][]byte, len(test.layers))
+			for i, entries := range test.layers {
+				layers[i] = makeLayer(t, entries...)
+			}
+			registry.pushManifest(t, "7.0.2", layers)
+
+			paths, err := registry.provider(registry.image(":7.0.2")).Resolve(context.Background(), "")
+			require.NoError(t, err)
+
+			contents, err := mongobin.Afs.ReadFile(path.Join(path.Dir(paths.Mongod), "bin", "mongod"))
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedContent, string(contents))
+			require.NoError(t, paths.Release())
+		})
+	}
+}
+
+func TestOCIImageProviderBasicAuth(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	registry := newTestRegistry(t)
+	registry.username = "user"
+	registry.password = "hunter2"
+	registry.basicAuth = true
+	registry.pushManifest(t, "7.0.2", [][]byte{makeLayer(t, layerEntry{name: "usr/bin/mongod", content: "mongod"})})
+
+	provider := registry.provider(registry.image(":7.0.2"))
+	_, err := provider.Resolve(context.Background(), "")
+	require.EqualError(t, err, "registry "+registry.server.Listener.Addr().String()+" needs credentials")
+
+	provider.Username = "user"
+	provider.Password = "hunter2"
+	paths, err := provider.Resolve(context.Background(), "")
+	require.NoError(t, err)
+	require.NoError(t, paths.Release())
+}
+
+func TestOCIImageProviderSharedLibraries(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("needs a dynamically linked ELF binary")
+	}
+
+	// Use a binary from the system as mongod, since we need an ELF binary
+	// that needs shared libraries
+	binary, err := os.ReadFile("/bin/sh")
+	require.NoError(t, err)
+	elfFile, err := elf.NewFile(bytes.NewReader(binary))
+	require.NoError(t, err)
+	needed, err := elfFile.ImportedLibraries()
+	require.NoError(t, err)
+	if len(needed) == 0 {
+		t.Skip("/bin/sh is statically linked")
+	}
+	var interpreter string
+	for _, prog := range elfFile.Progs {
+		if prog.Type == elf.PT_INTERP {
+			contents := make([]byte, prog.Filesz)
+			_, err := prog.ReadAt(contents, 0)
+			require.NoError(t, err)
+			interpreter = path.Base(strings.TrimRight(string(contents), "\x00"))
+		}
+	}
+	require.NotEmpty(t, interpreter)
+
+	// The first library is a symlink, like most libraries in images
+	entries := []layerEntry{
+		{name: "usr/bin/mongod", content: string(binary)},
+		{name: "usr/lib/x86_64-linux-gnu/" + needed[0], linkname: needed[0] + ".1.2.3"},
+		{name: "usr/lib/x86_64-linux-gnu/" + needed[0] + ".1.2.3", content: "library " + needed[0]},
+		{name: "usr/lib/x86_64-linux-gnu/libunused.so.1", content: "unused"},
+		{name: "usr/lib64/" + interpreter, content: "loader"},
+	}
+	for _, library := range needed[1:] {
+		entries = append(entries, layerEntry{name: "lib/" + library, content: "library " + library})
+	}
+
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+	registry := newTestRegistry(t)
+	registry.pushManifest(t, "7.0.2", [][]byte{makeLayer(t, entries...)})
+
+	paths, err := registry.provider(registry.image(":7.0.2")).Resolve(context.Background(), "")
+	require.NoError(t, err)
+	dirPath := path.Dir(paths.Mongod)
+
+	for _, library := range needed {
+		contents, err := mongobin.Afs.ReadFile(path.Join(dirPath, "lib", library))
+		require.NoError(t, err)
+		assert.Equal(t, "library "+library, string(contents))
+	}
+	exists, err := mongobin.Afs.Exists(path.Join(dirPath, "lib", interpreter))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	exists, err = mongobin.Afs.Exists(path.Join(dirPath, "lib", "libunused.so.1"))
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	wrapper, err := mongobin.Afs.ReadFile(paths.Mongod)
+	require.NoError(t, err)
+	assert.Contains(t, string(wrapper), `exec "$dir/lib/`+interpreter+`" --library-path "$dir/lib" "$dir/bin/mongod" "$@"`)
+}
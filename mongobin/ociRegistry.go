@@ -0,0 +1,327 @@
+package mongobin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Media types of the manifests we ask registries for. Indexes (and Docker's
+// manifest lists) point to one manifest per platform.
+const (
+	ociIndexMediaType           = "application/vnd.oci.image.index.v1+json"
+	ociManifestMediaType        = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// manifestAccept is the Accept header to ask for manifests with
+var manifestAccept = strings.Join([]string{ociIndexMediaType, dockerManifestListMediaType, ociManifestMediaType, dockerManifestMediaType}, ", ")
+
+// maxManifestSize is the largest manifest we read, to guard against a
+// misbehaving registry
+const maxManifestSize = 4 << 20
+
+var digestRegex = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// imageReference is a parsed image reference like "mongo:7.0" or
+// "registry.example.com/team/mongo@sha256:..."
+type imageReference struct {
+	// Registry is the host (and port) of the registry
+	Registry string
+
+	// Repository is the name of the image in the registry, e.g.
+	// library/mongo
+	Repository string
+
+	// Tag is the tag, if the reference isn't pinned to a digest
+	Tag string
+
+	// Digest pins the reference to a manifest
+	Digest string
+}
+
+// parseImageReference parses an image reference the way docker does: images
+// without a registry are on Docker Hub, and official images there are in the
+// library namespace
+func parseImageReference(ref string) (*imageReference, error) {
+	parsed := &imageReference{}
+
+	name := ref
+	if at := strings.Index(name, "@"); at >= 0 {
+		parsed.Digest = name[at+1:]
+		name = name[:at]
+		if !digestRegex.MatchString(parsed.Digest) {
+			return nil, fmt.Errorf("invalid image reference %q: only sha256 digests are supported", ref)
+		}
+	}
+
+	if slash := strings.LastIndex(name, "/"); strings.LastIndex(name, ":") > slash {
+		colon := strings.LastIndex(name, ":")
+		parsed.Tag = name[colon+1:]
+		name = name[:colon]
+	}
+	if parsed.Tag == "" && parsed.Digest == "" {
+		parsed.Tag = "latest"
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		parsed.Registry = parts[0]
+		parsed.Repository = parts[1]
+	} else {
+		parsed.Registry = "docker.io"
+		parsed.Repository = name
+	}
+	if parsed.Registry == "docker.io" && !strings.Contains(parsed.Repository, "/") {
+		parsed.Repository = "library/" + parsed.Repository
+	}
+
+	if parsed.Repository == "" || strings.ToLower(parsed.Repository) != parsed.Repository {
+		return nil, fmt.Errorf("invalid image reference %q", ref)
+	}
+
+	return parsed, nil
+}
+
+// String returns the reference with its registry and repository spelled out
+func (ref *imageReference) String() string {
+	if ref.Digest != "" {
+		return ref.Registry + "/" + ref.Repository + "@" + ref.Digest
+	}
+	return ref.Registry + "/" + ref.Repository + ":" + ref.Tag
+}
+
+// baseURL is the URL of the registry's API. Docker Hub serves its API from
+// another host than the one in image names.
+func (ref *imageReference) baseURL() string {
+	host := ref.Registry
+	if host == "docker.io" || host == "index.docker.io" {
+		host = "registry-1.docker.io"
+	}
+	return "https://" + host + "/v2/" + ref.Repository
+}
+
+// ociDescriptor points to a manifest or a layer
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ociManifest is an image manifest, or an index of manifests
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// registryClient talks to the registry API for one repository, and
+// authenticates with it when asked to
+type registryClient struct {
+	client   *http.Client
+	ref      *imageReference
+	headers  http.Header
+	username string
+	password string
+
+	// authorization is the Authorization header to send, once we know how
+	// to authenticate
+	authorization string
+}
+
+// fetchManifest fetches the manifest with the given tag or digest, and
+// checks it against the digest if there is one. It returns the manifest and
+// its digest.
+func (c *registryClient) fetchManifest(ctx context.Context, reference string) (*ociManifest, string, error) {
+	resp, getErr := c.requestManifest(ctx, http.MethodGet, c.ref.baseURL()+"/manifests/"+reference)
+	if getErr != nil {
+		return nil, "", getErr
+	}
+	defer resp.Body.Close()
+
+	contents, readErr := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if readErr != nil {
+		return nil, "", fmt.Errorf("error reading manifest %s of %s: %s", reference, c.ref.Repository, stripURLFromError(readErr))
+	}
+
+	shasum := sha256.Sum256(contents)
+	digest := "sha256:" + hex.EncodeToString(shasum[:])
+	if strings.HasPrefix(reference, "sha256:") && digest != reference {
+		return nil, "", fmt.Errorf("manifest %s of %s has digest %s; the registry may have been tampered with", reference, c.ref.Repository, digest)
+	}
+
+	manifest := &ociManifest{}
+	if jsonErr := json.Unmarshal(contents, manifest); jsonErr != nil {
+		return nil, "", fmt.Errorf("error parsing manifest %s of %s: %s", reference, c.ref.Repository, jsonErr)
+	}
+
+	return manifest, digest, nil
+}
+
+// blobURL is the URL of the blob with the given digest
+func (c *registryClient) blobURL(digest string) string {
+	return c.ref.baseURL() + "/blobs/" + digest
+}
+
+// blobHeaders are the headers to download blobs with
+func (c *registryClient) blobHeaders() http.Header {
+	headers := c.headers.Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	if c.authorization != "" {
+		headers.Set("Authorization", c.authorization)
+	}
+	return headers
+}
+
+// resolveTag asks the registry which manifest the tag points to, without
+// downloading it. It returns "" if the registry doesn't say.
+func (c *registryClient) resolveTag(ctx context.Context, tag string) (string, error) {
+	resp, headErr := c.requestManifest(ctx, http.MethodHead, c.ref.baseURL()+"/manifests/"+tag)
+	if headErr != nil {
+		return "", headErr
+	}
+	resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if !digestRegex.MatchString(digest) {
+		return "", nil
+	}
+	return digest, nil
+}
+
+// requestManifest sends a request for a manifest to the registry,
+// authenticating and retrying once if the registry asks for credentials
+func (c *registryClient) requestManifest(ctx context.Context, method string, urlStr string) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, reqErr := http.NewRequestWithContext(ctx, method, urlStr, nil)
+		if reqErr != nil {
+			return nil, fmt.Errorf("error creating request for %s: %s", RedactURL(urlStr), stripURLFromError(reqErr))
+		}
+		req.Header = c.blobHeaders()
+		req.Header.Set("Accept", manifestAccept)
+
+		resp, doErr := c.client.Do(req)
+		if doErr != nil {
+			return nil, fmt.Errorf("error requesting %s: %s", RedactURL(urlStr), stripURLFromError(doErr))
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 1 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+
+			if authErr := c.authenticate(ctx, challenge); authErr != nil {
+				return nil, authErr
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("request for %s failed with status code %d", RedactURL(urlStr), resp.StatusCode)
+		}
+
+		return resp, nil
+	}
+}
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate answers a WWW-Authenticate challenge: with the credentials
+// for basic auth, or by getting a token from the registry's token server
+// (anonymously, if there are no credentials)
+func (c *registryClient) authenticate(ctx context.Context, challenge string) error {
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	params := map[string]string{}
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[strings.ToLower(match[1])] = match[2]
+	}
+
+	switch scheme {
+	case "basic":
+		if c.username == "" {
+			return fmt.Errorf("registry %s needs credentials", c.ref.Registry)
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(c.username, c.password)
+		c.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+		token, tokenErr := c.fetchToken(ctx, params)
+		if tokenErr != nil {
+			return tokenErr
+		}
+		c.authorization = "Bearer " + token
+		return nil
+	default:
+		return fmt.Errorf("registry %s asked for credentials with an unsupported challenge %q", c.ref.Registry, challenge)
+	}
+}
+
+// fetchToken gets a token from the token server in a Bearer challenge
+func (c *registryClient) fetchToken(ctx context.Context, params map[string]string) (string, error) {
+	realm, parseErr := url.Parse(params["realm"])
+	if parseErr != nil || params["realm"] == "" {
+		return "", fmt.Errorf("registry %s sent an invalid token realm %q", c.ref.Registry, params["realm"])
+	}
+
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + c.ref.Repository + ":pull"
+	}
+	query := realm.Query()
+	query.Set("scope", scope)
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	realm.RawQuery = query.Encode()
+
+	req, reqErr := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if reqErr != nil {
+		return "", fmt.Errorf("error creating token request: %s", stripURLFromError(reqErr))
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, doErr := c.client.Do(req)
+	if doErr != nil {
+		return "", fmt.Errorf("error getting a token for %s: %s", c.ref.Registry, stripURLFromError(doErr))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error getting a token for %s: token server responded with status code %d", c.ref.Registry, resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if jsonErr := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&tokenResp); jsonErr != nil {
+		return "", fmt.Errorf("error parsing token for %s: %s", c.ref.Registry, jsonErr)
+	}
+	if tokenResp.Token != "" {
+		return tokenResp.Token, nil
+	}
+	if tokenResp.AccessToken != "" {
+		return tokenResp.AccessToken, nil
+	}
+
+	return "", fmt.Errorf("token server for %s did not return a token", c.ref.Registry)
+}
@@ -0,0 +1,301 @@
+package mongobin
+
+import (
+	// Needed for go:embed
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//go:embed platformRules.json
+var defaultPlatformRulesJSON []byte
+
+// defaultPlatformRules is parsed once; DefaultPlatformRules hands out copies
+var defaultPlatformRules = mustParsePlatformRules(defaultPlatformRulesJSON)
+
+// PlatformRules is MongoDB's support matrix: which OS build and arch of
+// MongoDB to download for a distro release, CPU architecture and version of
+// MongoDB. Rules are tried in order, and the first one that matches wins.
+type PlatformRules struct {
+	// OSNames pick the OSName for a Linux distro release
+	OSNames []OSNameRule `json:"osNames"`
+
+	// Archs pick the Arch once the OSName is known
+	Archs []ArchRule `json:"archs"`
+}
+
+// OSNameRule picks the OSName for releases of a distro
+type OSNameRule struct {
+	// Distros are the IDs from /etc/os-release the rule applies to, e.g.
+	// ["rhel", "rocky"]
+	Distros []string `json:"distros"`
+
+	// DistroVersion is the range of VERSION_IDs the rule applies to
+	DistroVersion VersionRange `json:"distroVersion,omitempty"`
+
+	// GoArch is the CPU architecture, as GOARCH names it, e.g. "arm64".
+	// Empty means any.
+	GoArch string `json:"goArch,omitempty"`
+
+	// MongoVersion is the range of MongoDB versions the rule applies to
+	MongoVersion VersionRange `json:"mongoVersion,omitempty"`
+
+	// OSName is the OS build of MongoDB to download, e.g. ubuntu2204
+	OSName string `json:"osName"`
+}
+
+// ArchRule picks the Arch of the build of MongoDB to download
+type ArchRule struct {
+	// GoArch is the CPU architecture, as GOARCH names it
+	GoArch string `json:"goArch"`
+
+	// Platform is "linux" or "osx". Empty means any.
+	Platform string `json:"platform,omitempty"`
+
+	// OSNames the rule applies to. Empty means any.
+	OSNames []string `json:"osNames,omitempty"`
+
+	// MongoVersion is the range of MongoDB versions the rule applies to
+	MongoVersion VersionRange `json:"mongoVersion,omitempty"`
+
+	// Arch is the architecture in the archive name, e.g. aarch64
+	Arch string `json:"arch"`
+}
+
+// VersionRange is a range of versions like "8.2" or "6.0.4". Missing parts
+// of a version count as 0.
+type VersionRange struct {
+	// Min is the lowest version in the range. Empty means no lower bound.
+	Min string `json:"min,omitempty"`
+
+	// Max is the first version after the range. Empty means no upper bound.
+	Max string `json:"max,omitempty"`
+}
+
+// DefaultPlatformRules returns the rules memongo ships with
+func DefaultPlatformRules() *PlatformRules {
+	return mustParsePlatformRules(defaultPlatformRulesJSON)
+}
+
+// LoadPlatformRules loads rules from a JSON file laid out like
+// platformRules.json. Pass them as SpecOverrides.Rules to try them before
+// the rules memongo ships with, e.g. to support a new distro release before
+// memongo does.
+func LoadPlatformRules(rulesPath string) (*PlatformRules, error) {
+	// rulesPath is given by the user (e.g. in MEMONGO_PLATFORM_RULES_FILE),
+	// who can read any file they choose anyway
+	//nolint:gosec
+	contents, readErr := os.ReadFile(rulesPath)
+	if readErr != nil {
+		return nil, fmt.Errorf("error reading platform rules: %s", readErr)
+	}
+
+	rules, parseErr := ParsePlatformRules(contents)
+	if parseErr != nil {
+		return nil, fmt.Errorf("error parsing platform rules from %s: %s", rulesPath, parseErr)
+	}
+
+	return rules, nil
+}
+
+// ParsePlatformRules parses and validates rules in JSON
+func ParsePlatformRules(contents []byte) (*PlatformRules, error) {
+	rules := &PlatformRules{}
+	if jsonErr := json.Unmarshal(contents, rules); jsonErr != nil {
+		return nil, jsonErr
+	}
+
+	for i, rule := range rules.OSNames {
+		if len(rule.Distros) == 0 || rule.OSName == "" {
+			return nil, fmt.Errorf("osNames[%d] needs distros and an osName", i)
+		}
+		if rangeErr := validateVersionRanges(rule.DistroVersion, rule.MongoVersion); rangeErr != nil {
+			return nil, fmt.Errorf("osNames[%d]: %s", i, rangeErr)
+		}
+	}
+
+	for i, rule := range rules.Archs {
+		if rule.GoArch == "" || rule.Arch == "" {
+			return nil, fmt.Errorf("archs[%d] needs a goArch and an arch", i)
+		}
+		if rangeErr := validateVersionRanges(rule.MongoVersion); rangeErr != nil {
+			return nil, fmt.Errorf("archs[%d]: %s", i, rangeErr)
+		}
+	}
+
+	return rules, nil
+}
+
+func mustParsePlatformRules(contents []byte) *PlatformRules {
+	rules, err := ParsePlatformRules(contents)
+	if err != nil {
+		panic("invalid embedded platform rules: " + err.Error())
+	}
+	return rules
+}
+
+func validateVersionRanges(ranges ...VersionRange) error {
+	for _, versionRange := range ranges {
+		for _, version := range []string{versionRange.Min, versionRange.Max} {
+			if version == "" {
+				continue
+			}
+			if _, err := parseVersionParts(version); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergePlatformRules returns the rules in overrides, followed by the ones in
+// rules
+func mergePlatformRules(overrides *PlatformRules, rules *PlatformRules) *PlatformRules {
+	if overrides == nil {
+		return rules
+	}
+
+	return &PlatformRules{
+		OSNames: append(append([]OSNameRule{}, overrides.OSNames...), rules.OSNames...),
+		Archs:   append(append([]ArchRule{}, overrides.Archs...), rules.Archs...),
+	}
+}
+
+// osName returns the OSName for a distro release. It returns false if no
+// rule mentions the distro.
+func (rules *PlatformRules) osName(distro string, distroVersion []int, goArch string, mongoVersion []int) (string, bool) {
+	known := false
+	for _, rule := range rules.OSNames {
+		if !contains(rule.Distros, distro) {
+			continue
+		}
+		known = true
+
+		if rule.DistroVersion.contains(distroVersion) &&
+			(rule.GoArch == "" || rule.GoArch == goArch) &&
+			rule.MongoVersion.contains(mongoVersion) {
+			return rule.OSName, true
+		}
+	}
+
+	return "", known
+}
+
+// arch returns the Arch to download. It returns false if no rule matches.
+func (rules *PlatformRules) arch(platform string, osName string, goArch string, mongoVersion []int) (string, bool) {
+	for _, rule := range rules.Archs {
+		if rule.GoArch == goArch &&
+			(rule.Platform == "" || rule.Platform == platform) &&
+			(len(rule.OSNames) == 0 || contains(rule.OSNames, osName)) &&
+			rule.MongoVersion.contains(mongoVersion) {
+			return rule.Arch, true
+		}
+	}
+
+	return "", false
+}
+
+// knowsGoArch returns whether any rule is for goArch
+func (rules *PlatformRules) knowsGoArch(goArch string) bool {
+	for _, rule := range rules.Archs {
+		if rule.GoArch == goArch {
+			return true
+		}
+	}
+	return false
+}
+
+// family returns osName, followed by the OSNames picked for older releases
+// of the same distros on goArch, newest first
+func (rules *PlatformRules) family(osName string, goArch string) []string {
+	var distros []string
+	for _, rule := range rules.OSNames {
+		if rule.OSName == osName && (rule.GoArch == "" || rule.GoArch == goArch) {
+			distros = rule.Distros
+			break
+		}
+	}
+	if distros == nil {
+		return nil
+	}
+
+	family := []string{osName}
+	found := false
+	for _, rule := range rules.OSNames {
+		if rule.GoArch != "" && rule.GoArch != goArch {
+			continue
+		}
+		if rule.OSName == osName {
+			found = true
+			continue
+		}
+		if found && !contains(family, rule.OSName) && sharesDistro(rule.Distros, distros) {
+			family = append(family, rule.OSName)
+		}
+	}
+
+	return family
+}
+
+func sharesDistro(a []string, b []string) bool {
+	for _, distro := range a {
+		if contains(b, distro) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns whether version is in the range
+func (versionRange VersionRange) contains(version []int) bool {
+	if versionRange.Min != "" {
+		min, _ := parseVersionParts(versionRange.Min)
+		if compareVersions(version, min) < 0 {
+			return false
+		}
+	}
+	if versionRange.Max != "" {
+		max, _ := parseVersionParts(versionRange.Max)
+		if compareVersions(version, max) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseVersionParts parses a version like "8.2" or "2018.03"
+func parseVersionParts(version string) ([]int, error) {
+	parts := strings.Split(version, ".")
+	parsed := make([]int, len(parts))
+	for i, part := range parts {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		parsed[i] = number
+	}
+	return parsed, nil
+}
+
+// compareVersions compares two versions, treating missing parts as 0
+func compareVersions(a []int, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		aPart, bPart := 0, 0
+		if i < len(a) {
+			aPart = a[i]
+		}
+		if i < len(b) {
+			bPart = b[i]
+		}
+		if aPart != bPart {
+			if aPart < bPart {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
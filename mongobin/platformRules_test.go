@@ -0,0 +1,113 @@
+package mongobin_test
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+func TestDefaultPlatformRules(t *testing.T) {
+	rules := mongobin.DefaultPlatformRules()
+	require.NotEmpty(t, rules.OSNames)
+	require.NotEmpty(t, rules.Archs)
+
+	// Callers get their own copy
+	rules.OSNames = nil
+	assert.NotEmpty(t, mongobin.DefaultPlatformRules().OSNames)
+}
+
+func TestPlatformRulesOverride(t *testing.T) {
+	etcDir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(etcDir, "os-release"), []byte("ID=ubuntu\nVERSION_ID=\"26.04\"\n"), 0644))
+
+	rulesPath := path.Join(t.TempDir(), "rules.json")
+	require.NoError(t, os.WriteFile(rulesPath, []byte(`{
+		"osNames": [
+			{"distros": ["ubuntu"], "distroVersion": {"min": "26"}, "mongoVersion": {"min": "8.2.0"}, "osName": "ubuntu2604"}
+		],
+		"archs": [
+			{"goArch": "arm64", "osNames": ["ubuntu2604"], "arch": "aarch64"}
+		]
+	}`), 0644))
+
+	rules, err := mongobin.LoadPlatformRules(rulesPath)
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		mongoVersion string
+		goArch       string
+
+		expectedSpec *mongobin.DownloadSpec
+	}{
+		"Override rule matches": {
+			mongoVersion: "8.2.1",
+			goArch:       "amd64",
+
+			expectedSpec: &mongobin.DownloadSpec{Version: "8.2.1", Platform: "linux", Arch: "x86_64", OSName: "ubuntu2604"},
+		},
+		"Override arch rule matches": {
+			mongoVersion: "8.2.1",
+			goArch:       "arm64",
+
+			expectedSpec: &mongobin.DownloadSpec{Version: "8.2.1", Platform: "linux", Arch: "aarch64", OSName: "ubuntu2604"},
+		},
+		"Falls through to the default rules": {
+			mongoVersion: "8.0.0",
+			goArch:       "amd64",
+
+			expectedSpec: &mongobin.DownloadSpec{Version: "8.0.0", Platform: "linux", Arch: "x86_64", OSName: "ubuntu2404"},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			spec, err := mongobin.DetectSpec(test.mongoVersion, &mongobin.SpecOverrides{
+				Platform: "linux",
+				Arch:     test.goArch,
+				EtcDir:   etcDir,
+				Rules:    rules,
+			})
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedSpec, spec)
+		})
+	}
+}
+
+func TestParsePlatformRulesErrors(t *testing.T) {
+	tests := map[string]struct {
+		rules         string
+		expectedError string
+	}{
+		"Invalid JSON": {
+			rules:         `{"osNames": [`,
+			expectedError: "unexpected end of JSON input",
+		},
+		"OSName rule without an osName": {
+			rules:         `{"osNames": [{"distros": ["ubuntu"]}]}`,
+			expectedError: "osNames[0] needs distros and an osName",
+		},
+		"Invalid distro version": {
+			rules:         `{"osNames": [{"distros": ["ubuntu"], "distroVersion": {"min": "noble"}, "osName": "ubuntu2404"}]}`,
+			expectedError: `osNames[0]: invalid version "noble"`,
+		},
+		"Arch rule without an arch": {
+			rules:         `{"archs": [{"goArch": "arm64"}]}`,
+			expectedError: "archs[0] needs a goArch and an arch",
+		},
+		"Invalid MongoDB version": {
+			rules:         `{"archs": [{"goArch": "arm64", "arch": "aarch64", "mongoVersion": {"max": "8.x"}}]}`,
+			expectedError: `archs[0]: invalid version "8.x"`,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := mongobin.ParsePlatformRules([]byte(test.rules))
+			require.EqualError(t, err, test.expectedError)
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package mongobin
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processExists returns whether a process with the given PID is running
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
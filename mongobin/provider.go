@@ -0,0 +1,274 @@
+package mongobin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/tryvium-travels/memongo/memongolog"
+)
+
+// BinaryProvider finds the MongoDB binaries to run, e.g. by downloading them
+// or looking them up on the system. Implement it to plug in other sources,
+// like Bazel runfiles or a Nix store.
+type BinaryProvider interface {
+	// Resolve returns the binaries for the given version of MongoDB. The
+	// version may be empty if the caller doesn't know it, e.g. when it gave
+	// a download URL instead.
+	Resolve(ctx context.Context, version string) (*BinaryPaths, error)
+}
+
+// BinaryPaths are the binaries a BinaryProvider resolved
+type BinaryPaths struct {
+	// Mongod is the path to mongod
+	Mongod string
+
+	// Release, if set, must be called once the binaries are no longer used,
+	// e.g. to let the cache prune them again
+	Release func() error
+}
+
+// URLProvider is a BinaryProvider that downloads an archive into the cache,
+// and marks the cache entry as in use until the binaries are released
+type URLProvider struct {
+	// Downloader downloads and caches the archive
+	Downloader *Downloader
+
+	// URL of the archive. Defaults to the official archive for the version
+	// of MongoDB being resolved (see DetectSpec).
+	URL string
+
+	// MirrorURLs are tried before URL (see Downloader.GetOrDownloadMongod)
+	MirrorURLs []string
+
+	// CacheKeyURL, if set, is the URL the cache entry is keyed by instead of
+	// URL, e.g. the official URL of an archive that URL is a copy of. The
+	// archive is still only downloaded from MirrorURLs and URL.
+	CacheKeyURL string
+}
+
+// Resolve downloads the archive, or finds it in the cache
+func (p *URLProvider) Resolve(ctx context.Context, version string) (*BinaryPaths, error) {
+	urlStr := p.URL
+	if urlStr == "" {
+		spec, specErr := DetectSpecWithLogger(version, nil, p.Downloader.logger())
+		if specErr != nil {
+			return nil, specErr
+		}
+		urlStr = spec.GetDownloadURL()
+	}
+
+	keyURL := p.CacheKeyURL
+	if keyURL == "" {
+		keyURL = urlStr
+	}
+	sources := append(append([]string{}, p.MirrorURLs...), urlStr)
+
+	cache := &Cache{
+		Path:   p.Downloader.CachePath,
+		Logger: p.Downloader.Logger,
+	}
+
+	// The binary may be pruned by another process before we mark it as in
+	// use, in which case we download it again
+	for attempt := 1; ; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+
+		paths, downloadErr := p.Downloader.getOrDownloadBinaries(ctx, keyURL, sources, []string{"mongod"})
+		if downloadErr != nil {
+			return nil, downloadErr
+		}
+		binPath := paths["mongod"]
+
+		marker, markErr := cache.MarkInUse(binPath)
+		if os.IsNotExist(markErr) && attempt < 2 {
+			continue
+		}
+		if markErr != nil {
+			return nil, fmt.Errorf("error marking %s as in use: %s", binPath, markErr)
+		}
+
+		return &BinaryPaths{Mongod: binPath, Release: marker.Release}, nil
+	}
+}
+
+// FixedPathProvider is a BinaryProvider for a mongod at a fixed path. The
+// version of the binary isn't checked.
+type FixedPathProvider struct {
+	// Mongod is the path to mongod
+	Mongod string
+}
+
+// Resolve checks that the binary exists
+func (p *FixedPathProvider) Resolve(ctx context.Context, version string) (*BinaryPaths, error) {
+	if _, statErr := os.Stat(p.Mongod); statErr != nil {
+		return nil, fmt.Errorf("error finding mongod: %s", statErr)
+	}
+
+	return &BinaryPaths{Mongod: p.Mongod}, nil
+}
+
+// SystemBinaryDirs are the common install locations of mongod that
+// LookPathProvider searches after $PATH when Dirs isn't set
+var SystemBinaryDirs = []string{
+	"/usr/bin",
+	"/usr/local/bin",
+	"/opt/homebrew/bin",
+	"/usr/local/opt/mongodb-community/bin",
+	"/opt/homebrew/opt/mongodb-community/bin",
+	"/opt/mongodb/bin",
+}
+
+// LookPathProvider is a BinaryProvider that looks mongod up in $PATH, and
+// uses it if it's the version being resolved
+type LookPathProvider struct {
+	// Name of the binary to look up. Defaults to mongod.
+	Name string
+
+	// Dirs are searched for the binary after $PATH, e.g. SystemBinaryDirs
+	Dirs []string
+
+	// If set, a binary with the same major and minor version is used too,
+	// e.g. 6.0.5 when resolving 6.0.4
+	MatchMinorVersion bool
+
+	// Logger for explaining which binary was picked. Defaults to printing
+	// to stderr.
+	Logger *memongolog.Logger
+}
+
+// Resolve looks the binary up, and checks its version
+func (p *LookPathProvider) Resolve(ctx context.Context, version string) (*BinaryPaths, error) {
+	name := p.Name
+	if name == "" {
+		name = "mongod"
+	}
+
+	candidates, findErr := p.candidates(name)
+	if findErr != nil {
+		p.logger().Infof("Not using a system %s: %s", name, findErr)
+		return nil, findErr
+	}
+
+	var errs []string
+	for _, binPath := range candidates {
+		binVersion, versionErr := binaryVersion(ctx, binPath)
+		if versionErr != nil {
+			p.logger().Debugf("Not using %s: %s", binPath, versionErr)
+			errs = append(errs, versionErr.Error())
+			continue
+		}
+		if !p.versionMatches(binVersion, version) {
+			p.logger().Infof("Not using %s: it is MongoDB %s, not %s", binPath, binVersion, version)
+			errs = append(errs, fmt.Sprintf("%s is MongoDB %s, not %s", binPath, binVersion, version))
+			continue
+		}
+
+		p.logger().Infof("Using %s, which is MongoDB %s", binPath, binVersion)
+		return &BinaryPaths{Mongod: binPath}, nil
+	}
+
+	return nil, errors.New(strings.Join(errs, "; "))
+}
+
+// candidates returns the binaries found in $PATH and Dirs, in that order
+func (p *LookPathProvider) candidates(name string) ([]string, error) {
+	var candidates []string
+
+	binPath, lookErr := exec.LookPath(name)
+	if lookErr == nil {
+		candidates = append(candidates, binPath)
+	}
+
+	for _, dir := range p.Dirs {
+		candidate := filepath.Join(dir, name)
+		if contains(candidates, candidate) {
+			continue
+		}
+		if info, statErr := os.Stat(candidate); statErr == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	if len(candidates) == 0 {
+		if len(p.Dirs) == 0 {
+			return nil, fmt.Errorf("error finding %s in $PATH: %s", name, lookErr)
+		}
+		return nil, fmt.Errorf("could not find %s in $PATH or in %s", name, strings.Join(p.Dirs, ", "))
+	}
+
+	return candidates, nil
+}
+
+// versionMatches returns whether a binary of binVersion can be used for
+// version
+func (p *LookPathProvider) versionMatches(binVersion string, version string) bool {
+	if version == "" || binVersion == version {
+		return true
+	}
+	if !p.MatchMinorVersion {
+		return false
+	}
+
+	binParts := leadingVersionParts(binVersion)
+	parts := leadingVersionParts(version)
+	return len(binParts) >= 2 && len(parts) >= 2 && binParts[0] == parts[0] && binParts[1] == parts[1]
+}
+
+func (p *LookPathProvider) logger() *memongolog.Logger {
+	if p.Logger == nil {
+		return memongolog.New(nil, 0)
+	}
+	return p.Logger
+}
+
+// ChainProvider is a BinaryProvider that tries each of its providers in
+// order, and returns the binaries from the first that resolves them
+type ChainProvider []BinaryProvider
+
+// Resolve tries each provider in order
+func (providers ChainProvider) Resolve(ctx context.Context, version string) (*BinaryPaths, error) {
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no binary providers")
+	}
+
+	var errs []string
+	for _, provider := range providers {
+		paths, err := provider.Resolve(ctx, version)
+		if err == nil {
+			return paths, nil
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		errs = append(errs, err.Error())
+	}
+
+	return nil, fmt.Errorf("no binary provider could provide MongoDB %s: %s", version, strings.Join(errs, "; "))
+}
+
+// binaryVersion runs `binPath --version`, and returns the version it reports
+func binaryVersion(ctx context.Context, binPath string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, BinaryCheckTimeout)
+	defer cancel()
+
+	//  Safe to pass binPath
+	//nolint:gosec
+	output, runErr := exec.CommandContext(ctx, binPath, "--version").CombinedOutput()
+	if runErr != nil {
+		return "", fmt.Errorf("error running %s --version: %s: %s", binPath, runErr, strings.TrimSpace(string(output)))
+	}
+
+	match := binaryVersionRegex.FindStringSubmatch(string(output))
+	if match == nil {
+		return "", fmt.Errorf("could not find a version in the output of %s --version: %s", binPath, strings.TrimSpace(string(output)))
+	}
+
+	return match[1], nil
+}
@@ -0,0 +1,296 @@
+package mongobin_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// providerFunc adapts a function to a BinaryProvider
+type providerFunc func(ctx context.Context, version string) (*mongobin.BinaryPaths, error)
+
+func (f providerFunc) Resolve(ctx context.Context, version string) (*mongobin.BinaryPaths, error) {
+	return f(ctx, version)
+}
+
+// writeFakeMongod writes a mongod that reports the given version to dir
+func writeFakeMongod(t *testing.T, dir string, version string) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binaries are shell scripts")
+	}
+
+	mongodPath := path.Join(dir, "mongod")
+	require.NoError(t, os.WriteFile(mongodPath, []byte("#!/bin/sh\necho 'db version v"+version+"'\n"), 0755))
+	return mongodPath
+}
+
+func TestURLProvider(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	server, requests := countingServer(t, makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"}))
+	provider := &mongobin.URLProvider{
+		Downloader: &mongobin.Downloader{
+			CachePath: "/cache",
+			Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+		},
+		URL: server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+	}
+
+	paths, err := provider.Resolve(context.Background(), "6.0.4")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), *requests)
+
+	contents, err := mongobin.Afs.ReadFile(paths.Mongod)
+	require.NoError(t, err)
+	assert.Equal(t, "mongod", string(contents))
+
+	// The cache entry can't be pruned until the binaries are released
+	cache := newTestCache()
+	removed, err := cache.Prune(time.Nanosecond, 0)
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	require.NoError(t, paths.Release())
+	removed, err = cache.Prune(time.Nanosecond, 0)
+	require.NoError(t, err)
+	assert.Len(t, removed, 1)
+}
+
+func TestURLProviderStopsWhenContextIsDone(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		// lockHeld makes another live process hold the lock on the cache
+		// entry
+		lockHeld bool
+	}{
+		"Waiting for the lock": {
+			lockHeld: true,
+		},
+		"Retrying the download": {},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+			setFastLocks(t)
+
+			oldBackoff := mongobin.DownloadInitialBackoff
+			mongobin.DownloadInitialBackoff = time.Minute
+			defer func() { mongobin.DownloadInitialBackoff = oldBackoff }()
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+			urlStr := server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+			if test.lockHeld {
+				lockPath := "/cache/.locks/mongodb-linux-x86_64-ubuntu2204-6_0_4_tgz_" + sha256Hex([]byte(urlStr))[0:10] + ".lock"
+				require.NoError(t, mongobin.Afs.WriteFile(lockPath, []byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), hostname)), 0644))
+			}
+
+			provider := &mongobin.URLProvider{
+				Downloader: &mongobin.Downloader{
+					CachePath: "/cache",
+					Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+				},
+				URL: urlStr,
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			_, err := provider.Resolve(ctx, "6.0.4")
+			assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+			assert.Less(t, time.Since(start), 5*time.Second)
+		})
+	}
+}
+
+func TestSharedDownloadOutlivesTheCallerThatStartedIt(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	archive := makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"})
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		requested <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	provider := &mongobin.URLProvider{
+		Downloader: &mongobin.Downloader{
+			CachePath: "/cache",
+			Logger:    memongolog.New(nil, memongolog.LogLevelSilent),
+		},
+		URL: server.URL + "/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz",
+	}
+
+	// The first caller starts the download, and a second one waits for it
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := provider.Resolve(ctx, "")
+		firstErr <- err
+	}()
+	<-requested
+
+	secondErr := make(chan error)
+	go func() {
+		paths, err := provider.Resolve(context.Background(), "")
+		if err == nil {
+			err = paths.Release()
+		}
+		secondErr <- err
+	}()
+	// Give the second caller a chance to join the download
+	time.Sleep(100 * time.Millisecond)
+
+	// The first caller giving up doesn't stop the download for the second
+	cancel()
+	assert.True(t, errors.Is(<-firstErr, context.Canceled))
+	close(release)
+	assert.NoError(t, <-secondErr)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestFixedPathProvider(t *testing.T) {
+	mongodPath := writeFakeMongod(t, t.TempDir(), "6.0.4")
+
+	paths, err := (&mongobin.FixedPathProvider{Mongod: mongodPath}).Resolve(context.Background(), "5.0.3")
+	require.NoError(t, err)
+	assert.Equal(t, mongodPath, paths.Mongod)
+	assert.Nil(t, paths.Release)
+
+	_, err = (&mongobin.FixedPathProvider{Mongod: mongodPath + "-missing"}).Resolve(context.Background(), "")
+	require.Error(t, err)
+}
+
+func TestLookPathProvider(t *testing.T) {
+	dir := t.TempDir()
+	mongodPath := writeFakeMongod(t, dir, "6.0.4")
+	t.Setenv("PATH", dir)
+
+	otherDir := t.TempDir()
+	otherMongodPath := writeFakeMongod(t, otherDir, "7.0.2")
+
+	tests := map[string]struct {
+		name       string
+		version    string
+		dirs       []string
+		matchMinor bool
+
+		expectedPath  string
+		expectedError string
+	}{
+		"Same version": {
+			version:      "6.0.4",
+			expectedPath: mongodPath,
+		},
+		"Any version": {
+			expectedPath: mongodPath,
+		},
+		"Other version": {
+			version:       "6.0.5",
+			expectedError: mongodPath + " is MongoDB 6.0.4, not 6.0.5",
+		},
+		"Same minor version": {
+			version:      "6.0.5",
+			matchMinor:   true,
+			expectedPath: mongodPath,
+		},
+		"Other minor version": {
+			version:       "6.1.0",
+			matchMinor:    true,
+			expectedError: mongodPath + " is MongoDB 6.0.4, not 6.1.0",
+		},
+		"Found in dirs": {
+			version:      "7.0.2",
+			dirs:         []string{t.TempDir(), otherDir},
+			expectedPath: otherMongodPath,
+		},
+		"No match in PATH or dirs": {
+			version:       "8.0.0",
+			dirs:          []string{otherDir},
+			expectedError: mongodPath + " is MongoDB 6.0.4, not 8.0.0; " + otherMongodPath + " is MongoDB 7.0.2, not 8.0.0",
+		},
+		"Not in PATH": {
+			name:          "mongod7",
+			expectedError: `error finding mongod7 in $PATH: exec: "mongod7": executable file not found in $PATH`,
+		},
+		"Not in PATH or dirs": {
+			name:          "mongod7",
+			dirs:          []string{otherDir},
+			expectedError: "could not find mongod7 in $PATH or in " + otherDir,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			provider := &mongobin.LookPathProvider{
+				Name:              test.name,
+				Dirs:              test.dirs,
+				MatchMinorVersion: test.matchMinor,
+				Logger:            memongolog.New(nil, memongolog.LogLevelSilent),
+			}
+
+			paths, err := provider.Resolve(context.Background(), test.version)
+			if test.expectedError != "" {
+				require.EqualError(t, err, test.expectedError)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedPath, paths.Mongod)
+		})
+	}
+}
+
+func TestChainProvider(t *testing.T) {
+	failing := providerFunc(func(ctx context.Context, version string) (*mongobin.BinaryPaths, error) {
+		return nil, errors.New("not here")
+	})
+	var calls []string
+	found := func(name string) mongobin.BinaryProvider {
+		return providerFunc(func(ctx context.Context, version string) (*mongobin.BinaryPaths, error) {
+			calls = append(calls, name)
+			return &mongobin.BinaryPaths{Mongod: "/" + name + "/mongod"}, nil
+		})
+	}
+
+	paths, err := mongobin.ChainProvider{failing, found("first"), found("second")}.Resolve(context.Background(), "6.0.4")
+	require.NoError(t, err)
+	assert.Equal(t, "/first/mongod", paths.Mongod)
+	assert.Equal(t, []string{"first"}, calls)
+
+	_, err = mongobin.ChainProvider{failing, failing}.Resolve(context.Background(), "6.0.4")
+	require.EqualError(t, err, "no binary provider could provide MongoDB 6.0.4: not here; not here")
+
+	_, err = mongobin.ChainProvider{}.Resolve(context.Background(), "6.0.4")
+	require.EqualError(t, err, "no binary providers")
+}
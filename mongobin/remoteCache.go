@@ -0,0 +1,289 @@
+package mongobin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// RemoteCacheTimeout is how long fetching an entry from a RemoteCache, or
+// uploading one to it, may take
+var RemoteCacheTimeout = 5 * time.Minute
+
+// maxRemoteMetadataSize is the largest entry metadata we read from a
+// RemoteCache
+const maxRemoteMetadataSize = 1 << 20
+
+var sha256Regex = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// ErrRemoteCacheMiss is returned by a RemoteCache that doesn't hold a key
+var ErrRemoteCacheMiss = errors.New("not in the remote cache")
+
+// RemoteCache is a second-level cache shared between machines, e.g.
+// ephemeral CI runners. When a binary isn't in the local cache, it's
+// fetched from the remote cache before downloading it, and binaries that
+// had to be downloaded are uploaded to it.
+//
+// Entries are keyed by the SHA-256 checksum of the archive they were
+// extracted from, and binaries by their own. The name of the local cache
+// entry, which is derived from the archive's official URL, points to the
+// checksum of the archive, so the entries are shared whichever mirror the
+// archive was downloaded from.
+//
+// Only archives that were checked against a checksum, either the one MongoDB
+// publishes or a local .sha256 file, are uploaded. What's fetched is checked
+// against the checksums in the remote cache, so anyone who can write to it
+// can make memongo run any binary: only share it with machines you trust.
+type RemoteCache interface {
+	// Get returns the contents stored under key, or ErrRemoteCacheMiss
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Put stores size bytes of contents under key
+	Put(ctx context.Context, key string, contents io.Reader, size int64) error
+}
+
+// HTTPRemoteCache is a RemoteCache on an HTTP server that serves GET and PUT
+// requests for <BaseURL>/<key>, like a build cache server or a WebDAV share
+type HTTPRemoteCache struct {
+	// BaseURL is the URL keys are relative to
+	BaseURL string
+
+	// HTTPClient is used for the requests. Defaults to a client that uses
+	// DownloadConnectTimeout.
+	HTTPClient *http.Client
+
+	// Headers are added to every request, e.g. to authenticate
+	Headers http.Header
+}
+
+// Get downloads the contents stored under key
+func (c *HTTPRemoteCache) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrRemoteCacheMiss
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s failed with status code %d", RedactURL(c.url(key)), resp.StatusCode)
+	}
+}
+
+// Put uploads contents under key
+func (c *HTTPRemoteCache) Put(ctx context.Context, key string, contents io.Reader, size int64) error {
+	resp, err := c.do(ctx, http.MethodPut, key, contents, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT %s failed with status code %d", RedactURL(c.url(key)), resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *HTTPRemoteCache) do(ctx context.Context, method string, key string, body io.Reader, size int64) (*http.Response, error) {
+	urlStr := c.url(key)
+
+	req, reqErr := http.NewRequestWithContext(ctx, method, urlStr, body)
+	if reqErr != nil {
+		return nil, fmt.Errorf("error creating request for %s: %s", RedactURL(urlStr), stripURLFromError(reqErr))
+	}
+	req.ContentLength = size
+	for name, values := range c.Headers {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = newDownloadClient()
+	}
+
+	resp, doErr := client.Do(req)
+	if doErr != nil {
+		return nil, fmt.Errorf("error requesting %s: %s", RedactURL(urlStr), stripURLFromError(doErr))
+	}
+
+	return resp, nil
+}
+
+func (c *HTTPRemoteCache) url(key string) string {
+	return strings.TrimSuffix(c.BaseURL, "/") + "/" + key
+}
+
+// remoteArchiveKey is the key of the checksum of the archive of the cache
+// entry named dirname in a RemoteCache
+func remoteArchiveKey(dirname string) string {
+	return "archives/" + url.PathEscape(dirname)
+}
+
+// remoteEntryKey is the key of the metadata of the binaries extracted from
+// the archive with the given checksum in a RemoteCache
+func remoteEntryKey(archiveSHA256 string) string {
+	return "entries/" + archiveSHA256 + ".json"
+}
+
+// remoteBinaryKey is the key of a binary in a RemoteCache
+func remoteBinaryKey(sha256 string) string {
+	return "binaries/" + sha256
+}
+
+// fetchFromRemoteCache fetches the wanted binaries from the archive named
+// archiveName from the remote cache into dirPath, and checks them against
+// the metadata in the remote cache. It returns ErrRemoteCacheMiss if the
+// remote cache doesn't hold the archive's entry, or one of the required
+// binaries.
+func (d *Downloader) fetchFromRemoteCache(ctx context.Context, archiveName string, dirPath string, wanted map[string]bool) (*CacheMetadata, error) {
+	if archiveName == "" {
+		return nil, ErrRemoteCacheMiss
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RemoteCacheTimeout)
+	defer cancel()
+
+	archiveSHA, shaErr := d.getRemoteArchiveSHA256(ctx, archiveName)
+	if shaErr != nil {
+		return nil, shaErr
+	}
+
+	contents, getErr := d.RemoteCache.Get(ctx, remoteEntryKey(archiveSHA))
+	if getErr != nil {
+		return nil, getErr
+	}
+	defer contents.Close()
+
+	remote := &CacheMetadata{}
+	if jsonErr := json.NewDecoder(io.LimitReader(contents, maxRemoteMetadataSize)).Decode(remote); jsonErr != nil {
+		return nil, fmt.Errorf("error parsing metadata of %s: %s", archiveName, jsonErr)
+	}
+	if remote.ArchiveSHA256 != archiveSHA {
+		return nil, fmt.Errorf("metadata of %s is for the archive with SHA-256 %s, not %s", archiveName, remote.ArchiveSHA256, archiveSHA)
+	}
+	for name, required := range wanted {
+		if _, ok := remote.Binaries[name]; required && !ok {
+			return nil, ErrRemoteCacheMiss
+		}
+	}
+
+	fetched := &CacheMetadata{
+		SourceURL:     remote.SourceURL,
+		ArchiveSHA256: remote.ArchiveSHA256,
+		Version:       remote.Version,
+		Binaries:      map[string]BinaryMetadata{},
+	}
+	for _, name := range sortedKeys(remote.Binaries) {
+		if _, ok := wanted[name]; !ok {
+			continue
+		}
+
+		binMetadata, fetchErr := d.fetchRemoteBinary(ctx, path.Join(dirPath, name), remote.Binaries[name])
+		if fetchErr != nil {
+			for fetchedName := range fetched.Binaries {
+				_ = Afs.Remove(path.Join(dirPath, fetchedName))
+			}
+			return nil, fmt.Errorf("error fetching %s: %w", name, fetchErr)
+		}
+		fetched.Binaries[name] = binMetadata
+	}
+
+	return fetched, nil
+}
+
+// getRemoteArchiveSHA256 returns the checksum the remote cache holds for the
+// archive named archiveName
+func (d *Downloader) getRemoteArchiveSHA256(ctx context.Context, archiveName string) (string, error) {
+	contents, getErr := d.RemoteCache.Get(ctx, remoteArchiveKey(archiveName))
+	if getErr != nil {
+		return "", getErr
+	}
+	defer contents.Close()
+
+	// The checksum is 64 hex digits; anything longer isn't one
+	checksum, readErr := io.ReadAll(io.LimitReader(contents, 128))
+	if readErr != nil {
+		return "", fmt.Errorf("error reading checksum of %s: %s", archiveName, readErr)
+	}
+	archiveSHA := strings.TrimSpace(string(checksum))
+	if !sha256Regex.MatchString(archiveSHA) {
+		return "", fmt.Errorf("invalid checksum for %s in the remote cache", archiveName)
+	}
+
+	return archiveSHA, nil
+}
+
+// fetchRemoteBinary fetches a binary from the remote cache to binPath, and
+// checks it against its metadata
+func (d *Downloader) fetchRemoteBinary(ctx context.Context, binPath string, expected BinaryMetadata) (BinaryMetadata, error) {
+	contents, getErr := d.RemoteCache.Get(ctx, remoteBinaryKey(expected.SHA256))
+	if getErr != nil {
+		return BinaryMetadata{}, getErr
+	}
+	defer contents.Close()
+
+	binMetadata, saveErr := saveFile(binPath, contents, d.logger())
+	if saveErr != nil {
+		return BinaryMetadata{}, saveErr
+	}
+	if binMetadata != expected {
+		_ = Afs.Remove(binPath)
+		return BinaryMetadata{}, fmt.Errorf("expected SHA-256 %s (%d bytes), got %s (%d bytes)", expected.SHA256, expected.Size, binMetadata.SHA256, binMetadata.Size)
+	}
+
+	return binMetadata, nil
+}
+
+// uploadToRemoteCache uploads the binaries extracted from the archive named
+// archiveName, followed by their metadata and the archive's checksum, so the
+// entry is only found once it's complete
+func (d *Downloader) uploadToRemoteCache(ctx context.Context, archiveName string, dirPath string, metadata *CacheMetadata) error {
+	if archiveName == "" || !sha256Regex.MatchString(metadata.ArchiveSHA256) {
+		return fmt.Errorf("the archive at %s can't be identified", metadata.SourceURL)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RemoteCacheTimeout)
+	defer cancel()
+
+	for _, name := range sortedKeys(metadata.Binaries) {
+		binMetadata := metadata.Binaries[name]
+
+		file, openErr := Afs.Open(path.Join(dirPath, name))
+		if openErr != nil {
+			return openErr
+		}
+		putErr := d.RemoteCache.Put(ctx, remoteBinaryKey(binMetadata.SHA256), file, binMetadata.Size)
+		file.Close()
+		if putErr != nil {
+			return fmt.Errorf("error uploading %s: %w", name, putErr)
+		}
+	}
+
+	contents, jsonErr := json.MarshalIndent(metadata, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	if putErr := d.RemoteCache.Put(ctx, remoteEntryKey(metadata.ArchiveSHA256), bytes.NewReader(contents), int64(len(contents))); putErr != nil {
+		return putErr
+	}
+
+	return d.RemoteCache.Put(ctx, remoteArchiveKey(archiveName), strings.NewReader(metadata.ArchiveSHA256), int64(len(metadata.ArchiveSHA256)))
+}
@@ -0,0 +1,245 @@
+package mongobin_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// remoteCacheServer is a build-cache-like server that stores what's PUT, and
+// serves it back on GET
+type remoteCacheServer struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	entries map[string][]byte
+	gets    int
+}
+
+func newRemoteCacheServer(t *testing.T) *remoteCacheServer {
+	cacheServer := &remoteCacheServer{entries: map[string][]byte{}}
+	cacheServer.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cacheServer.mu.Lock()
+		defer cacheServer.mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer cache-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			cacheServer.gets++
+			contents, ok := cacheServer.entries[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_, _ = w.Write(contents)
+		case http.MethodPut:
+			contents, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			cacheServer.entries[r.URL.Path] = contents
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(cacheServer.server.Close)
+
+	return cacheServer
+}
+
+func (s *remoteCacheServer) remoteCache() *mongobin.HTTPRemoteCache {
+	return &mongobin.HTTPRemoteCache{
+		BaseURL: s.server.URL + "/memongo/",
+		Headers: http.Header{"Authorization": {"Bearer cache-token"}},
+	}
+}
+
+func (s *remoteCacheServer) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checksummedServer serves archive, and its checksum next to it, whichever
+// host the request is for. It counts the requests for the archive.
+func checksummedServer(t *testing.T, archive []byte) (*http.Client, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".sha256") {
+			_, _ = w.Write([]byte(sha256Hex(archive)))
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(archive)
+	}))
+	t.Cleanup(server.Close)
+	target, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	return &http.Client{Transport: hostTransport{target}}, &requests
+}
+
+func TestRemoteCache(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	cacheServer := newRemoteCacheServer(t)
+	httpClient, requests := checksummedServer(t, makeTarball(t, map[string]string{
+		"mongodb/bin/mongod": "mongod",
+		"mongodb/bin/mongos": "mongos",
+	}))
+	urlStr := "https://fastdl.mongodb.org/linux/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"
+
+	downloader := &mongobin.Downloader{
+		CachePath:   "/cache",
+		Logger:      memongolog.New(nil, memongolog.LogLevelSilent),
+		HTTPClient:  httpClient,
+		RemoteCache: cacheServer.remoteCache(),
+	}
+
+	// The first runner downloads the binaries, and uploads them
+	_, err := downloader.GetOrDownloadMongod(urlStr)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	keys := cacheServer.keys()
+	require.Len(t, keys, 4)
+	assert.Regexp(t, `^/memongo/archives/mongodb-linux-x86_64-ubuntu2204-6_0_4_tgz_[0-9a-f]{10}$`, keys[0])
+	assert.Regexp(t, `^/memongo/binaries/[0-9a-f]{64}$`, keys[1])
+	assert.Regexp(t, `^/memongo/binaries/[0-9a-f]{64}$`, keys[2])
+	assert.Regexp(t, `^/memongo/entries/[0-9a-f]{64}\.json$`, keys[3])
+
+	// The next runner, with an empty cache, fetches them from the remote
+	// cache, even if it would download the archive from a mirror
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+	provider := &mongobin.URLProvider{
+		Downloader: downloader,
+		URL:        urlStr,
+		MirrorURLs: []string{"https://mirror.example.com/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz"},
+	}
+	binPaths, err := provider.Resolve(context.Background(), "6.0.4")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	contents, err := mongobin.Afs.ReadFile(binPaths.Mongod)
+	require.NoError(t, err)
+	assert.Equal(t, "mongod", string(contents))
+
+	entries, err := newTestCache().List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "6.0.4", entries[0].Version)
+	assert.Equal(t, urlStr, entries[0].SourceURL)
+
+	// A corrupt binary in the remote cache is downloaded instead
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+	cacheServer.mu.Lock()
+	for key := range cacheServer.entries {
+		if strings.Contains(key, "/binaries/") {
+			cacheServer.entries[key] = []byte("corrupt")
+		}
+	}
+	cacheServer.mu.Unlock()
+
+	binPath, err := downloader.GetOrDownloadMongod(urlStr)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(requests))
+
+	contents, err = mongobin.Afs.ReadFile(binPath)
+	require.NoError(t, err)
+	assert.Equal(t, "mongod", string(contents))
+}
+
+func TestRemoteCacheOnlyGetsVerifiedArchives(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	cacheServer := newRemoteCacheServer(t)
+	tarball := makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"})
+	server, _ := countingServer(t, tarball)
+	require.NoError(t, mongobin.Afs.WriteFile("/archives/mongodb.tgz", tarball, 0644))
+	require.NoError(t, mongobin.Afs.WriteFile("/archives/mongodb.tgz.sha256", []byte(sha256Hex(tarball)), 0644))
+
+	downloader := &mongobin.Downloader{
+		CachePath:   "/cache",
+		Logger:      memongolog.New(nil, memongolog.LogLevelSilent),
+		RemoteCache: cacheServer.remoteCache(),
+	}
+
+	// There's no checksum to check a custom URL against
+	_, err := downloader.GetOrDownloadMongod(server.URL + "/mongodb.tgz")
+	require.NoError(t, err)
+	assert.Empty(t, cacheServer.keys())
+
+	// A local archive is checked against the checksum next to it
+	_, err = downloader.GetOrDownloadMongod("/archives/mongodb.tgz")
+	require.NoError(t, err)
+	keys := cacheServer.keys()
+	require.Len(t, keys, 3)
+	assert.Regexp(t, `^/memongo/archives/mongodb_tgz_[0-9a-f]{10}$`, keys[0])
+}
+
+func TestVendoredArchiveIsUsedBeforeRemoteCache(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	cacheServer := newRemoteCacheServer(t)
+	tarball := makeTarball(t, map[string]string{"mongodb/bin/mongod": "mongod"})
+	require.NoError(t, mongobin.Afs.WriteFile("/vendor/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz", tarball, 0644))
+
+	downloader := &mongobin.Downloader{
+		CachePath:   "/cache",
+		Logger:      memongolog.New(nil, memongolog.LogLevelSilent),
+		ArchiveDir:  "/vendor",
+		RemoteCache: cacheServer.remoteCache(),
+	}
+
+	_, err := downloader.GetOrDownloadMongod("https://fastdl.mongodb.org/linux/mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz")
+	require.NoError(t, err)
+
+	cacheServer.mu.Lock()
+	defer cacheServer.mu.Unlock()
+	assert.Zero(t, cacheServer.gets)
+}
+
+func TestHTTPRemoteCache(t *testing.T) {
+	cacheServer := newRemoteCacheServer(t)
+	remoteCache := cacheServer.remoteCache()
+
+	_, err := remoteCache.Get(context.Background(), "entries/missing.json")
+	require.ErrorIs(t, err, mongobin.ErrRemoteCacheMiss)
+
+	require.NoError(t, remoteCache.Put(context.Background(), "binaries/abc", strings.NewReader("mongod"), 6))
+	contents, err := remoteCache.Get(context.Background(), "binaries/abc")
+	require.NoError(t, err)
+	defer contents.Close()
+	read, err := io.ReadAll(contents)
+	require.NoError(t, err)
+	assert.Equal(t, "mongod", string(read))
+
+	remoteCache.Headers = nil
+	err = remoteCache.Put(context.Background(), "binaries/abc", strings.NewReader("mongod"), 6)
+	require.EqualError(t, err, "PUT "+cacheServer.server.URL+"/memongo/binaries/abc failed with status code 403")
+}
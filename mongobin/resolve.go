@@ -0,0 +1,373 @@
+package mongobin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/tryvium-travels/memongo/memongolog"
+)
+
+// DefaultReleaseCatalogURL is MongoDB's catalog of every release, and the
+// builds published for it
+const DefaultReleaseCatalogURL = "https://downloads.mongodb.org/full.json"
+
+// ReleaseCatalogMaxAge is how long a downloaded release catalog is used
+// before it's downloaded again
+var ReleaseCatalogMaxAge = 24 * time.Hour
+
+// BuildCheckRetryInterval is how long a server that couldn't be reached to
+// check which builds exist isn't asked again, so that setups without network
+// access don't wait for it to time out every time
+var BuildCheckRetryInterval = time.Hour
+
+// catalogDirName is the directory in the cache where the release catalog is
+// kept, along with recent failures to reach the servers that are checked for
+// builds
+const catalogDirName = ".catalog"
+
+// BuildChecker checks whether MongoDB publishes a build
+type BuildChecker interface {
+	// BuildExists returns whether the archive described by spec exists
+	BuildExists(spec *DownloadSpec) (bool, error)
+}
+
+// ReleaseCatalog is a BuildChecker that looks builds up in MongoDB's release
+// catalog. The catalog is downloaded once, and kept in the cache for
+// ReleaseCatalogMaxAge.
+type ReleaseCatalog struct {
+	// URL of the catalog. Defaults to DefaultReleaseCatalogURL.
+	URL string
+
+	// CachePath is the cache directory the catalog is kept in. If it's
+	// empty, the catalog is downloaded every time it's loaded.
+	CachePath string
+
+	// HTTPClient is used to download the catalog. Defaults to a client that
+	// uses DownloadConnectTimeout.
+	HTTPClient *http.Client
+
+	once     sync.Once
+	archives map[string]bool
+	loadErr  error
+}
+
+// releaseCatalogJSON is the part of the release catalog we care about
+type releaseCatalogJSON struct {
+	Versions []struct {
+		Downloads []struct {
+			Archive struct {
+				URL string `json:"url"`
+			} `json:"archive"`
+		} `json:"downloads"`
+	} `json:"versions"`
+}
+
+// BuildExists returns whether the catalog lists the archive described by
+// spec
+func (c *ReleaseCatalog) BuildExists(spec *DownloadSpec) (bool, error) {
+	c.once.Do(func() {
+		c.archives, c.loadErr = c.load()
+	})
+	if c.loadErr != nil {
+		return false, c.loadErr
+	}
+
+	return c.archives[spec.archiveName()], nil
+}
+
+func (c *ReleaseCatalog) load() (map[string]bool, error) {
+	catalogURL := c.URL
+	if catalogURL == "" {
+		catalogURL = DefaultReleaseCatalogURL
+	}
+
+	cachedPath := ""
+	if c.CachePath != "" {
+		if dirname, nameErr := directoryNameForURL(catalogURL); nameErr == nil {
+			cachedPath = path.Join(c.CachePath, catalogDirName, dirname)
+		}
+	}
+
+	var cached []byte
+	if cachedPath != "" {
+		if info, statErr := Afs.Stat(cachedPath); statErr == nil {
+			cached, _ = Afs.ReadFile(cachedPath)
+			if cached != nil && time.Since(info.ModTime()) < ReleaseCatalogMaxAge {
+				return parseReleaseCatalog(cached)
+			}
+		}
+	}
+
+	var contents []byte
+	downloadErr := recentCheckFailure(c.CachePath, catalogURL)
+	if downloadErr == nil {
+		contents, downloadErr = c.download(catalogURL)
+		if downloadErr != nil {
+			recordCheckFailure(c.CachePath, catalogURL, downloadErr)
+		}
+	}
+	if downloadErr != nil {
+		// A stale catalog is better than none
+		if cached != nil {
+			return parseReleaseCatalog(cached)
+		}
+		return nil, downloadErr
+	}
+
+	archives, parseErr := parseReleaseCatalog(contents)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	if cachedPath != "" {
+		if mkdirErr := Afs.MkdirAll(path.Dir(cachedPath), 0755); mkdirErr == nil {
+			_ = Afs.WriteFile(cachedPath, contents, 0644)
+		}
+	}
+
+	return archives, nil
+}
+
+func (c *ReleaseCatalog) download(catalogURL string) ([]byte, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = newDownloadClient()
+	}
+
+	resp, getErr := client.Get(catalogURL)
+	if getErr != nil {
+		return nil, fmt.Errorf("error getting release catalog from %s: %s", RedactURL(catalogURL), stripURLFromError(getErr))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting release catalog from %s: HTTP request failed with status code %d", RedactURL(catalogURL), resp.StatusCode)
+	}
+
+	body := newIdleTimeoutReader(resp.Body, DownloadIdleTimeout, func() { _ = resp.Body.Close() })
+	defer body.stop()
+
+	contents, readErr := io.ReadAll(body)
+	if readErr != nil {
+		return nil, fmt.Errorf("error reading release catalog from %s: %s", RedactURL(catalogURL), stripURLFromError(readErr))
+	}
+
+	return contents, nil
+}
+
+func parseReleaseCatalog(contents []byte) (map[string]bool, error) {
+	catalog := releaseCatalogJSON{}
+	if jsonErr := json.Unmarshal(contents, &catalog); jsonErr != nil {
+		return nil, fmt.Errorf("error parsing release catalog: %s", jsonErr)
+	}
+
+	archives := map[string]bool{}
+	for _, version := range catalog.Versions {
+		for _, download := range version.Downloads {
+			if download.Archive.URL != "" {
+				archives[path.Base(download.Archive.URL)] = true
+			}
+		}
+	}
+
+	return archives, nil
+}
+
+// HeadChecker is a BuildChecker that checks whether an archive exists by
+// sending a HEAD request for it
+type HeadChecker struct {
+	// URLTemplate is where archives are downloaded from (see
+	// DownloadSpec.ExpandURLTemplate). Defaults to the official download
+	// location.
+	URLTemplate string
+
+	// HTTPClient is used to send the requests. Defaults to a client that
+	// uses DownloadConnectTimeout.
+	HTTPClient *http.Client
+
+	// Headers are added to every request, e.g. to authenticate with an
+	// artifact store. They're never sent to MongoDB's download servers.
+	Headers http.Header
+
+	// CachePath is the cache directory where failures to reach the server
+	// are recorded, so it's not asked again for BuildCheckRetryInterval. If
+	// it's empty, the server is always asked.
+	CachePath string
+}
+
+// BuildExists sends a HEAD request for the archive described by spec
+func (c *HeadChecker) BuildExists(spec *DownloadSpec) (bool, error) {
+	urlStr := spec.GetDownloadURL()
+	if c.URLTemplate != "" {
+		var templateErr error
+		urlStr, templateErr = spec.ExpandURLTemplate(c.URLTemplate)
+		if templateErr != nil {
+			return false, templateErr
+		}
+	}
+
+	req, reqErr := http.NewRequest(http.MethodHead, urlStr, nil)
+	if reqErr != nil {
+		return false, fmt.Errorf("error creating request for %s: %s", RedactURL(urlStr), stripURLFromError(reqErr))
+	}
+
+	// Failures are recorded per server, since they're about reaching it
+	serverURL := req.URL.Scheme + "://" + req.URL.Host + "/"
+	if failedErr := recentCheckFailure(c.CachePath, serverURL); failedErr != nil {
+		return false, failedErr
+	}
+	if !contains(mongoDBHosts, req.URL.Hostname()) {
+		for name, values := range c.Headers {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = newDownloadClient()
+	}
+
+	resp, headErr := client.Do(req)
+	if headErr != nil {
+		checkErr := fmt.Errorf("error checking for %s: %s", RedactURL(urlStr), stripURLFromError(headErr))
+		recordCheckFailure(c.CachePath, serverURL, checkErr)
+		return false, checkErr
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		// S3, which serves fastdl.mongodb.org, answers 403 for missing files
+		return false, nil
+	default:
+		checkErr := fmt.Errorf("error checking for %s: HTTP request failed with status code %d", RedactURL(urlStr), resp.StatusCode)
+		recordCheckFailure(c.CachePath, serverURL, checkErr)
+		return false, checkErr
+	}
+}
+
+// checkFailurePath returns where a failure to reach urlStr is recorded in
+// the cache at cachePath, or "" if it's not recorded
+func checkFailurePath(cachePath string, urlStr string) string {
+	if cachePath == "" {
+		return ""
+	}
+
+	dirname, nameErr := directoryNameForURL(urlStr)
+	if nameErr != nil {
+		return ""
+	}
+
+	return path.Join(cachePath, catalogDirName, dirname+".failed")
+}
+
+// recentCheckFailure returns the error recorded by recordCheckFailure if
+// reaching urlStr failed within BuildCheckRetryInterval
+func recentCheckFailure(cachePath string, urlStr string) error {
+	failurePath := checkFailurePath(cachePath, urlStr)
+	if failurePath == "" {
+		return nil
+	}
+
+	info, statErr := Afs.Stat(failurePath)
+	if statErr != nil || time.Since(info.ModTime()) >= BuildCheckRetryInterval {
+		return nil
+	}
+
+	recorded, readErr := Afs.ReadFile(failurePath)
+	if readErr != nil {
+		return nil
+	}
+
+	retryIn := BuildCheckRetryInterval - time.Since(info.ModTime())
+	return fmt.Errorf("%s (not trying again for %s)", recorded, retryIn.Round(time.Second))
+}
+
+// recordCheckFailure records that reaching urlStr failed with err, so it's
+// not tried again for BuildCheckRetryInterval
+func recordCheckFailure(cachePath string, urlStr string, err error) {
+	failurePath := checkFailurePath(cachePath, urlStr)
+	if failurePath == "" {
+		return
+	}
+
+	if mkdirErr := Afs.MkdirAll(path.Dir(failurePath), 0755); mkdirErr == nil {
+		_ = Afs.WriteFile(failurePath, []byte(err.Error()), 0644)
+	}
+}
+
+// ResolveCompatibleSpec is like DetectSpecWithLogger, but picks the
+// newest build published for the requested version that's compatible with
+// the current system. Starting with the newest build for the distro's
+// release, it walks down through the builds MongoDB publishes for the distro
+// family until the checkers report one that exists. Each build is checked
+// with the first checker that doesn't fail.
+//
+// If no checker can tell which builds exist (e.g. when offline), or
+// overrides sets the OSName, the spec from DetectSpecWithLogger is returned.
+func ResolveCompatibleSpec(version string, overrides *SpecOverrides, logger *memongolog.Logger, checkers ...BuildChecker) (*DownloadSpec, error) {
+	spec, specErr := DetectSpecWithLogger(version, overrides, logger)
+	if specErr != nil || spec.OSName == "" || (overrides != nil && overrides.OSName != "") {
+		return spec, specErr
+	}
+
+	parsedVersion, _ := parseVersion(version)
+	system, _ := overrides.targetSystem()
+
+	// The newest build for this release of the distro, ignoring when
+	// MongoDB started publishing it
+	newest := detectOSName(system, []int{math.MaxInt32, 0, 0}, memongolog.New(nil, memongolog.LogLevelSilent))
+
+	for _, osName := range system.rules.family(newest, system.goArch) {
+		arch, archErr := detectArch(system, osName, parsedVersion)
+		if archErr != nil {
+			continue
+		}
+
+		candidate := *spec
+		candidate.OSName = osName
+		candidate.Arch = arch
+
+		exists, checkErr := buildExists(&candidate, checkers)
+		if checkErr != nil {
+			logger.Debugf("could not check which builds of MongoDB %s exist, using the %s build: %s", version, spec.OSName, checkErr)
+			return spec, nil
+		}
+		if !exists {
+			logger.Debugf("MongoDB %s is not published for %s/%s", version, osName, arch)
+			continue
+		}
+
+		if osName != spec.OSName {
+			logger.Infof("using the %s build of MongoDB %s, the newest one published for your system", osName, version)
+		}
+		return &candidate, nil
+	}
+
+	return spec, nil
+}
+
+// buildExists checks whether the build exists with the first checker that
+// doesn't fail
+func buildExists(spec *DownloadSpec, checkers []BuildChecker) (bool, error) {
+	lastErr := fmt.Errorf("no build checkers")
+	for _, checker := range checkers {
+		exists, err := checker.BuildExists(spec)
+		if err == nil {
+			return exists, nil
+		}
+		lastErr = err
+	}
+
+	return false, lastErr
+}
@@ -0,0 +1,239 @@
+package mongobin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tryvium-travels/memongo/memongolog"
+	"github.com/tryvium-travels/memongo/mongobin"
+)
+
+// linuxOverrides makes the spec detection see the given test distro on
+// linux/amd64
+func linuxOverrides(etcFolder string) *mongobin.SpecOverrides {
+	return &mongobin.SpecOverrides{Platform: "linux", Arch: "amd64", EtcDir: "./testdata/etc/" + etcFolder}
+}
+
+// catalogServer serves a release catalog listing the given archives
+func catalogServer(t *testing.T, archives ...string) (*httptest.Server, *int32) {
+	type download struct {
+		Archive struct {
+			URL string `json:"url"`
+		} `json:"archive"`
+	}
+	downloads := make([]download, len(archives))
+	for i, archive := range archives {
+		downloads[i].Archive.URL = "https://fastdl.mongodb.org/linux/" + archive
+	}
+	catalog, err := json.Marshal(map[string]interface{}{
+		"versions": []interface{}{map[string]interface{}{"downloads": downloads}},
+	})
+	require.NoError(t, err)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write(catalog)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+// headServer answers HEAD requests for the given archives, and 404s for
+// anything else
+func headServer(t *testing.T, archives ...string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, archive := range archives {
+			if strings.HasSuffix(r.URL.Path, "/"+archive) {
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestResolveCompatibleSpec(t *testing.T) {
+	silent := memongolog.New(nil, memongolog.LogLevelSilent)
+
+	tests := map[string]struct {
+		etcFolder      string
+		mongoVersion   string
+		archives       []string
+		expectedOSName string
+	}{
+		"Exact build exists": {
+			etcFolder:      "ubuntu2204",
+			mongoVersion:   "6.0.4",
+			archives:       []string{"mongodb-linux-x86_64-ubuntu2204-6.0.4.tgz", "mongodb-linux-x86_64-ubuntu2004-6.0.4.tgz"},
+			expectedOSName: "ubuntu2204",
+		},
+		"Exact build missing": {
+			etcFolder:      "ubuntu2204",
+			mongoVersion:   "6.0.4",
+			archives:       []string{"mongodb-linux-x86_64-ubuntu2004-6.0.4.tgz", "mongodb-linux-x86_64-ubuntu1804-6.0.4.tgz"},
+			expectedOSName: "ubuntu2004",
+		},
+		"Newer build than the static rules know of": {
+			etcFolder:      "ubuntu2404",
+			mongoVersion:   "7.0.2",
+			archives:       []string{"mongodb-linux-x86_64-ubuntu2404-7.0.2.tgz", "mongodb-linux-x86_64-ubuntu2204-7.0.2.tgz"},
+			expectedOSName: "ubuntu2404",
+		},
+		"Debian": {
+			etcFolder:      "debianbookworm",
+			mongoVersion:   "6.0.12",
+			archives:       []string{"mongodb-linux-x86_64-debian12-6.0.12.tgz", "mongodb-linux-x86_64-debian11-6.0.12.tgz"},
+			expectedOSName: "debian12",
+		},
+		"Derivative distro": {
+			etcFolder:      "rocky8",
+			mongoVersion:   "5.0.3",
+			archives:       []string{"mongodb-linux-x86_64-rhel70-5.0.3.tgz"},
+			expectedOSName: "rhel70",
+		},
+		"Builds for other archs are skipped": {
+			etcFolder:      "rhel93",
+			mongoVersion:   "6.0.4",
+			archives:       []string{"mongodb-linux-x86_64-rhel82-6.0.4.tgz", "mongodb-linux-x86_64-rhel80-6.0.4.tgz"},
+			expectedOSName: "rhel80",
+		},
+		"No build published": {
+			etcFolder:      "ubuntu2204",
+			mongoVersion:   "6.0.4",
+			expectedOSName: "ubuntu2204",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+			server, _ := catalogServer(t, test.archives...)
+
+			spec, err := mongobin.ResolveCompatibleSpec(test.mongoVersion, linuxOverrides(test.etcFolder), silent, &mongobin.ReleaseCatalog{URL: server.URL})
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedOSName, spec.OSName)
+			assert.Equal(t, "x86_64", spec.Arch)
+			assert.Equal(t, test.mongoVersion, spec.Version)
+		})
+	}
+}
+
+func TestResolveCompatibleSpecFallsBackToHeadChecker(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	catalog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(catalog.Close)
+	mirror := headServer(t, "mongodb-linux-x86_64-ubuntu2004-6.0.4.tgz")
+
+	spec, err := mongobin.ResolveCompatibleSpec(
+		"6.0.4",
+		linuxOverrides("ubuntu2204"),
+		memongolog.New(nil, memongolog.LogLevelSilent),
+		&mongobin.ReleaseCatalog{URL: catalog.URL},
+		&mongobin.HeadChecker{URLTemplate: mirror.URL + "/{platform}/{archive}"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu2004", spec.OSName)
+}
+
+func TestResolveCompatibleSpecWhenCheckersFail(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+
+	spec, err := mongobin.ResolveCompatibleSpec(
+		"6.0.4",
+		linuxOverrides("ubuntu2204"),
+		memongolog.New(nil, memongolog.LogLevelSilent),
+		&mongobin.ReleaseCatalog{URL: server.URL},
+		&mongobin.HeadChecker{URLTemplate: server.URL + "/{archive}"},
+	)
+	require.NoError(t, err)
+
+	expectedSpec, err := mongobin.DetectSpec("6.0.4", linuxOverrides("ubuntu2204"))
+	require.NoError(t, err)
+	assert.Equal(t, expectedSpec, spec)
+}
+
+func TestReleaseCatalogIsCached(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	server, requests := catalogServer(t, "mongodb-linux-x86_64-ubuntu2004-6.0.4.tgz")
+	silent := memongolog.New(nil, memongolog.LogLevelSilent)
+
+	spec, err := mongobin.ResolveCompatibleSpec("6.0.4", linuxOverrides("ubuntu2204"), silent, &mongobin.ReleaseCatalog{URL: server.URL, CachePath: "/cache"})
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu2004", spec.OSName)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	// The cached catalog is used while it's fresh
+	spec, err = mongobin.ResolveCompatibleSpec("6.0.4", linuxOverrides("ubuntu2204"), silent, &mongobin.ReleaseCatalog{URL: server.URL, CachePath: "/cache"})
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu2004", spec.OSName)
+	assert.Equal(t, int32(1), atomic.LoadInt32(requests))
+
+	// and when it's stale, but the catalog can't be downloaded
+	oldMaxAge := mongobin.ReleaseCatalogMaxAge
+	mongobin.ReleaseCatalogMaxAge = 0
+	defer func() { mongobin.ReleaseCatalogMaxAge = oldMaxAge }()
+	server.Close()
+
+	spec, err = mongobin.ResolveCompatibleSpec("6.0.4", linuxOverrides("ubuntu2204"), silent, &mongobin.ReleaseCatalog{URL: server.URL, CachePath: "/cache"})
+	require.NoError(t, err)
+	assert.Equal(t, "ubuntu2004", spec.OSName)
+}
+
+func TestBuildCheckFailuresAreCached(t *testing.T) {
+	mongobin.Afs = afero.Afero{Fs: afero.NewMemMapFs()}
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	t.Cleanup(server.Close)
+
+	resolve := func() {
+		spec, err := mongobin.ResolveCompatibleSpec(
+			"6.0.4",
+			linuxOverrides("ubuntu2204"),
+			memongolog.New(nil, memongolog.LogLevelSilent),
+			&mongobin.ReleaseCatalog{URL: server.URL, CachePath: "/cache"},
+			&mongobin.HeadChecker{URLTemplate: server.URL + "/{archive}", CachePath: "/cache"},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, "ubuntu2204", spec.OSName)
+	}
+
+	// The catalog and one HEAD request fail
+	resolve()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// and aren't tried again for a while
+	resolve()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	oldRetryInterval := mongobin.BuildCheckRetryInterval
+	mongobin.BuildCheckRetryInterval = 0
+	defer func() { mongobin.BuildCheckRetryInterval = oldRetryInterval }()
+
+	resolve()
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+}